@@ -0,0 +1,332 @@
+/*
+Compression advisor. Tries bit slicings, field transforms and codecs on sample of real records
+and reports compression ratio and encode/decode time for each. Sample is coded in chunks like sealed files,
+so results match what storage would get
+*/
+package fixregsto
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+//DEFAULTADVISORECORDS is how many latest records FileStorage.Advise takes as sample when not told
+const DEFAULTADVISORECORDS = 16384
+
+//AdviseTransforms are transforms tried on each field
+var AdviseTransforms = []string{"", TRANSFORM_DELTA, TRANSFORM_DELTA2, TRANSFORM_DELTA + "+" + TRANSFORM_ZIGZAG, TRANSFORM_XOR}
+
+//AdviceOptions limits what advisor tries. Zero values try everything
+type AdviceOptions struct {
+	Methods     []string      //Compression methods, empty tries no compression and all registered codecs
+	Levels      []int         //Compression levels, empty is only codec default (0)
+	Slicings    [][]int       //Bit slices, empty tries no slicing, bytes, words and schema
+	Schema      *RecordSchema //Gives slicing candidate and byte order of fields
+	FileRecords int64         //Sample is coded in chunks of this many records. 0 codes sample as one chunk
+	MinEncodeMB float64       //Recommended candidate must encode at least this many MB/s. 0 no limit
+}
+
+//AdviceCandidate is measured configuration
+type AdviceCandidate struct {
+	CompressionMethod string
+	CompressionLevel  int
+	BitSlices         []int
+	FieldTransforms   []string
+	CompressedBytes   int
+	Ratio             float64 //Original size / compressed size
+	EncodeTime        time.Duration
+	DecodeTime        time.Duration
+}
+
+//EncodeMB is encoding speed in MB/s of original data
+func (p *AdviceCandidate) EncodeMB(sampleBytes int) float64 {
+	return float64(sampleBytes) / 1e6 / p.EncodeTime.Seconds()
+}
+
+//DecodeMB is decoding speed in MB/s of original data
+func (p *AdviceCandidate) DecodeMB(sampleBytes int) float64 {
+	return float64(sampleBytes) / 1e6 / p.DecodeTime.Seconds()
+}
+
+func (p *AdviceCandidate) String() string {
+	method := p.CompressionMethod
+	if len(method) == 0 {
+		method = "none"
+	}
+	transforms := strings.Join(p.FieldTransforms, ",")
+	if len(strings.Trim(transforms, ",")) == 0 {
+		transforms = "-"
+	}
+	return fmt.Sprintf("%-8s level=%-2v ratio=%6.2f bytes=%-9v encode=%-12v decode=%-12v slices=%v transforms=%v",
+		method, p.CompressionLevel, p.Ratio, p.CompressedBytes, p.EncodeTime, p.DecodeTime, p.BitSlices, transforms)
+}
+
+//Apply sets candidate compression settings to configuration. Candidate must slice like Schema if conf has it.
+//Open existing unframed storage with Migrate(oldConf, conf) when slicing or transforms change, framed files tell their own settings
+func (p *AdviceCandidate) Apply(conf *FileStorageConf) error {
+	if conf.Schema != nil && !reflect.DeepEqual(p.BitSlices, conf.Schema.BitSlices()) {
+		return fmt.Errorf("Candidate slices %v do not match schema %v", p.BitSlices, conf.Schema.BitSlices())
+	}
+	conf.CompressionMethod = p.CompressionMethod
+	conf.CompressionLevel = p.CompressionLevel
+	conf.BitSlices = p.BitSlices
+	conf.FieldTransforms = p.FieldTransforms
+	return nil
+}
+
+//Advice is result of measurements
+type Advice struct {
+	RecordSize  int64
+	SampleBytes int
+	Candidates  []AdviceCandidate //Best ratio first
+	Recommended AdviceCandidate
+}
+
+func (p *Advice) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "sample %v records of %v bytes\n", int64(p.SampleBytes)/p.RecordSize, p.RecordSize)
+	for i := range p.Candidates {
+		fmt.Fprintf(&sb, "%v\n", p.Candidates[i].String())
+	}
+	fmt.Fprintf(&sb, "recommended: %v\n", p.Recommended.String())
+	return sb.String()
+}
+
+//Advise measures candidates on sample. Sample is records, length must be multiple of record size
+func Advise(sample []byte, recordSize int64, opt AdviceOptions) (Advice, error) {
+	result := Advice{RecordSize: recordSize, SampleBytes: len(sample)}
+	if recordSize < 1 || len(sample) == 0 || int64(len(sample))%recordSize != 0 {
+		return result, fmt.Errorf("sample of %v bytes is not records of %v bytes", len(sample), recordSize)
+	}
+	if opt.Schema != nil {
+		if errSchema := opt.Schema.CheckErrors(recordSize); errSchema != nil {
+			return result, errSchema
+		}
+	}
+	methods := opt.Methods
+	if len(methods) == 0 {
+		methods = append([]string{""}, registeredCodecs()...)
+	}
+	levels := opt.Levels
+	if len(levels) == 0 {
+		levels = []int{0}
+	}
+	chunks := splitSample(sample, recordSize, opt.FileRecords)
+
+	for _, slices := range adviseSlicings(recordSize, opt) {
+		for _, transforms := range adviseTransforms(chunks, slices, opt.Schema, methods) {
+			coding := fieldCoding{bitSlices: slices, transforms: transforms, bigEndian: schemaByteOrder(opt.Schema, slices)}
+			for _, method := range methods {
+				for _, level := range levels {
+					candidate, errMeasure := measureCandidate(chunks, coding, method, level)
+					if errMeasure != nil {
+						return result, fmt.Errorf("method %v level %v slices %v: %v", method, level, slices, errMeasure)
+					}
+					candidate.Ratio = float64(len(sample)) / float64(candidate.CompressedBytes)
+					result.Candidates = append(result.Candidates, candidate)
+				}
+			}
+		}
+	}
+	sort.SliceStable(result.Candidates, func(i, j int) bool {
+		return result.Candidates[i].Ratio > result.Candidates[j].Ratio
+	})
+	result.Recommended = result.Candidates[0]
+	for _, candidate := range result.Candidates {
+		if opt.MinEncodeMB <= 0 || opt.MinEncodeMB <= candidate.EncodeMB(len(sample)) {
+			result.Recommended = candidate
+			break
+		}
+	}
+	return result, nil
+}
+
+//Advise measures compression candidates on latest records. Chunks are file sized.
+//Storage having Schema tries only slicing of schema, so candidates can be applied. maxRecords 0 is DEFAULTADVISORECORDS
+func (p *FileStorage) Advise(maxRecords int64, opt AdviceOptions) (Advice, error) {
+	if maxRecords <= 0 {
+		maxRecords = DEFAULTADVISORECORDS
+	}
+	sample, errSample := p.GetLatest(maxRecords)
+	if errSample != nil {
+		return Advice{}, errSample
+	}
+	if opt.FileRecords == 0 {
+		opt.FileRecords = p.conf.recordsPerFile()
+	}
+	if opt.Schema == nil {
+		opt.Schema = p.conf.Schema
+	}
+	if p.conf.Schema != nil && len(opt.Slicings) == 0 {
+		opt.Slicings = [][]int{p.conf.Schema.BitSlices()}
+	}
+	return Advise(sample, p.conf.RecordSize, opt)
+}
+
+func registeredCodecs() []string {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	result := make([]string, 0, len(codecs))
+	for name := range codecs {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func splitSample(sample []byte, recordSize int64, fileRecords int64) [][]byte {
+	if fileRecords <= 0 {
+		return [][]byte{sample}
+	}
+	result := [][]byte{}
+	chunkBytes := int(fileRecords * recordSize)
+	for start := 0; start < len(sample); start += chunkBytes {
+		end := start + chunkBytes
+		if len(sample) < end {
+			end = len(sample)
+		}
+		result = append(result, sample[start:end])
+	}
+	return result
+}
+
+//adviseSlicings lists slicing candidates, without duplicates
+func adviseSlicings(recordSize int64, opt AdviceOptions) [][]int {
+	candidates := opt.Slicings
+	if len(candidates) == 0 {
+		candidates = [][]int{nil}
+		if opt.Schema != nil {
+			candidates = append(candidates, opt.Schema.BitSlices())
+		}
+		for _, width := range []int64{8, 16, 32, 64} {
+			if recordSize*8%width == 0 && width < recordSize*8 {
+				slices := make([]int, recordSize*8/width)
+				for i := range slices {
+					slices[i] = int(width)
+				}
+				candidates = append(candidates, slices)
+			}
+		}
+	}
+	result := [][]int{}
+	seen := make(map[string]bool)
+	for _, slices := range candidates {
+		key := fmt.Sprint(slices)
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, slices)
+		}
+	}
+	return result
+}
+
+func schemaByteOrder(schema *RecordSchema, slices []int) []bool {
+	if schema == nil || fmt.Sprint(schema.BitSlices()) != fmt.Sprint(slices) {
+		return nil
+	}
+	result := make([]bool, len(schema.Fields))
+	for i, field := range schema.Fields {
+		result[i] = field.BigEndian
+	}
+	return result
+}
+
+//adviseTransforms gives no transforms and greedily picked transform for each field. Picking uses first compressing method
+func adviseTransforms(chunks [][]byte, slices []int, schema *RecordSchema, methods []string) [][]string {
+	result := [][]string{nil}
+	method := ""
+	for _, m := range methods {
+		if 0 < len(m) {
+			method = m
+			break
+		}
+	}
+	if len(slices) == 0 || len(method) == 0 {
+		return result
+	}
+	coding := fieldCoding{bitSlices: slices, transforms: make([]string, len(slices)), bigEndian: schemaByteOrder(schema, slices)}
+	best, errBest := compressedSize(chunks, coding, method)
+	if errBest != nil {
+		return result
+	}
+	for i, bits := range slices {
+		if 64 < bits {
+			continue
+		}
+		for _, transform := range AdviseTransforms[1:] {
+			previous := coding.transforms[i]
+			coding.transforms[i] = transform
+			size, errSize := compressedSize(chunks, coding, method)
+			if errSize == nil && size < best {
+				best = size
+				continue
+			}
+			coding.transforms[i] = previous
+		}
+	}
+	if coding.hasTransforms() {
+		result = append(result, coding.transforms)
+	}
+	return result
+}
+
+func compressedSize(chunks [][]byte, coding fieldCoding, method string) (int, error) {
+	result := 0
+	for _, chunk := range chunks {
+		coded, errCode := coding.encode(chunk)
+		if errCode != nil {
+			return 0, errCode
+		}
+		compressed, errCompress := compressBytes(coded, method, 0)
+		if errCompress != nil {
+			return 0, errCompress
+		}
+		result += len(compressed)
+	}
+	return result, nil
+}
+
+//measureCandidate codes all chunks and checks that they decode back
+func measureCandidate(chunks [][]byte, coding fieldCoding, method string, level int) (AdviceCandidate, error) {
+	result := AdviceCandidate{CompressionMethod: method, CompressionLevel: level, BitSlices: coding.bitSlices, FieldTransforms: coding.transforms}
+	compressed := make([][]byte, len(chunks))
+	tStart := time.Now()
+	for i, chunk := range chunks {
+		coded, errCode := coding.encode(chunk)
+		if errCode != nil {
+			return result, errCode
+		}
+		var errCompress error
+		compressed[i], errCompress = compressBytes(coded, method, level)
+		if errCompress != nil {
+			return result, errCompress
+		}
+		result.CompressedBytes += len(compressed[i])
+	}
+	result.EncodeTime = time.Since(tStart)
+
+	tStart = time.Now()
+	decoded := make([][]byte, len(chunks))
+	for i := range compressed {
+		payload, errDecompress := decompressBytes(compressed[i], method)
+		if errDecompress != nil {
+			return result, errDecompress
+		}
+		var errDecode error
+		decoded[i], errDecode = coding.decode(payload)
+		if errDecode != nil {
+			return result, errDecode
+		}
+	}
+	result.DecodeTime = time.Since(tStart)
+	for i := range chunks {
+		if !bytes.Equal(chunks[i], decoded[i]) {
+			return result, fmt.Errorf("chunk %v does not decode back", i)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package fixregsto
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvise(t *testing.T) {
+	sample := counterRecords(2000)
+	advice, errAdvise := Advise(sample, 16, AdviceOptions{Methods: []string{"", COMPRESSIONMETHOD_GZ, COMPRESSIONMETHOD_ZSTD}, FileRecords: 256})
+	assert.Equal(t, nil, errAdvise)
+	assert.Equal(t, len(sample), advice.SampleBytes)
+	assert.True(t, 10 < len(advice.Candidates))
+	for i := 1; i < len(advice.Candidates); i++ {
+		assert.True(t, advice.Candidates[i].Ratio <= advice.Candidates[i-1].Ratio)
+	}
+	best := advice.Recommended
+	assert.Equal(t, advice.Candidates[0], best)
+	assert.NotEqual(t, "", best.CompressionMethod)
+	assert.True(t, 0 < len(best.FieldTransforms), "%v", best.String())
+
+	for _, candidate := range advice.Candidates {
+		if len(candidate.CompressionMethod) == 0 && len(candidate.BitSlices) == 0 {
+			assert.Equal(t, float64(1), candidate.Ratio)
+		}
+	}
+
+	_, errSize := Advise(sample[:10], 16, AdviceOptions{})
+	assert.NotEqual(t, nil, errSize)
+
+	//Recommended configuration works on storage
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{Name: "advised", RecordSize: 16, MaxFileCount: 20, FileMaxSize: 16 * 256, Path: TMPTESTDIR}
+	assert.Equal(t, nil, best.Apply(&cfg))
+	assert.Equal(t, nil, cfg.CheckErrors())
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	_, errWrite := fl.Write(sample)
+	assert.Equal(t, nil, errWrite)
+	all, errAll := fl.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, sample, all)
+
+	fromStorage, errFromStorage := fl.Advise(200, AdviceOptions{Methods: []string{COMPRESSIONMETHOD_SNAPPY}, Slicings: [][]int{{32, 32, 64}}})
+	assert.Equal(t, nil, errFromStorage)
+	assert.Equal(t, 200*16, fromStorage.SampleBytes)
+	assert.Equal(t, 2, len(fromStorage.Candidates)) //Without and with transforms
+}
+
+func TestAdviseWithSchema(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	schema := RecordSchema{Fields: []SchemaField{
+		{Name: "timestamp", Bits: 32, Type: FIELDTYPE_UNSIGNED},
+		{Name: "counter", Bits: 32, Type: FIELDTYPE_UNSIGNED},
+		{Name: "temp", Bits: 64, Type: FIELDTYPE_FLOAT},
+	}}
+	cfg := FileStorageConf{Name: "advised", RecordSize: 16, MaxFileCount: 20, FileMaxSize: 16 * 256, Path: TMPTESTDIR, Schema: &schema}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	_, errWrite := fl.Write(counterRecords(1000))
+	assert.Equal(t, nil, errWrite)
+
+	advice, errAdvise := fl.Advise(0, AdviceOptions{Methods: []string{COMPRESSIONMETHOD_GZ}})
+	assert.Equal(t, nil, errAdvise)
+	for _, candidate := range advice.Candidates {
+		assert.Equal(t, []int{32, 32, 64}, candidate.BitSlices)
+	}
+	applied := cfg
+	assert.Equal(t, nil, advice.Recommended.Apply(&applied))
+	assert.Equal(t, nil, applied.CheckErrors())
+
+	bytewise := AdviceCandidate{BitSlices: []int{8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8}}
+	assert.NotEqual(t, nil, bytewise.Apply(&applied))
+	assert.Equal(t, nil, applied.CheckErrors())
+}
@@ -0,0 +1,127 @@
+/*
+Append only work file. Write appends new records to end of work file instead of rewriting whole work buffer,
+so flash is written only once per record until file is sealed.
+
+	magic "FXRA", version uint8, recordSize uint32
+	record + crc32 of record, repeated
+
+Power cut during append leaves torn entry at end. Entries are read until first incomplete entry or crc mismatch,
+recovery truncates rest away. All integers are little endian
+*/
+package fixregsto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+const (
+	APPENDWORKMAGIC   = "FXRA"
+	APPENDWORKVERSION = 1
+
+	appendWorkHeaderLen = 4 + 1 + 4
+	appendWorkCrcLen    = 4
+)
+
+//isAppendWork tells does content start like append only work file
+func isAppendWork(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(APPENDWORKMAGIC))
+}
+
+//encodeAppendEntries creates entries for records, without header
+func encodeAppendEntries(records []byte, recordSize int64) []byte {
+	count := int64(len(records)) / recordSize
+	result := make([]byte, 0, count*(recordSize+appendWorkCrcLen))
+	crc := make([]byte, appendWorkCrcLen)
+	for i := int64(0); i < count; i++ {
+		record := records[i*recordSize : (i+1)*recordSize]
+		binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(record))
+		result = append(append(result, record...), crc...)
+	}
+	return result
+}
+
+//encodeAppendWork creates complete append only work file content
+func encodeAppendWork(records []byte, recordSize int64) []byte {
+	header := make([]byte, appendWorkHeaderLen)
+	copy(header, APPENDWORKMAGIC)
+	header[4] = APPENDWORKVERSION
+	binary.LittleEndian.PutUint32(header[5:], uint32(recordSize))
+	return append(header, encodeAppendEntries(records, recordSize)...)
+}
+
+//decodeAppendWork returns records of valid entries and how many bytes from start are valid
+func decodeAppendWork(content []byte, recordSize int64) ([]byte, int64, error) {
+	if len(content) < appendWorkHeaderLen || !isAppendWork(content) {
+		return nil, 0, fmt.Errorf("not append only work file")
+	}
+	if content[4] != APPENDWORKVERSION {
+		return nil, 0, fmt.Errorf("unsupported append only work file version %v", content[4])
+	}
+	if fileRecordSize := int64(binary.LittleEndian.Uint32(content[5:])); fileRecordSize != recordSize {
+		return nil, 0, fmt.Errorf("append only work file record size is %v, configured %v", fileRecordSize, recordSize)
+	}
+	entrySize := recordSize + appendWorkCrcLen
+	result := make([]byte, 0, (int64(len(content))/entrySize)*recordSize)
+	valid := int64(appendWorkHeaderLen)
+	for valid+entrySize <= int64(len(content)) {
+		record := content[valid : valid+recordSize]
+		if crc32.ChecksumIEEE(record) != binary.LittleEndian.Uint32(content[valid+recordSize:]) {
+			break
+		}
+		result = append(result, record...)
+		valid += entrySize
+	}
+	return result, valid, nil
+}
+
+//writeAppendEntries writes entries to end of work file. Variable so tests can inject short writes
+var writeAppendEntries = func(f *os.File, entries []byte) (int, error) {
+	return f.Write(entries)
+}
+
+//appendWorkFile appends records to existing append only work file. Synced if syncFile is set
+func (p *FileStorageConf) appendWorkFile(records []byte, syncFile bool) error {
+	f, errOpen := os.OpenFile(p.BaseFileName(), os.O_WRONLY|os.O_APPEND, 0755)
+	if errOpen != nil {
+		return errOpen
+	}
+	info, errStat := f.Stat()
+	if errStat != nil {
+		f.Close()
+		return errStat
+	}
+	if _, wErr := writeAppendEntries(f, encodeAppendEntries(records, p.RecordSize)); wErr != nil {
+		f.Truncate(info.Size()) //Cut partial entry if possible. Writer rewrites whole work file next time anyway
+		f.Close()
+		return wErr
+	}
+	if !syncFile {
+		return f.Close()
+	}
+	if syncErr := f.Sync(); syncErr != nil {
+		f.Close()
+		return syncErr
+	}
+	return f.Close()
+}
+
+//truncateWorkFile cuts torn entries from end of append only work file
+func (p *FileStorageConf) truncateWorkFile(size int64) error {
+	f, errOpen := os.OpenFile(p.BaseFileName(), os.O_WRONLY, 0755)
+	if errOpen != nil {
+		return errOpen
+	}
+	if errTruncate := f.Truncate(size); errTruncate != nil {
+		f.Close()
+		return errTruncate
+	}
+	if syncErr := f.Sync(); syncErr != nil {
+		f.Close()
+		return syncErr
+	}
+	return f.Close()
+}
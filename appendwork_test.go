@@ -0,0 +1,155 @@
+package fixregsto
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendWork(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "appended",
+		RecordSize:   4,
+		MaxFileCount: 4,
+		FileMaxSize:  4 * 8,
+		Path:         TMPTESTDIR,
+		AppendWork:   true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	expected := []byte{}
+	for i := byte(0); i < 20; i++ {
+		record := []byte{i, i, i, i}
+		_, errWrite := fl.Write(record)
+		assert.Equal(t, nil, errWrite)
+		expected = append(expected, record...)
+
+		info, errStat := os.Stat(cfg.BaseFileName())
+		assert.Equal(t, nil, errStat)
+		assert.Equal(t, int64(appendWorkHeaderLen+(int(i+1)%8)*8), info.Size()) //Header and record+crc per record
+	}
+	assert.Equal(t, nil, fl.Close())
+
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	report := fl.RecoveryReport()
+	assert.True(t, report.Clean())
+	all, errAll := fl.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, expected, all)
+	assert.Equal(t, nil, fl.Close())
+
+	//Power cut during append, torn entry at end
+	f, _ := os.OpenFile(cfg.BaseFileName(), os.O_WRONLY|os.O_APPEND, 0755)
+	f.Write([]byte{20, 20, 20, 20, 1, 2})
+	f.Close()
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, int64(6), fl.RecoveryReport().TruncatedBytes)
+	all, _ = fl.ReadAll()
+	assert.Equal(t, expected, all)
+	_, errWrite := fl.Write([]byte{20, 20, 20, 20})
+	assert.Equal(t, nil, errWrite)
+	expected = append(expected, 20, 20, 20, 20)
+	assert.Equal(t, nil, fl.Close())
+
+	//Last complete entry with bad crc
+	content, _ := os.ReadFile(cfg.BaseFileName())
+	content[len(content)-1] ^= 0xFF
+	assert.Equal(t, nil, os.WriteFile(cfg.BaseFileName(), content, 0755))
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, int64(8), fl.RecoveryReport().TruncatedBytes)
+	all, _ = fl.ReadAll()
+	assert.Equal(t, expected[:len(expected)-4], all)
+	assert.Equal(t, nil, fl.Close())
+}
+
+func TestAppendWorkConversion(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "appended",
+		RecordSize:   4,
+		MaxFileCount: 4,
+		FileMaxSize:  4 * 8,
+		Path:         TMPTESTDIR,
+		Framed:       true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, errWrite := fl.Write([]byte{1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 6, 6, 6, 6, 7, 7, 7, 7, 8, 8, 8, 8, 9, 9, 9, 9})
+	assert.Equal(t, nil, errWrite)
+	assert.Equal(t, nil, fl.Close())
+
+	total := 36
+	for _, appendWork := range []bool{true, false, true} {
+		cfg.AppendWork = appendWork
+		fl, flErr = cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		content, _ := os.ReadFile(cfg.BaseFileName())
+		assert.Equal(t, appendWork, isAppendWork(content))
+		all, errAll := fl.ReadAll()
+		assert.Equal(t, nil, errAll)
+		assert.Equal(t, total, len(all))
+
+		roCfg := cfg
+		roCfg.ReadOnly = true
+		reader, errReader := roCfg.InitFileStorage()
+		assert.Equal(t, nil, errReader)
+		_, errWrite = fl.Write([]byte{10, 10, 10, 10})
+		assert.Equal(t, nil, errWrite)
+		total += 4
+		latest, errLatest := reader.GetLatest(1)
+		assert.Equal(t, nil, errLatest)
+		assert.Equal(t, []byte{10, 10, 10, 10}, latest)
+		assert.Equal(t, nil, reader.Close())
+		assert.Equal(t, nil, fl.Close())
+	}
+}
+
+func TestAppendWorkShortWrite(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "appended",
+		RecordSize:   4,
+		MaxFileCount: 4,
+		FileMaxSize:  4 * 8,
+		Path:         TMPTESTDIR,
+		AppendWork:   true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, errWrite := fl.Write([]byte{1, 1, 1, 1, 2, 2, 2, 2})
+	assert.Equal(t, nil, errWrite)
+
+	//Disk full in middle of entry
+	writeAppendEntries = func(f *os.File, entries []byte) (int, error) {
+		n, _ := f.Write(entries[:len(entries)/2])
+		return n, errors.New("no space left on device")
+	}
+	_, errWrite = fl.Write([]byte{3, 3, 3, 3})
+	writeAppendEntries = func(f *os.File, entries []byte) (int, error) {
+		return f.Write(entries)
+	}
+	assert.NotEqual(t, nil, errWrite)
+	all, _ := fl.ReadAll()
+	assert.Equal(t, []byte{1, 1, 1, 1, 2, 2, 2, 2}, all)
+
+	_, errWrite = fl.Write([]byte{4, 4, 4, 4})
+	assert.Equal(t, nil, errWrite)
+	_, errWrite = fl.Write([]byte{5, 5, 5, 5})
+	assert.Equal(t, nil, errWrite)
+	assert.Equal(t, nil, fl.Close())
+
+	//Records acknowledged after failed append survive restart
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	report := fl.RecoveryReport()
+	assert.True(t, report.Clean())
+	all, _ = fl.ReadAll()
+	assert.Equal(t, []byte{1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 5, 5, 5, 5}, all)
+	assert.Equal(t, nil, fl.Close())
+}
@@ -1,32 +1,16 @@
 /*
 Bit operations.
 Used for arranging bits for better compression
+
+Bits are numbered from most significant bit of first byte. Slicing moves same field of every struct next to each other.
+Fields are moved up to 64 bits at time and byte aligned fields are copied as bytes
 */
 package fixregsto
 
-import "fmt"
-
-func boolsToBytes(t []bool) []byte {
-	b := make([]byte, (len(t)+7)/8)
-	for i, x := range t {
-		if x {
-			b[i/8] |= 0x80 >> uint(i%8)
-		}
-	}
-	return b
-}
-
-func bytesToBools(b []byte) []bool {
-	t := make([]bool, 8*len(b))
-	for i, x := range b {
-		for j := 0; j < 8; j++ {
-			if (x<<uint(j))&0x80 == 0x80 {
-				t[8*i+j] = true
-			}
-		}
-	}
-	return t
-}
+import (
+	"encoding/binary"
+	"fmt"
+)
 
 func sumIntArr(arr []int) int {
 	result := 0
@@ -36,60 +20,138 @@ func sumIntArr(arr []int) int {
 	return result
 }
 
-func unsliceBitArr(sliced []byte, pattern []int) ([]byte, error) {
-	if len(pattern) == 0 {
-		return sliced, nil //NOP
+//readBits reads n (0-64) bits starting from bit pos. Result is on lowest bits
+func readBits(arr []byte, pos int, n int) uint64 {
+	if n == 0 {
+		return 0
 	}
+	byteIndex := pos >> 3
+	shift := uint(pos & 7)
+	var word uint64
+	if byteIndex+8 <= len(arr) {
+		word = binary.BigEndian.Uint64(arr[byteIndex:])
+	} else {
+		for i := 0; i < 8 && byteIndex+i < len(arr); i++ {
+			word |= uint64(arr[byteIndex+i]) << (56 - 8*uint(i))
+		}
+	}
+	word <<= shift
+	if 64 < int(shift)+n { //Spans 9 bytes
+		word |= uint64(arr[byteIndex+8]) >> (8 - shift)
+	}
+	return word >> (64 - uint(n))
+}
 
-	inBools := bytesToBools(sliced)
-	outBools := []bool{}
-
-	structsize := sumIntArr(pattern)
-	if len(inBools)%structsize != 0 {
-		return nil, fmt.Errorf("got %v bits, must be multiple of pattern size %v", len(inBools), structsize)
+//xorBits flips bits by n (0-64) lowest bits of value starting from bit pos. Sets value if target bits are zero
+func xorBits(arr []byte, pos int, value uint64, n int) {
+	if n == 0 {
+		return
 	}
+	byteIndex := pos >> 3
+	shift := uint(pos & 7)
+	aligned := value << (64 - uint(n)) //First bit on top
+	word := aligned >> shift
+	if byteIndex+8 <= len(arr) {
+		binary.BigEndian.PutUint64(arr[byteIndex:], binary.BigEndian.Uint64(arr[byteIndex:])^word)
+	} else {
+		for i := 0; i < 8 && byteIndex+i < len(arr); i++ {
+			arr[byteIndex+i] ^= byte(word >> (56 - 8*uint(i)))
+		}
+	}
+	if 64 < int(shift)+n {
+		arr[byteIndex+8] ^= byte(aligned << (64 - shift) >> 56)
+	}
+}
 
-	structCount := len(inBools) / structsize
-	structlist := make([][]bool, structCount)
+//writeBits replaces n (0-64) bits starting from bit pos
+func writeBits(arr []byte, pos int, value uint64, n int) {
+	xorBits(arr, pos, readBits(arr, pos, n)^value, n)
+}
 
-	offset := 0
-	for _, pat := range pattern {
-		for structIndex := 0; structIndex < structCount; structIndex++ {
-			structlist[structIndex] = append(structlist[structIndex], inBools[offset:offset+pat]...)
-			offset += pat
-		}
+func swapBytes(value uint64, byteCount int) uint64 {
+	result := uint64(0)
+	for i := 0; i < byteCount; i++ {
+		result = result<<8 | value&0xFF
+		value >>= 8
 	}
+	return result
+}
 
-	for _, arr := range structlist {
-		outBools = append(outBools, arr...)
+//readField reads numeric field. Little endian byte order is used only when field is whole bytes
+func readField(arr []byte, pos int, bits int, bigEndian bool) uint64 {
+	value := readBits(arr, pos, bits)
+	if !bigEndian && bits%8 == 0 {
+		return swapBytes(value, bits/8)
 	}
+	return value
+}
 
-	return boolsToBytes(outBools), nil
+//writeField is reverse of readField
+func writeField(arr []byte, pos int, bits int, bigEndian bool, value uint64) {
+	if !bigEndian && bits%8 == 0 {
+		value = swapBytes(value, bits/8)
+	}
+	writeBits(arr, pos, value, bits)
 }
 
-func sliceBitArr(arrIn []byte, pattern []int) ([]byte, error) {
+//transposeBits moves every field of pattern between struct order and sliced order
+func transposeBits(arrIn []byte, pattern []int, slicing bool) ([]byte, error) {
 	if len(pattern) == 0 {
 		return arrIn, nil //NOP
 	}
-	inBools := bytesToBools(arrIn)
-	outBools := []bool{}
-
 	structsize := sumIntArr(pattern)
-	if len(inBools)%structsize != 0 {
-		return nil, fmt.Errorf("got %v bits, must be multiple of pattern size %v", len(inBools), structsize)
+	totalBits := len(arrIn) * 8
+	if structsize <= 0 || totalBits%structsize != 0 {
+		return nil, fmt.Errorf("got %v bits, must be multiple of pattern size %v", totalBits, structsize)
 	}
+	structCount := totalBits / structsize
+	result := make([]byte, len(arrIn))
 
-	structCount := len(inBools) / structsize
 	offset := 0 //inside struct
 	for _, pat := range pattern {
+		slicedStart := offset * structCount //Where this field starts on sliced array
+
+		if structsize%8 == 0 && offset%8 == 0 && pat%8 == 0 { //Byte aligned, copy as bytes
+			structBytes := structsize / 8
+			fieldBytes := pat / 8
+			sliced := slicedStart / 8
+			for structAddress := offset / 8; structAddress < len(arrIn); structAddress += structBytes {
+				if slicing {
+					copy(result[sliced:sliced+fieldBytes], arrIn[structAddress:structAddress+fieldBytes])
+				} else {
+					copy(result[structAddress:structAddress+fieldBytes], arrIn[sliced:sliced+fieldBytes])
+				}
+				sliced += fieldBytes
+			}
+			offset += pat
+			continue
+		}
+
+		sliced := slicedStart
 		for structIndex := 0; structIndex < structCount; structIndex++ {
-			startAddress := structsize*structIndex + offset
-			outBools = append(outBools, inBools[startAddress:startAddress+pat]...)
+			structAddress := structsize*structIndex + offset
+			for done := 0; done < pat; done += 64 { //Wide fields are moved in pieces
+				n := pat - done
+				if 64 < n {
+					n = 64
+				}
+				if slicing {
+					xorBits(result, sliced, readBits(arrIn, structAddress+done, n), n)
+				} else {
+					xorBits(result, structAddress+done, readBits(arrIn, sliced, n), n)
+				}
+				sliced += n
+			}
 		}
 		offset += pat
 	}
-	if len(outBools) != len(inBools) {
-		return nil, fmt.Errorf("internal error outbool len=%v inbool len=%v", len(outBools), len(inBools))
-	}
-	return boolsToBytes(outBools), nil
+	return result, nil
+}
+
+func unsliceBitArr(sliced []byte, pattern []int) ([]byte, error) {
+	return transposeBits(sliced, pattern, false)
+}
+
+func sliceBitArr(arrIn []byte, pattern []int) ([]byte, error) {
+	return transposeBits(arrIn, pattern, true)
 }
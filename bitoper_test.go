@@ -1,7 +1,9 @@
 package fixregsto
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -80,3 +82,159 @@ func TestSlicing2(t *testing.T) {
 	assert.Equal(t, nil, errUn)
 	assert.Equal(t, inputdata, inputBack)
 }
+
+/*
+Reference implementation, bit by bit with []bool. Word level version must give same output
+*/
+
+func boolsToBytes(t []bool) []byte {
+	b := make([]byte, (len(t)+7)/8)
+	for i, x := range t {
+		if x {
+			b[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return b
+}
+func bytesToBools(b []byte) []bool {
+	t := make([]bool, 8*len(b))
+	for i, x := range b {
+		for j := 0; j < 8; j++ {
+			if (x<<uint(j))&0x80 == 0x80 {
+				t[8*i+j] = true
+			}
+		}
+	}
+	return t
+}
+
+func unsliceBitArrReference(sliced []byte, pattern []int) ([]byte, error) {
+	if len(pattern) == 0 {
+		return sliced, nil //NOP
+	}
+
+	inBools := bytesToBools(sliced)
+	outBools := []bool{}
+
+	structsize := sumIntArr(pattern)
+	if len(inBools)%structsize != 0 {
+		return nil, fmt.Errorf("got %v bits, must be multiple of pattern size %v", len(inBools), structsize)
+	}
+
+	structCount := len(inBools) / structsize
+	structlist := make([][]bool, structCount)
+
+	offset := 0
+	for _, pat := range pattern {
+		for structIndex := 0; structIndex < structCount; structIndex++ {
+			structlist[structIndex] = append(structlist[structIndex], inBools[offset:offset+pat]...)
+			offset += pat
+		}
+	}
+
+	for _, arr := range structlist {
+		outBools = append(outBools, arr...)
+	}
+
+	return boolsToBytes(outBools), nil
+}
+
+func sliceBitArrReference(arrIn []byte, pattern []int) ([]byte, error) {
+	if len(pattern) == 0 {
+		return arrIn, nil //NOP
+	}
+	inBools := bytesToBools(arrIn)
+	outBools := []bool{}
+
+	structsize := sumIntArr(pattern)
+	if len(inBools)%structsize != 0 {
+		return nil, fmt.Errorf("got %v bits, must be multiple of pattern size %v", len(inBools), structsize)
+	}
+
+	structCount := len(inBools) / structsize
+	offset := 0 //inside struct
+	for _, pat := range pattern {
+		for structIndex := 0; structIndex < structCount; structIndex++ {
+			startAddress := structsize*structIndex + offset
+			outBools = append(outBools, inBools[startAddress:startAddress+pat]...)
+		}
+		offset += pat
+	}
+	if len(outBools) != len(inBools) {
+		return nil, fmt.Errorf("internal error outbool len=%v inbool len=%v", len(outBools), len(inBools))
+	}
+	return boolsToBytes(outBools), nil
+}
+
+func TestSlicingMatchesReference(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	patterns := [][]int{
+		{8}, {1, 7}, {32, 16, 8, 8}, {12, 4, 7, 1, 8}, {3, 5, 11, 13}, {64, 64}, {100, 28}, {1, 2, 3, 4, 5, 6, 7, 8, 9, 11}, {0, 8, 0},
+	}
+	for i := 0; i < 20; i++ { //Random patterns, not always byte aligned structs
+		pattern := make([]int, 1+rnd.Intn(6))
+		for j := range pattern {
+			pattern[j] = 1 + rnd.Intn(70)
+		}
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		structsize := sumIntArr(pattern)
+		for _, structCount := range []int{8, 16, 200} { //Multiple of 8, so whole bytes
+			input := make([]byte, structsize*structCount/8)
+			rnd.Read(input)
+			sliced, err := sliceBitArr(input, pattern)
+			assert.Equal(t, nil, err)
+			reference, _ := sliceBitArrReference(input, pattern)
+			assert.Equal(t, reference, sliced, "pattern %v", pattern)
+			back, errBack := unsliceBitArr(sliced, pattern)
+			assert.Equal(t, nil, errBack)
+			assert.Equal(t, input, back, "pattern %v", pattern)
+		}
+	}
+	_, errSize := sliceBitArr([]byte{1, 2, 3}, []int{16})
+	assert.NotEqual(t, nil, errSize)
+	_, errEmpty := sliceBitArr([]byte{1, 2, 3}, []int{0})
+	assert.NotEqual(t, nil, errEmpty)
+}
+
+/*
+Benchmarks with sealed file sized input
+*/
+
+const BENCHSLICEBYTES = 256 * 1024
+
+func benchmarkSlicing(b *testing.B, pattern []int, f func([]byte, []int) ([]byte, error)) {
+	input := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, BENCHSLICEBYTES/16)
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f(input, pattern); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSliceAligned(b *testing.B) {
+	benchmarkSlicing(b, []int{32, 16, 8, 8, 64}, sliceBitArr)
+}
+
+func BenchmarkSliceAlignedReference(b *testing.B) {
+	benchmarkSlicing(b, []int{32, 16, 8, 8, 64}, sliceBitArrReference)
+}
+
+func BenchmarkSliceBits(b *testing.B) {
+	benchmarkSlicing(b, []int{12, 4, 7, 1, 40, 64}, sliceBitArr)
+}
+
+func BenchmarkSliceBitsReference(b *testing.B) {
+	benchmarkSlicing(b, []int{12, 4, 7, 1, 40, 64}, sliceBitArrReference)
+}
+
+func BenchmarkUnsliceBits(b *testing.B) {
+	benchmarkSlicing(b, []int{12, 4, 7, 1, 40, 64}, unsliceBitArr)
+}
+
+func BenchmarkUnsliceBitsReference(b *testing.B) {
+	benchmarkSlicing(b, []int{12, 4, 7, 1, 40, 64}, unsliceBitArrReference)
+}
@@ -0,0 +1,500 @@
+/*
+Block device based storage. Uses fixed size region of raw block device (or preallocated image file)
+as ring of erase block aligned sectors. No filesystem is needed.
+
+Sector 0 of region is superblock. Rest are data sectors, each starts with sector header having sequence number.
+Sector with sequence number seq is always at data sector seq % sectorCount, so head and tail are found
+after reboot by scanning sector headers.
+
+Each record slot in sector is crc32 + record. Crc covers sector sequence number and slot index so stale
+records from previous round of ring are not valid. Records are only appended to sector, torn write
+can only damage records that were not yet acknowledged
+*/
+package fixregsto
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	BLOCKSUPERMAGIC  = "FXRSBLK1"
+	BLOCKSECTORMAGIC = "FXRB"
+
+	blockSectorHeaderSize = 16 //magic, seq uint64, crc uint32
+	blockSlotCrcSize      = 4
+)
+
+//BlockStorageConf tells what region of device is used
+//DevicePath, block device like /dev/mmcblk0p3 or image file. Image file is extended if it is too small
+//Offset and Size, region on device. Must be multiple of SectorSize
+//SectorSize, erase block size of device. Multiple of 512
+//Format, region without superblock is formatted. Otherwise it is error, so wrong partition or image is not destroyed
+type BlockStorageConf struct {
+	DevicePath string
+	Offset     int64
+	Size       int64
+	SectorSize int64
+	RecordSize int64
+	Format     bool
+}
+
+//BlockStorage implements FixRegSto on raw block device
+type BlockStorage struct {
+	conf BlockStorageConf
+	f    *os.File
+
+	sectorCount      int64 //Data sectors, superblock excluded
+	recordsPerSector int64
+
+	empty     bool   //No sectors written yet
+	headSeq   uint64 //Sector being filled
+	headCount int64  //Records on head sector
+	tailSeq   uint64 //Oldest sector
+
+	mu      *sync.RWMutex //Write locks, reads share
+	cursor  *Cursor       //Used by Read and Seek
+	changes *changeNotifier
+	closed  *closeState
+}
+
+type blockSuperblock struct {
+	Magic       [8]byte
+	Version     uint32
+	RecordSize  uint32
+	SectorSize  uint32
+	SectorCount uint32
+}
+
+//CheckErrors tell is there problems with configuration
+func (p *BlockStorageConf) CheckErrors() error {
+	if p.RecordSize < 1 {
+		return fmt.Errorf("Invalid RecordSize %v", p.RecordSize)
+	}
+	if p.SectorSize < 512 || p.SectorSize%512 != 0 {
+		return fmt.Errorf("Invalid SectorSize %v, must be multiple of 512", p.SectorSize)
+	}
+	if p.Offset < 0 || p.Offset%p.SectorSize != 0 {
+		return fmt.Errorf("Offset %v is not aligned to SectorSize %v", p.Offset, p.SectorSize)
+	}
+	if p.Size%p.SectorSize != 0 {
+		return fmt.Errorf("Size %v is not multiple of SectorSize %v", p.Size, p.SectorSize)
+	}
+	if p.Size/p.SectorSize < 3 {
+		return fmt.Errorf("Size %v is too small, at least superblock and two data sectors are needed", p.Size)
+	}
+	if p.recordsPerSector() < 1 {
+		return fmt.Errorf("RecordSize %v does not fit to SectorSize %v", p.RecordSize, p.SectorSize)
+	}
+	return nil
+}
+
+func (p *BlockStorageConf) recordsPerSector() int64 {
+	return (p.SectorSize - blockSectorHeaderSize) / (p.RecordSize + blockSlotCrcSize)
+}
+
+func (p *BlockStorageConf) superblock() blockSuperblock {
+	result := blockSuperblock{
+		Version:     1,
+		RecordSize:  uint32(p.RecordSize),
+		SectorSize:  uint32(p.SectorSize),
+		SectorCount: uint32(p.Size/p.SectorSize - 1),
+	}
+	copy(result.Magic[:], BLOCKSUPERMAGIC)
+	return result
+}
+
+//InitBlockStorage opens device and finds head and tail of ring. Unformatted region is formatted only if Format is set
+func (p *BlockStorageConf) InitBlockStorage() (BlockStorage, error) {
+	result := BlockStorage{conf: *p, mu: &sync.RWMutex{}, cursor: &Cursor{}, changes: newChangeNotifier(), closed: &closeState{}, sectorCount: p.Size/p.SectorSize - 1, recordsPerSector: p.recordsPerSector()}
+	if errConf := p.CheckErrors(); errConf != nil {
+		return result, errConf
+	}
+	f, errOpen := os.OpenFile(p.DevicePath, os.O_RDWR, 0)
+	if errOpen != nil {
+		return result, fmt.Errorf("Error opening device %v err=%v", p.DevicePath, errOpen.Error())
+	}
+	result.f = f
+
+	fInfo, errStat := f.Stat()
+	if errStat != nil {
+		f.Close()
+		return result, errStat
+	}
+	if fInfo.Mode().IsRegular() && fInfo.Size() < p.Offset+p.Size { //Image file
+		if errTruncate := f.Truncate(p.Offset + p.Size); errTruncate != nil {
+			f.Close()
+			return result, fmt.Errorf("Error extending image file %v err=%v", p.DevicePath, errTruncate.Error())
+		}
+	}
+
+	errMount := result.mount()
+	if errMount != nil {
+		f.Close()
+		return result, errMount
+	}
+	if _, errSeek := result.Seek(0, io.SeekStart); errSeek != nil {
+		f.Close()
+		return result, errSeek
+	}
+	return result, nil
+}
+
+//Close releases device and stops followers
+func (p *BlockStorage) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return ErrClosed
+	}
+	p.closed.closed = true
+	p.changes.notify()
+	return p.f.Close()
+}
+
+//Flush syncs device. Write already syncs, so there is nothing buffered after successful Write
+func (p *BlockStorage) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return ErrClosed
+	}
+	return p.f.Sync()
+}
+
+func (p *BlockStorage) sectorOffset(seq uint64) int64 {
+	return p.conf.Offset + p.conf.SectorSize*(1+int64(seq%uint64(p.sectorCount)))
+}
+
+func (p *BlockStorage) slotOffset(seq uint64, index int64) int64 {
+	return p.sectorOffset(seq) + blockSectorHeaderSize + index*(p.conf.RecordSize+blockSlotCrcSize)
+}
+
+func encodeBlockSectorHeader(seq uint64) []byte {
+	result := make([]byte, blockSectorHeaderSize)
+	copy(result, BLOCKSECTORMAGIC)
+	binary.LittleEndian.PutUint64(result[4:], seq)
+	binary.LittleEndian.PutUint32(result[12:], crc32.ChecksumIEEE(result[0:12]))
+	return result
+}
+
+func blockSlotCrc(seq uint64, index int64, record []byte) uint32 {
+	var prefix [12]byte
+	binary.LittleEndian.PutUint64(prefix[0:], seq)
+	binary.LittleEndian.PutUint32(prefix[8:], uint32(index))
+	return crc32.Update(crc32.ChecksumIEEE(prefix[:]), crc32.IEEETable, record)
+}
+
+//readSectorHeader returns sequence number of data sector at index. False if sector is not valid
+func (p *BlockStorage) readSectorHeader(index int64) (uint64, bool, error) {
+	buf := make([]byte, blockSectorHeaderSize)
+	if _, errRead := p.f.ReadAt(buf, p.conf.Offset+p.conf.SectorSize*(1+index)); errRead != nil {
+		return 0, false, errRead
+	}
+	if string(buf[0:4]) != BLOCKSECTORMAGIC || binary.LittleEndian.Uint32(buf[12:]) != crc32.ChecksumIEEE(buf[0:12]) {
+		return 0, false, nil
+	}
+	seq := binary.LittleEndian.Uint64(buf[4:])
+	return seq, int64(seq%uint64(p.sectorCount)) == index, nil
+}
+
+func (p *BlockStorage) format() error {
+	var buf bytes.Buffer
+	sb := p.conf.superblock()
+	binary.Write(&buf, binary.LittleEndian, sb)
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	//Clear old sector headers, there might be something from earlier use
+	zeroHeader := make([]byte, blockSectorHeaderSize)
+	for i := int64(0); i < p.sectorCount; i++ {
+		if _, errWrite := p.f.WriteAt(zeroHeader, p.conf.Offset+p.conf.SectorSize*(1+i)); errWrite != nil {
+			return errWrite
+		}
+	}
+	if errSync := p.f.Sync(); errSync != nil {
+		return errSync
+	}
+	if _, errWrite := p.f.WriteAt(buf.Bytes(), p.conf.Offset); errWrite != nil {
+		return errWrite
+	}
+	return p.f.Sync()
+}
+
+//mount reads superblock and scans sectors for head and tail
+func (p *BlockStorage) mount() error {
+	raw := make([]byte, binary.Size(blockSuperblock{})+4)
+	if _, errRead := p.f.ReadAt(raw, p.conf.Offset); errRead != nil {
+		return fmt.Errorf("Error reading superblock err=%v", errRead.Error())
+	}
+	expected := p.conf.superblock()
+	if string(raw[0:8]) != BLOCKSUPERMAGIC {
+		if !p.conf.Format {
+			return fmt.Errorf("No superblock on %v offset %v, set Format to format region", p.conf.DevicePath, p.conf.Offset)
+		}
+		if errFormat := p.format(); errFormat != nil {
+			return fmt.Errorf("Error formatting %v err=%v", p.conf.DevicePath, errFormat.Error())
+		}
+		p.empty = true
+		return nil
+	}
+	var sb blockSuperblock
+	binary.Read(bytes.NewReader(raw), binary.LittleEndian, &sb)
+	if binary.LittleEndian.Uint32(raw[len(raw)-4:]) != crc32.ChecksumIEEE(raw[0:len(raw)-4]) {
+		return fmt.Errorf("Superblock crc mismatch on %v", p.conf.DevicePath)
+	}
+	if sb != expected {
+		return fmt.Errorf("Superblock %#v does not match configuration %#v", sb, expected)
+	}
+
+	found := false
+	valid := make(map[uint64]bool)
+	for i := int64(0); i < p.sectorCount; i++ {
+		seq, ok, errHeader := p.readSectorHeader(i)
+		if errHeader != nil {
+			return errHeader
+		}
+		if !ok {
+			continue
+		}
+		valid[seq] = true
+		if !found || p.headSeq < seq {
+			p.headSeq = seq
+		}
+		found = true
+	}
+	if !found {
+		p.empty = true
+		return nil
+	}
+	p.tailSeq = p.headSeq
+	for 0 < p.tailSeq && valid[p.tailSeq-1] && p.headSeq-(p.tailSeq-1) < uint64(p.sectorCount) {
+		p.tailSeq--
+	}
+
+	headCount, errCount := p.validRecordsInSector(p.headSeq)
+	if errCount != nil {
+		return errCount
+	}
+	p.headCount = headCount
+	return nil
+}
+
+//validRecordsInSector counts records from start of sector until first invalid slot
+func (p *BlockStorage) validRecordsInSector(seq uint64) (int64, error) {
+	buf := make([]byte, p.conf.SectorSize-blockSectorHeaderSize)
+	if _, errRead := p.f.ReadAt(buf, p.sectorOffset(seq)+blockSectorHeaderSize); errRead != nil {
+		return 0, errRead
+	}
+	slotSize := p.conf.RecordSize + blockSlotCrcSize
+	for i := int64(0); i < p.recordsPerSector; i++ {
+		slot := buf[i*slotSize : (i+1)*slotSize]
+		if binary.LittleEndian.Uint32(slot) != blockSlotCrc(seq, i, slot[blockSlotCrcSize:]) {
+			return i, nil
+		}
+	}
+	return p.recordsPerSector, nil
+}
+
+func (p *BlockStorage) firstPosition() int64 {
+	return int64(p.tailSeq) * p.recordsPerSector
+}
+
+func (p *BlockStorage) endPosition() int64 {
+	if p.empty {
+		return 0
+	}
+	return int64(p.headSeq)*p.recordsPerSector + p.headCount
+}
+
+//Write implements writer interface. Only complete records are accepted
+func (p *BlockStorage) Write(raw []byte) (n int, err error) {
+	if len(raw)%int(p.conf.RecordSize) != 0 {
+		return 0, fmt.Errorf("Appended data length %v is not multiple of %v", len(raw), p.conf.RecordSize)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return 0, ErrClosed
+	}
+	defer p.changes.notify()
+	originalTotal := len(raw)
+	for 0 < len(raw) {
+		headSeq := p.headSeq
+		headCount := p.headCount
+		var chunk []byte
+		if p.empty || headCount == p.recordsPerSector { //Start new sector, overwrites oldest
+			if !p.empty {
+				headSeq++
+			}
+			headCount = 0
+			chunk = encodeBlockSectorHeader(headSeq)
+		}
+		start := p.slotOffset(headSeq, headCount) - int64(len(chunk))
+		written := 0
+		for written < len(raw) && headCount < p.recordsPerSector {
+			record := raw[written : written+int(p.conf.RecordSize)]
+			crc := make([]byte, blockSlotCrcSize)
+			binary.LittleEndian.PutUint32(crc, blockSlotCrc(headSeq, headCount, record))
+			chunk = append(chunk, crc...)
+			chunk = append(chunk, record...)
+			written += int(p.conf.RecordSize)
+			headCount++
+		}
+		if _, errWrite := p.f.WriteAt(chunk, start); errWrite != nil {
+			return originalTotal - len(raw), errWrite
+		}
+		p.empty = false
+		p.headSeq = headSeq
+		p.headCount = headCount
+		if uint64(p.sectorCount) <= p.headSeq-p.tailSeq {
+			p.tailSeq = p.headSeq - uint64(p.sectorCount) + 1
+		}
+		raw = raw[written:]
+	}
+	if errSync := p.f.Sync(); errSync != nil {
+		return 0, errSync
+	}
+	return originalTotal, nil
+}
+
+//readRecords reads records between absolute positions
+func (p *BlockStorage) readRecords(from int64, to int64) ([]byte, error) {
+	result := make([]byte, 0, (to-from)*p.conf.RecordSize)
+	slotSize := p.conf.RecordSize + blockSlotCrcSize
+	for from < to {
+		seq := uint64(from / p.recordsPerSector)
+		index := from % p.recordsPerSector
+		count := p.recordsPerSector - index
+		if to-from < count {
+			count = to - from
+		}
+		buf := make([]byte, count*slotSize)
+		if _, errRead := p.f.ReadAt(buf, p.slotOffset(seq, index)); errRead != nil {
+			return result, errRead
+		}
+		for i := int64(0); i < count; i++ {
+			slot := buf[i*slotSize : (i+1)*slotSize]
+			if binary.LittleEndian.Uint32(slot) != blockSlotCrc(seq, index+i, slot[blockSlotCrcSize:]) {
+				return result, &CorruptedError{Filename: p.conf.DevicePath, Records: []int64{from + i}}
+			}
+			result = append(result, slot[blockSlotCrcSize:]...)
+		}
+		from += count
+	}
+	return result, nil
+}
+
+//Len returns how many records are stored
+func (p *BlockStorage) Len() (int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return 0, ErrClosed
+	}
+	return p.endPosition() - p.firstPosition(), nil
+}
+
+//GetLatest nRecords without moving seek cursor
+func (p *BlockStorage) GetLatest(nRecords int64) ([]byte, error) {
+	if nRecords < 1 {
+		return nil, fmt.Errorf("wrong parameter nRecords=%v", nRecords)
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
+	from := p.endPosition() - nRecords
+	if from < p.firstPosition() {
+		from = p.firstPosition()
+	}
+	return p.readRecords(from, p.endPosition())
+}
+
+//GetFirst nRecords without moving seek cursor
+func (p *BlockStorage) GetFirst(nRecords int64) ([]byte, error) {
+	if nRecords < 1 {
+		return nil, fmt.Errorf("wrong parameter nRecords=%v", nRecords)
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
+	to := p.firstPosition() + nRecords
+	if p.endPosition() < to {
+		to = p.endPosition()
+	}
+	return p.readRecords(p.firstPosition(), to)
+}
+
+//ReadAll gets all content. Use with caution, small storages
+func (p *BlockStorage) ReadAll() ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
+	return p.readRecords(p.firstPosition(), p.endPosition())
+}
+
+//Read implements Reader interface.  Except only array length must be multiple of recordsize for normal operation
+func (p *BlockStorage) Read(arr []byte) (n int, err error) {
+	return p.cursor.readFrom(p, arr)
+}
+
+//Seeks, For implementing seeker interface
+//Seeks with byte by byte but rounds new position to where record starts
+func (p *BlockStorage) Seek(offset int64, whence int) (int64, error) {
+	return p.cursor.readSeekFrom(p, offset, whence)
+}
+
+//NewCursor creates independent reader at first record. Cursor refers to this BlockStorage, do not copy BlockStorage after that
+func (p *BlockStorage) NewCursor() (*Cursor, error) {
+	return newCursor(p)
+}
+
+//Follow delivers records from offset and then new records as those are written.
+//Subscription refers to this BlockStorage, do not copy BlockStorage after that
+func (p *BlockStorage) Follow(ctx context.Context, offset int64, whence int) (*Subscription, error) {
+	return follow(ctx, p, p.changes, offset, whence, 0, nil)
+}
+
+//RecordSize tells how long one record is in bytes
+func (p *BlockStorage) RecordSize() int64 {
+	return p.conf.RecordSize
+}
+
+func (p *BlockStorage) positionRange() (int64, int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return 0, 0, ErrClosed
+	}
+	return p.firstPosition(), p.endPosition(), nil
+}
+
+func (p *BlockStorage) readRecordsAt(position int64, maxRecords int64) ([]byte, int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, position, ErrClosed
+	}
+	if position < p.firstPosition() { //If already overwritten
+		position = p.firstPosition()
+	}
+	to := position + maxRecords
+	if p.endPosition() < to {
+		to = p.endPosition()
+	}
+	if to <= position {
+		return []byte{}, position, nil
+	}
+	byt, errRead := p.readRecords(position, to)
+	return byt, position + int64(len(byt))/p.conf.RecordSize, errRead
+}
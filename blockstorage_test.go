@@ -0,0 +1,121 @@
+package fixregsto
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TMPBLOCKIMAGE = "/tmp/blocktest12356789.img"
+)
+
+func blockTestRecord(i int) []byte {
+	return []byte{byte(i >> 8), byte(i), 3, 4, 5, 6, 7, 8}
+}
+
+func TestBlockStorage(t *testing.T) {
+	os.Remove(TMPBLOCKIMAGE)
+	f, errCreate := os.Create(TMPBLOCKIMAGE)
+	assert.Equal(t, nil, errCreate)
+	f.Close()
+
+	cfg := BlockStorageConf{
+		DevicePath: TMPBLOCKIMAGE,
+		Offset:     512,
+		Size:       512 * 4, //superblock + 3 data sectors
+		SectorSize: 512,
+		RecordSize: 8,
+	}
+	rps := int(cfg.recordsPerSector()) //41
+
+	//Unformatted region is not formatted without asking
+	_, errUnformatted := cfg.InitBlockStorage()
+	assert.NotEqual(t, nil, errUnformatted)
+	cfg.Format = true
+
+	sto, errInit := cfg.InitBlockStorage()
+	assert.Equal(t, nil, errInit)
+	n, errLen := sto.Len()
+	assert.Equal(t, nil, errLen)
+	assert.Equal(t, int64(0), n)
+	empty, errEmpty := io.ReadAll(&sto)
+	assert.Equal(t, nil, errEmpty)
+	assert.Equal(t, []byte{}, empty)
+
+	_, errWrong := sto.Write([]byte{1, 2, 3})
+	assert.NotEqual(t, nil, errWrong)
+
+	for i := 0; i < rps+5; i++ {
+		_, errWrite := sto.Write(blockTestRecord(i))
+		assert.Equal(t, nil, errWrite)
+	}
+	assert.Equal(t, nil, sto.Close())
+
+	//Reboot finds head from sequence numbers
+	sto, errInit = cfg.InitBlockStorage()
+	assert.Equal(t, nil, errInit)
+	n, _ = sto.Len()
+	assert.Equal(t, int64(rps+5), n)
+	latest, errLatest := sto.GetLatest(1)
+	assert.Equal(t, nil, errLatest)
+	assert.Equal(t, blockTestRecord(rps+4), latest)
+	first, errFirst := sto.GetFirst(2)
+	assert.Equal(t, nil, errFirst)
+	assert.Equal(t, append(blockTestRecord(0), blockTestRecord(1)...), first)
+
+	//Fill over ring, oldest sector is overwritten
+	big := []byte{}
+	for i := rps + 5; i < 4*rps; i++ {
+		big = append(big, blockTestRecord(i)...)
+	}
+	wrote, errBig := sto.Write(big)
+	assert.Equal(t, nil, errBig)
+	assert.Equal(t, len(big), wrote)
+	n, _ = sto.Len()
+	assert.Equal(t, int64(3*rps), n)
+	all, errAll := sto.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, 3*rps*8, len(all))
+	assert.Equal(t, blockTestRecord(rps), all[0:8])
+
+	pos, errSeek := sto.Seek(-16, io.SeekEnd)
+	assert.Equal(t, nil, errSeek)
+	assert.Equal(t, int64((4*rps-2)*8), pos)
+	tail, errTail := io.ReadAll(&sto)
+	assert.Equal(t, nil, errTail)
+	assert.Equal(t, append(blockTestRecord(4*rps-2), blockTestRecord(4*rps-1)...), tail)
+	assert.Equal(t, nil, sto.Close())
+
+	//Torn header of next sector destroys oldest sector only. Flipped bit on old record
+	img, errImg := os.OpenFile(TMPBLOCKIMAGE, os.O_RDWR, 0)
+	assert.Equal(t, nil, errImg)
+	_, errTorn := img.WriteAt([]byte{'F', 'X', 'R', 'B', 4, 0}, sto.sectorOffset(sto.headSeq+1))
+	assert.Equal(t, nil, errTorn)
+	_, errFlip := img.WriteAt([]byte{0xEE}, sto.slotOffset(sto.headSeq-1, 1)+5)
+	assert.Equal(t, nil, errFlip)
+	img.Close()
+
+	sto, errInit = cfg.InitBlockStorage()
+	assert.Equal(t, nil, errInit)
+	n, _ = sto.Len()
+	assert.Equal(t, int64(2*rps), n)
+	_, errCorrupt := sto.GetFirst(3)
+	var corruptErr *CorruptedError
+	assert.True(t, errors.As(errCorrupt, &corruptErr))
+	assert.Equal(t, []int64{int64(2*rps) + 1}, corruptErr.Records)
+
+	_, errWrite := sto.Write(blockTestRecord(4 * rps))
+	assert.Equal(t, nil, errWrite)
+	latest, _ = sto.GetLatest(1)
+	assert.Equal(t, blockTestRecord(4*rps), latest)
+	assert.Equal(t, nil, sto.Close())
+
+	//Other geometry on same region is refused
+	cfg.RecordSize = 16
+	_, errMismatch := cfg.InitBlockStorage()
+	assert.NotEqual(t, nil, errMismatch)
+}
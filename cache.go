@@ -0,0 +1,111 @@
+/*
+Cache of decompressed sealed files. Sequential reads and cursors touch same file many times,
+so records are kept in memory and file is decompressed only once.
+Least recently used file is dropped when cache is full. Entry is valid while it is same file (inode) with same size and
+modification time. Recompression, Migrate and Restore keep modification times, but those replace file with new one
+*/
+package fixregsto
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+//DEFAULTCACHEFILES is used when CacheFiles is not set
+const DEFAULTCACHEFILES = 4
+
+type cacheEntry struct {
+	fileNumber int64
+	info       os.FileInfo
+	records    []byte
+}
+
+//fileCache is LRU keyed by file number. Safe for concurrent use
+type fileCache struct {
+	mu       sync.Mutex
+	maxFiles int
+	entries  map[int64]*list.Element
+	order    *list.List //Most recently used first
+}
+
+//newFileCache creates cache. Nil cache (maxFiles 0) is valid and does not cache
+func newFileCache(maxFiles int) *fileCache {
+	if maxFiles <= 0 {
+		return nil
+	}
+	return &fileCache{maxFiles: maxFiles, entries: make(map[int64]*list.Element), order: list.New()}
+}
+
+//get returns cached records if file is not changed after caching. Returned slice must not be modified
+func (p *fileCache) get(fileNumber int64, info os.FileInfo) ([]byte, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	element, haz := p.entries[fileNumber]
+	if !haz {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !os.SameFile(entry.info, info) || entry.info.Size() != info.Size() || !entry.info.ModTime().Equal(info.ModTime()) {
+		p.order.Remove(element)
+		delete(p.entries, fileNumber)
+		return nil, false
+	}
+	p.order.MoveToFront(element)
+	return entry.records, true
+}
+
+func (p *fileCache) put(fileNumber int64, info os.FileInfo, records []byte) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry := &cacheEntry{fileNumber: fileNumber, info: info, records: records[:len(records):len(records)]} //Append copies
+	if element, haz := p.entries[fileNumber]; haz {
+		element.Value = entry
+		p.order.MoveToFront(element)
+		return
+	}
+	p.entries[fileNumber] = p.order.PushFront(entry)
+	for p.maxFiles < p.order.Len() {
+		oldest := p.order.Back()
+		p.order.Remove(oldest)
+		delete(p.entries, oldest.Value.(*cacheEntry).fileNumber)
+	}
+}
+
+func (p *fileCache) remove(fileNumber int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if element, haz := p.entries[fileNumber]; haz {
+		p.order.Remove(element)
+		delete(p.entries, fileNumber)
+	}
+}
+
+//fileRecords reads records of sealed file trough cache, obeys SkipCorrupted. Returned slice must not be modified
+func (p *FileStorage) fileRecords(fileNumber int64) ([]byte, error) {
+	info, errStat := os.Stat(p.conf.filename(fileNumber))
+	if os.IsNotExist(errStat) {
+		return nil, nil //Removed after listing, same as missing file
+	}
+	if errStat != nil {
+		return nil, errStat
+	}
+	if records, haz := p.cache.get(fileNumber, info); haz {
+		return records, nil
+	}
+	records, errRead := p.conf.ReadFileWithNumber(fileNumber)
+	if errRead != nil {
+		return p.conf.skipCorrupted(records, errRead)
+	}
+	p.cache.put(fileNumber, info, records)
+	return records, nil
+}
@@ -0,0 +1,155 @@
+package fixregsto
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCounters(t testing.TB, fl *FileStorage, from int, n int) {
+	records := make([]byte, 8*n)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(records[i*8:], uint64(from+i))
+	}
+	_, errWrite := fl.Write(records)
+	assert.Equal(t, nil, errWrite)
+}
+
+func TestFileCache(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "cached",
+		RecordSize:        8,
+		MaxFileCount:      10,
+		FileMaxSize:       8 * 64,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		CacheFiles:        2,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	writeCounters(t, &fl, 0, 64*12+10) //10 files and work, two oldest files are removed
+
+	assert.Equal(t, 2, fl.cache.order.Len()) //Latest sealed files
+	_, cachedOld := fl.cache.entries[0]
+	assert.False(t, cachedOld)
+
+	latest, errLatest := fl.GetLatest(200) //Spans work and 3 files
+	assert.Equal(t, nil, errLatest)
+	assert.Equal(t, 200*8, len(latest))
+	assert.Equal(t, uint64(64*12+10-200), binary.LittleEndian.Uint64(latest))
+	assert.Equal(t, uint64(64*12+10-1), binary.LittleEndian.Uint64(latest[len(latest)-8:]))
+
+	first, errFirst := fl.GetFirst(70)
+	assert.Equal(t, nil, errFirst)
+	assert.Equal(t, 70*8, len(first))
+	assert.Equal(t, uint64(64*2), binary.LittleEndian.Uint64(first))
+	_, cachedFirst := fl.cache.entries[2]
+	assert.True(t, cachedFirst)
+
+	//Changed file is not served from cache
+	assert.Equal(t, nil, cfg.writeSealedFile(cfg.filename(2), make([]byte, 64*8)))
+	first, errFirst = fl.GetFirst(1)
+	assert.Equal(t, nil, errFirst)
+	assert.Equal(t, make([]byte, 8), first)
+}
+
+func TestFileCacheReplacedFile(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "cached",
+		RecordSize:   8,
+		MaxFileCount: 10,
+		FileMaxSize:  8 * 64,
+		Path:         TMPTESTDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	writeCounters(t, &fl, 1, 64*2)
+	first, _ := fl.GetFirst(1)
+	assert.Equal(t, counterRecord(1), first)
+
+	//Replaced like recompression does, same size and modification time
+	info, _ := os.Stat(cfg.filename(0))
+	assert.Equal(t, nil, os.WriteFile(cfg.filename(0)+"_TMP", make([]byte, 64*8), 0644))
+	assert.Equal(t, nil, os.Chtimes(cfg.filename(0)+"_TMP", info.ModTime(), info.ModTime()))
+	assert.Equal(t, nil, os.Rename(cfg.filename(0)+"_TMP", cfg.filename(0)))
+	first, errFirst := fl.GetFirst(1)
+	assert.Equal(t, nil, errFirst)
+	assert.Equal(t, make([]byte, 8), first)
+}
+
+func TestFileCacheRead(t *testing.T) {
+	for _, cacheFiles := range []int{-1, 1, 0} {
+		os.RemoveAll(TMPTESTDIR)
+		cfg := FileStorageConf{
+			Name:              "cached",
+			RecordSize:        8,
+			MaxFileCount:      10,
+			FileMaxSize:       8 * 64,
+			Path:              TMPTESTDIR,
+			CompressionMethod: COMPRESSIONMETHOD_GZ,
+			CacheFiles:        cacheFiles,
+		}
+		fl, flErr := cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		writeCounters(t, &fl, 0, 64*5+3)
+		buf := make([]byte, 24)
+		expected := uint64(0)
+		for {
+			n, errRead := fl.Read(buf)
+			if errRead == io.EOF {
+				break
+			}
+			assert.Equal(t, nil, errRead)
+			for i := 0; i < n; i += 8 {
+				assert.Equal(t, expected, binary.LittleEndian.Uint64(buf[i:]))
+				expected++
+			}
+		}
+		assert.Equal(t, uint64(64*5+3), expected)
+		assert.Equal(t, nil, fl.Close())
+	}
+}
+
+func benchmarkSequentialRead(b *testing.B, cacheFiles int) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "cached",
+		RecordSize:        8,
+		MaxFileCount:      100,
+		FileMaxSize:       8 * 4096,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		CacheFiles:        cacheFiles,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	if flErr != nil {
+		b.Fatal(flErr)
+	}
+	defer fl.Close()
+	writeCounters(b, &fl, 0, 4096*20)
+	buf := make([]byte, 8*64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fl.Seek(0, io.SeekStart)
+		for {
+			if _, errRead := fl.Read(buf); errRead != nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkSequentialReadCached(b *testing.B) {
+	benchmarkSequentialRead(b, 0)
+}
+
+func BenchmarkSequentialReadUncached(b *testing.B) {
+	benchmarkSequentialRead(b, -1)
+}
@@ -0,0 +1,200 @@
+/*
+Command line tool for FixRegSto file storages
+
+	fixregsto advise -path ./data -name alpha -recordsize 16 -filemaxsize 4096
+	fixregsto snapshot -path ./data -name alpha -o alpha.tar
+	fixregsto restore -path ./restored -name alpha -i alpha.tar
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hjkoskel/fixregsto"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %v <command> [flags]\ncommands:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  advise   measure compression settings on existing storage\n")
+	fmt.Fprintf(os.Stderr, "  snapshot write storage to tar archive, storage can be in use\n")
+	fmt.Fprintf(os.Stderr, "  restore  rebuild storage from snapshot archive\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "advise":
+		err = advise(os.Args[2:])
+	case "snapshot":
+		err = snapshot(os.Args[2:])
+	case "restore":
+		err = restore(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func parseIntList(s string) ([]int, error) {
+	result := []int{}
+	if len(s) == 0 {
+		return result, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		n, errParse := strconv.Atoi(strings.TrimSpace(item))
+		if errParse != nil {
+			return nil, fmt.Errorf("invalid number %#v in list %v", item, s)
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+func parseStringList(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+//storageFlags are flags for opening existing storage read only
+type storageFlags struct {
+	conf      fixregsto.FileStorageConf
+	bitSlices string
+	transform string
+}
+
+func addStorageFlags(fs *flag.FlagSet) *storageFlags {
+	result := storageFlags{}
+	fs.StringVar(&result.conf.Path, "path", ".", "storage directory")
+	fs.StringVar(&result.conf.Name, "name", "", "storage name")
+	fs.Int64Var(&result.conf.RecordSize, "recordsize", 0, "record size in bytes")
+	fs.Int64Var(&result.conf.FileMaxSize, "filemaxsize", 0, "file size in bytes")
+	fs.Int64Var(&result.conf.MaxFileCount, "maxfilecount", 1, "max file count")
+	fs.StringVar(&result.conf.CompressionMethod, "compression", "", "current compression method")
+	fs.BoolVar(&result.conf.Framed, "framed", false, "files are framed")
+	fs.StringVar(&result.bitSlices, "bitslices", "", "current bit slices, comma separated")
+	fs.StringVar(&result.transform, "transforms", "", "current field transforms, comma separated")
+	return &result
+}
+
+//open opens storage read only, so it can be inspected while other process writes. Layout is taken from manifest if storage has it
+func (p *storageFlags) open() (fixregsto.FileStorage, error) {
+	var errSlices error
+	p.conf.BitSlices, errSlices = parseIntList(p.bitSlices)
+	if errSlices != nil {
+		return fixregsto.FileStorage{}, errSlices
+	}
+	p.conf.FieldTransforms = parseStringList(p.transform)
+	manifest, errManifest := p.conf.ReadManifest()
+	if errManifest != nil {
+		return fixregsto.FileStorage{}, errManifest
+	}
+	if manifest != nil {
+		manifest.Layout.Apply(&p.conf)
+	}
+	p.conf.ReadOnly = true
+	if errConf := p.conf.CheckErrors(); errConf != nil {
+		return fixregsto.FileStorage{}, errConf
+	}
+	return p.conf.InitFileStorage()
+}
+
+func advise(args []string) error {
+	fs := flag.NewFlagSet("advise", flag.ExitOnError)
+	sf := addStorageFlags(fs)
+	records := fs.Int64("records", fixregsto.DEFAULTADVISORECORDS, "how many latest records are used as sample")
+	methods := fs.String("methods", "", "compression methods to try, comma separated. Empty tries all")
+	levels := fs.String("levels", "", "compression levels to try, comma separated")
+	slicings := fs.String("slicings", "", "bit slicings to try, separated with ; like 32,32,64;8,8,8,8")
+	minEncode := fs.Float64("minencode", 0, "minimum encode speed MB/s for recommendation")
+	fs.Parse(args)
+
+	opt := fixregsto.AdviceOptions{Methods: parseStringList(*methods), MinEncodeMB: *minEncode}
+	var errLevels error
+	opt.Levels, errLevels = parseIntList(*levels)
+	if errLevels != nil {
+		return errLevels
+	}
+	if 0 < len(*slicings) {
+		for _, s := range strings.Split(*slicings, ";") {
+			slices, errSlices := parseIntList(s)
+			if errSlices != nil {
+				return errSlices
+			}
+			opt.Slicings = append(opt.Slicings, slices)
+		}
+	}
+
+	sto, errOpen := sf.open()
+	if errOpen != nil {
+		return errOpen
+	}
+	defer sto.Close()
+	advice, errAdvise := sto.Advise(*records, opt)
+	if errAdvise != nil {
+		return errAdvise
+	}
+	fmt.Print(advice.String())
+	return nil
+}
+
+func snapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	sf := addStorageFlags(fs)
+	output := fs.String("o", "", "archive file. Empty writes to stdout")
+	fs.Parse(args)
+
+	sto, errOpen := sf.open()
+	if errOpen != nil {
+		return errOpen
+	}
+	defer sto.Close()
+	if len(*output) == 0 {
+		return sto.Snapshot(os.Stdout)
+	}
+	f, errCreate := os.Create(*output)
+	if errCreate != nil {
+		return errCreate
+	}
+	if errSnapshot := sto.Snapshot(f); errSnapshot != nil {
+		f.Close()
+		return errSnapshot
+	}
+	if errSync := f.Sync(); errSync != nil {
+		f.Close()
+		return errSync
+	}
+	return f.Close()
+}
+
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("path", ".", "storage directory")
+	name := fs.String("name", "", "storage name")
+	input := fs.String("i", "", "archive file. Empty reads from stdin")
+	fs.Parse(args)
+
+	conf := fixregsto.FileStorageConf{Path: *dir, Name: *name}
+	if len(*input) == 0 {
+		return fixregsto.Restore(os.Stdin, conf)
+	}
+	f, errOpen := os.Open(*input)
+	if errOpen != nil {
+		return errOpen
+	}
+	defer f.Close()
+	return fixregsto.Restore(f, conf)
+}
@@ -0,0 +1,205 @@
+/*
+Compression codecs. Codec is picked from registry by CompressionMethod string.
+Built in are gz (configurable level), snappy (fast, for CPU limited devices) and zstd (high ratio, for archival).
+
+Framed files tell codec on header. Files without header are recognized by magic bytes at start of compressed data,
+so files written with different codecs can be in same directory
+*/
+package fixregsto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSIONMETHOD_GZ     = "gz"
+	COMPRESSIONMETHOD_SNAPPY = "snappy"
+	COMPRESSIONMETHOD_ZSTD   = "zstd"
+)
+
+//Codec compresses payload of storage file
+type Codec interface {
+	Compress(content []byte, level int) ([]byte, error) //Level is codec specific, 0 is codec default
+	Decompress(content []byte) ([]byte, error)
+	Magic() []byte //Compressed data starts with this. Used for recognizing codec of file, empty if not recognizable
+}
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[string]Codec{
+		COMPRESSIONMETHOD_GZ:     gzCodec{},
+		COMPRESSIONMETHOD_SNAPPY: snappyCodec{},
+		COMPRESSIONMETHOD_ZSTD:   &zstdCodec{encoders: make(map[zstd.EncoderLevel]*zstd.Encoder)},
+	}
+)
+
+//RegisterCodec adds codec for method. Built in methods can not be replaced
+func RegisterCodec(method string, codec Codec) error {
+	if len(method) == 0 || 255 < len(method) {
+		return fmt.Errorf("invalid compression method name %#v", method)
+	}
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	if _, haz := codecs[method]; haz {
+		return fmt.Errorf("compression method %v is already registered", method)
+	}
+	codecs[method] = codec
+	return nil
+}
+
+//GetCodec gets codec for method. Empty method is no compression and does not have codec
+func GetCodec(method string) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, haz := codecs[method]
+	if !haz {
+		return nil, fmt.Errorf("unknown compression method %#v", method)
+	}
+	return codec, nil
+}
+
+//detectCodecs lists methods having magic that content starts with. Configured method is first
+func detectCodecs(content []byte, method string) []string {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	result := []string{}
+	for name, codec := range codecs {
+		magic := codec.Magic()
+		if 0 < len(magic) && bytes.HasPrefix(content, magic) {
+			result = append(result, name)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] == method || (result[j] != method && result[i] < result[j])
+	})
+	return result
+}
+
+/*
+gz
+*/
+
+type gzCodec struct{}
+
+func (gzCodec) Magic() []byte {
+	return []byte{0x1f, 0x8b, 8} //Deflate
+}
+
+func (gzCodec) Compress(content []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	zw, errLevel := gzip.NewWriterLevel(&buf, level)
+	if errLevel != nil {
+		return nil, errLevel
+	}
+	_, wErr := zw.Write(content)
+	if wErr != nil {
+		return nil, wErr
+	}
+	gzCloseErr := zw.Close()
+	if gzCloseErr != nil {
+		return nil, fmt.Errorf("gz compression err %v", gzCloseErr.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzCodec) Decompress(content []byte) ([]byte, error) {
+	zr, zrErr := gzip.NewReader(bytes.NewReader(content))
+	if zrErr != nil {
+		return nil, zrErr
+	}
+	result, readErr := io.ReadAll(zr)
+	if readErr != nil {
+		return nil, readErr
+	}
+	zcloseErr := zr.Close()
+	if zcloseErr != nil {
+		return nil, zcloseErr
+	}
+	return result, nil
+}
+
+/*
+snappy, stream format because it has magic and CRC
+*/
+
+type snappyCodec struct{}
+
+func (snappyCodec) Magic() []byte {
+	return []byte("\xff\x06\x00\x00sNaPpY")
+}
+
+func (snappyCodec) Compress(content []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := snappy.NewBufferedWriter(&buf)
+	if _, wErr := zw.Write(content); wErr != nil {
+		return nil, wErr
+	}
+	if errClose := zw.Close(); errClose != nil {
+		return nil, fmt.Errorf("snappy compression err %v", errClose.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+func (snappyCodec) Decompress(content []byte) ([]byte, error) {
+	return io.ReadAll(snappy.NewReader(bytes.NewReader(content)))
+}
+
+/*
+zstd, level is like on zstd command line 1-22 and it is mapped to nearest encoder level
+*/
+
+type zstdCodec struct {
+	mu       sync.Mutex
+	encoders map[zstd.EncoderLevel]*zstd.Encoder
+	decoder  *zstd.Decoder
+}
+
+func (*zstdCodec) Magic() []byte {
+	return []byte{0x28, 0xb5, 0x2f, 0xfd}
+}
+
+func (p *zstdCodec) Compress(content []byte, level int) ([]byte, error) {
+	encoderLevel := zstd.SpeedDefault
+	if level != 0 {
+		encoderLevel = zstd.EncoderLevelFromZstd(level)
+	}
+	p.mu.Lock()
+	encoder, haz := p.encoders[encoderLevel]
+	if !haz {
+		var errEncoder error
+		encoder, errEncoder = zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1))
+		if errEncoder != nil {
+			p.mu.Unlock()
+			return nil, errEncoder
+		}
+		p.encoders[encoderLevel] = encoder
+	}
+	p.mu.Unlock()
+	return encoder.EncodeAll(content, nil), nil
+}
+
+func (p *zstdCodec) Decompress(content []byte) ([]byte, error) {
+	p.mu.Lock()
+	if p.decoder == nil {
+		var errDecoder error
+		p.decoder, errDecoder = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if errDecoder != nil {
+			p.mu.Unlock()
+			return nil, errDecoder
+		}
+	}
+	decoder := p.decoder
+	p.mu.Unlock()
+	return decoder.DecodeAll(content, nil)
+}
@@ -0,0 +1,126 @@
+package fixregsto
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+	content := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 100)
+	for _, method := range []string{COMPRESSIONMETHOD_GZ, COMPRESSIONMETHOD_SNAPPY, COMPRESSIONMETHOD_ZSTD} {
+		codec, errCodec := GetCodec(method)
+		assert.Equal(t, nil, errCodec)
+		for _, level := range []int{0, 1, 9} {
+			compressed, errCompress := codec.Compress(content, level)
+			assert.Equal(t, nil, errCompress)
+			assert.True(t, len(compressed) < len(content), "%v level %v", method, level)
+			assert.True(t, bytes.HasPrefix(compressed, codec.Magic()))
+			back, errBack := codec.Decompress(compressed)
+			assert.Equal(t, nil, errBack)
+			assert.Equal(t, content, back)
+		}
+	}
+	gz, _ := GetCodec(COMPRESSIONMETHOD_GZ)
+	_, errLevel := gz.Compress(content, 20)
+	assert.NotEqual(t, nil, errLevel)
+
+	_, errUnknown := GetCodec("rar")
+	assert.NotEqual(t, nil, errUnknown)
+	assert.NotEqual(t, nil, RegisterCodec(COMPRESSIONMETHOD_GZ, gzCodec{}))
+}
+
+type xorCodec struct{}
+
+func (xorCodec) Compress(content []byte, level int) ([]byte, error) {
+	result := make([]byte, len(content))
+	for i := range content {
+		result[i] = content[i] ^ 0x55
+	}
+	return result, nil
+}
+
+func (p xorCodec) Decompress(content []byte) ([]byte, error) {
+	return p.Compress(content, 0)
+}
+
+func (xorCodec) Magic() []byte {
+	return nil
+}
+
+var registerXorOnce sync.Once
+
+//registerXorCodec registers test codec once per process, registry is global and tests can be run again with -count
+func registerXorCodec(t *testing.T) {
+	registerXorOnce.Do(func() { assert.Equal(t, nil, RegisterCodec("xortest", xorCodec{})) })
+}
+
+func TestMixedCodecsInDirectory(t *testing.T) {
+	registerXorCodec(t)
+	for _, framed := range []bool{false, true} {
+		os.RemoveAll(TMPTESTDIR)
+		cfg := FileStorageConf{
+			Name:         "mixed",
+			RecordSize:   8,
+			MaxFileCount: 100,
+			FileMaxSize:  64,
+			Path:         TMPTESTDIR,
+			Framed:       framed,
+		}
+		expected := []byte{}
+		methods := []string{"", COMPRESSIONMETHOD_GZ, COMPRESSIONMETHOD_SNAPPY, COMPRESSIONMETHOD_ZSTD}
+		if framed { //Codec without magic is found only from header
+			methods = append(methods, "xortest")
+		}
+		for i, method := range append(methods, COMPRESSIONMETHOD_ZSTD) {
+			cfg.CompressionMethod = method
+			cfg.CompressionLevel = i
+			assert.Equal(t, nil, cfg.CheckErrors())
+			fl, flErr := cfg.InitFileStorage()
+			assert.Equal(t, nil, flErr)
+			records := bytes.Repeat([]byte{byte(i), 0, 0, 0, byte(i), 0, 0, 0}, 8)
+			_, errWrite := fl.Write(records)
+			assert.Equal(t, nil, errWrite)
+			expected = append(expected, records...)
+			assert.Equal(t, nil, fl.Close())
+		}
+		cfg.CompressionMethod = COMPRESSIONMETHOD_SNAPPY
+		fl, flErr := cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		all, errAll := fl.ReadAll()
+		assert.Equal(t, nil, errAll, "framed=%v", framed)
+		assert.Equal(t, expected, all, "framed=%v", framed)
+		assert.Equal(t, nil, fl.Close())
+	}
+}
+
+func TestUncompressedStartingWithMagic(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "magic",
+		RecordSize:   8,
+		MaxFileCount: 10,
+		FileMaxSize:  64,
+		Path:         TMPTESTDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	records := bytes.Repeat([]byte{0x1f, 0x8b, 8, 0, 0x28, 0xb5, 0x2f, 0xfd}, 8) //Gzip magic on start of file
+	_, errWrite := fl.Write(records)
+	assert.Equal(t, nil, errWrite)
+	assert.Equal(t, nil, fl.Close())
+
+	//Compression is enabled later, old file is still readable
+	cfg.CompressionMethod = COMPRESSIONMETHOD_GZ
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, errWrite = fl.Write(records)
+	assert.Equal(t, nil, errWrite)
+	all, errAll := fl.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, append(append([]byte{}, records...), records...), all)
+	assert.Equal(t, nil, fl.Close())
+}
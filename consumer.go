@@ -0,0 +1,203 @@
+/*
+Named consumers of FileStorage. Consumer is Cursor having durable position, committed to file name.<consumer>.consumer
+after records are handled. Rotation checks committed positions before removing oldest file, see RotationPolicy.
+Checkpoint of Shipper counts also as consumer.
+
+Consumers can be on read only storage on other process. Use one Consumer per name at time.
+Positions are same as on cursors. Migrate and Restore move positions of records, those refuse while consumers exist
+*/
+package fixregsto
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const consumerSuffix = ".consumer"
+
+//shipperConsumer is name of Shipper checkpoint among consumers
+const shipperConsumer = "shipper"
+
+//Consumer reads records with own Cursor and keeps committed position on disk
+type Consumer struct {
+	*Cursor
+	name     string
+	filename string
+
+	mu        sync.Mutex
+	committed int64
+}
+
+//Name of consumer
+func (p *Consumer) Name() string {
+	return p.name
+}
+
+//Committed returns position stored on disk. Records before it are consumed
+func (p *Consumer) Committed() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.committed
+}
+
+//Commit stores current read position of cursor on disk. Call after read records are handled
+func (p *Consumer) Commit() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	position := p.Position()
+	if errWrite := writeConsumerPosition(p.filename, position); errWrite != nil {
+		return errWrite
+	}
+	p.committed = position
+	return nil
+}
+
+func consumerNameOk(name string) bool {
+	if len(name) == 0 || name == shipperConsumer {
+		return false
+	}
+	for _, c := range name {
+		if !(('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *FileStorageConf) consumerFileName(name string) string {
+	return p.BaseFileName() + "." + name + consumerSuffix
+}
+
+func writeConsumerPosition(filename string, position int64) error {
+	_, errWrite := writeWithFsyncCow(filename, []byte(strconv.FormatInt(position, 10)))
+	return errWrite
+}
+
+func readConsumerPosition(filename string) (int64, error) {
+	content, errRead := os.ReadFile(filename)
+	if errRead != nil {
+		return 0, errRead
+	}
+	position, errParse := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if errParse != nil {
+		return 0, fmt.Errorf("Invalid consumer position on %v err=%v", filename, errParse)
+	}
+	return position, nil
+}
+
+//Consumer opens named consumer at its committed position. New consumer is registered at first stored record,
+//so rotation keeps records stored now until consumer commits them.
+//Consumer refers to this FileStorage, do not copy FileStorage after that
+func (p *FileStorage) Consumer(name string) (*Consumer, error) {
+	if !consumerNameOk(name) {
+		return nil, fmt.Errorf("Invalid consumer name %#v, use letters, numbers, - and _. Name %v is reserved", name, shipperConsumer)
+	}
+	cursor, errCursor := p.NewCursor()
+	if errCursor != nil {
+		return nil, errCursor
+	}
+	result := Consumer{Cursor: cursor, name: name, filename: p.conf.consumerFileName(name)}
+	position, errRead := readConsumerPosition(result.filename)
+	if os.IsNotExist(errRead) {
+		position = cursor.Position()
+		errRead = writeConsumerPosition(result.filename, position)
+	}
+	if errRead != nil {
+		return nil, errRead
+	}
+	cursor.mu.Lock()
+	cursor.position = position //Dropped records are skipped on read
+	cursor.mu.Unlock()
+	result.committed = position
+	return &result, nil
+}
+
+//Consumers lists committed positions of registered consumers
+func (p *FileStorage) Consumers() (map[string]int64, error) {
+	return p.conf.consumerPositions()
+}
+
+//RemoveConsumer unregisters consumer, rotation does not wait for it anymore
+func (p *FileStorage) RemoveConsumer(name string) error {
+	if !consumerNameOk(name) {
+		return fmt.Errorf("Invalid consumer name %#v", name)
+	}
+	errRemove := os.Remove(p.conf.consumerFileName(name))
+	if os.IsNotExist(errRemove) {
+		return fmt.Errorf("No consumer %v", name)
+	}
+	return errRemove
+}
+
+func (p *FileStorageConf) consumerPositions() (map[string]int64, error) {
+	fEntries, errDir := os.ReadDir(p.Path)
+	if errDir != nil {
+		return nil, errDir
+	}
+	result := make(map[string]int64)
+	prefix := p.Name + "."
+	for _, entry := range fEntries {
+		fname := entry.Name()
+		if !strings.HasPrefix(fname, prefix) || !strings.HasSuffix(fname, consumerSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(fname, prefix), consumerSuffix)
+		if !consumerNameOk(name) {
+			continue
+		}
+		position, errRead := readConsumerPosition(p.consumerFileName(name))
+		if os.IsNotExist(errRead) {
+			continue //Removed after listing
+		}
+		if errRead != nil {
+			return nil, errRead
+		}
+		result[name] = position
+	}
+	return result, nil
+}
+
+//checkNoConsumers refuses Migrate and Restore, committed positions would point to other records after those
+func (p *FileStorageConf) checkNoConsumers() error {
+	positions, errPositions := p.consumerPositions()
+	if errPositions != nil {
+		return errPositions
+	}
+	names := make([]string, 0, len(positions))
+	for name := range positions {
+		names = append(names, name)
+	}
+	if 0 < len(names) {
+		sort.Strings(names)
+		return fmt.Errorf("Positions of records change, remove consumers %v first", names)
+	}
+	return nil
+}
+
+//slowestConsumer finds smallest consumed position of consumers and shipper. Returns false if there are none
+func (p *FileStorageConf) slowestConsumer() (int64, string, bool, error) {
+	positions, errPositions := p.consumerPositions()
+	if errPositions != nil {
+		return 0, "", false, errPositions
+	}
+	if fileExists(p.checkpointFileName()) {
+		shipped, errCheckpoint := p.readCheckpoint()
+		if errCheckpoint != nil {
+			return 0, "", false, errCheckpoint
+		}
+		positions[shipperConsumer] = (shipped + 1) * p.recordsPerFile()
+	}
+	found := false
+	slowest := int64(0)
+	slowestName := ""
+	for name, position := range positions {
+		if !found || position < slowest || (position == slowest && name < slowestName) {
+			slowest, slowestName, found = position, name, true
+		}
+	}
+	return slowest, slowestName, found, nil
+}
@@ -0,0 +1,113 @@
+package fixregsto
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func counterRange(from int, n int) []byte {
+	result := []byte{}
+	for i := from; i < from+n; i++ {
+		result = append(result, counterRecord(i)...)
+	}
+	return result
+}
+
+func TestConsumer(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "audit",
+		RecordSize:        8,
+		MaxFileCount:      3,
+		FileMaxSize:       8 * 4,
+		Path:              path.Join(TMPTESTDIR, "audit"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		Rotation:          RotationPolicy{Mode: ROTATION_DELETE},
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 0, 10)
+
+	consumer, errConsumer := fl.Consumer("uploader")
+	assert.Equal(t, nil, errConsumer)
+	assert.Equal(t, "uploader", consumer.Name())
+	assert.Equal(t, int64(0), consumer.Committed())
+	buf := make([]byte, 8*6)
+	n, errRead := consumer.Read(buf)
+	assert.Equal(t, nil, errRead)
+	assert.Equal(t, 8*6, n)
+	assert.Equal(t, int64(0), consumer.Committed())
+	assert.Equal(t, nil, consumer.Commit())
+	assert.Equal(t, int64(6), consumer.Committed())
+	positions, errPositions := fl.Consumers()
+	assert.Equal(t, nil, errPositions)
+	assert.Equal(t, map[string]int64{"uploader": 6}, positions)
+	assert.Equal(t, nil, fl.Close())
+
+	//Continues from committed position after restart, also on read only storage
+	for _, readOnly := range []bool{false, true} {
+		reopenCfg := cfg
+		reopenCfg.ReadOnly = readOnly
+		fl, flErr = reopenCfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		consumer, errConsumer = fl.Consumer("uploader")
+		assert.Equal(t, nil, errConsumer)
+		assert.Equal(t, int64(6), consumer.Position())
+		n, errRead = consumer.Read(buf)
+		assert.Equal(t, nil, errRead)
+		assert.Equal(t, counterRange(6, 4), buf[:n])
+		assert.Equal(t, nil, fl.Close())
+	}
+
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	_, errConsumer = fl.Consumer("../uploader")
+	assert.NotEqual(t, nil, errConsumer)
+	_, errConsumer = fl.Consumer("shipper") //Checkpoint of shipper
+	assert.NotEqual(t, nil, errConsumer)
+	assert.Equal(t, nil, fl.RemoveConsumer("uploader"))
+	assert.NotEqual(t, nil, fl.RemoveConsumer("uploader"))
+	positions, errPositions = fl.Consumers()
+	assert.Equal(t, nil, errPositions)
+	assert.Equal(t, map[string]int64{}, positions)
+}
+
+func TestConsumerRefusesMigrate(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "audit",
+		RecordSize:        8,
+		MaxFileCount:      3,
+		FileMaxSize:       8 * 4,
+		Path:              path.Join(TMPTESTDIR, "audit"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		Rotation:          RotationPolicy{Mode: ROTATION_DELETE},
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 0, 10)
+	_, errConsumer := fl.Consumer("uploader")
+	assert.Equal(t, nil, errConsumer)
+	var archive bytes.Buffer
+	assert.Equal(t, nil, fl.Snapshot(&archive))
+	assert.Equal(t, nil, fl.Close())
+
+	//Committed positions would point to other records after migration
+	newCfg := cfg
+	newCfg.FileMaxSize = 8 * 8
+	assert.NotEqual(t, nil, Migrate(cfg, newCfg))
+	assert.NotEqual(t, nil, Restore(bytes.NewReader(archive.Bytes()), cfg))
+	manifest, _ := cfg.ReadManifest()
+	assert.Equal(t, cfg.Layout(), manifest.Layout)
+
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, nil, fl.RemoveConsumer("uploader"))
+	assert.Equal(t, nil, fl.Close())
+	assert.Equal(t, nil, Migrate(cfg, newCfg))
+}
@@ -0,0 +1,122 @@
+/*
+Cursor is read position on storage. Storages have their own cursor for Read and Seek,
+and NewCursor gives independent cursors so many readers can read same storage at same time.
+
+Positions are absolute record numbers. Position of record does not change when old records are dropped
+*/
+package fixregsto
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+//cursorSource is storage that cursor reads
+type cursorSource interface {
+	RecordSize() int64
+	positionRange() (int64, int64, error)                                  //First available and end position (one past latest)
+	readRecordsAt(position int64, maxRecords int64) ([]byte, int64, error) //Returns records and position after them. Dropped records are skipped
+}
+
+//keySource is cursorSource that can find position of first record having key >= key
+type keySource interface {
+	keyPosition(key uint64) (int64, error)
+}
+
+//Cursor implements io.ReadSeeker with own read position.
+//Only complete records are read, so arr on Read must be at least one record long
+type Cursor struct {
+	src      cursorSource
+	mu       sync.Mutex
+	position int64
+}
+
+func newCursor(src cursorSource) (*Cursor, error) {
+	result := Cursor{src: src}
+	_, errSeek := result.readSeekFrom(src, 0, io.SeekStart)
+	return &result, errSeek
+}
+
+//Read implements Reader interface.  Except only array length must be multiple of recordsize for normal operation
+func (p *Cursor) Read(arr []byte) (int, error) {
+	return p.readFrom(p.src, arr)
+}
+
+//Seek implements Seeker interface. Offset is rounded down to record boundary.
+//SeekStart is relative to first available record, returned position is absolute
+func (p *Cursor) Seek(offset int64, whence int) (int64, error) {
+	return p.readSeekFrom(p.src, offset, whence)
+}
+
+//SeekToKey moves cursor to first record having key >= key. Returns new position in bytes like Seek
+func (p *Cursor) SeekToKey(key uint64) (int64, error) {
+	return p.seekToKeyFrom(p.src, key)
+}
+
+//Position returns absolute record number where next Read starts
+func (p *Cursor) Position() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.position
+}
+
+func (p *Cursor) seekToKeyFrom(src cursorSource, key uint64) (int64, error) {
+	recordSize := src.RecordSize()
+	keySrc, haz := src.(keySource)
+	if !haz {
+		return p.Position() * recordSize, ErrNoKey
+	}
+	position, errFind := keySrc.keyPosition(key)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if errFind != nil {
+		return p.position * recordSize, errFind
+	}
+	p.position = position
+	return position * recordSize, nil
+}
+
+func (p *Cursor) readFrom(src cursorSource, arr []byte) (int, error) {
+	recordSize := src.RecordSize()
+	if len(arr) < int(recordSize) { //Breaks read interface but it have to. Avoid io.ReadAll
+		//usually problem if non power of 2 record size and io.ReadAll kind of method
+		return 0, fmt.Errorf("Asked %v bytes, minimum record size is %v", len(arr), recordSize)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	byt, next, errRead := src.readRecordsAt(p.position, int64(len(arr))/recordSize)
+	p.position = next
+	if len(byt) == 0 && errRead == nil {
+		return 0, io.EOF
+	}
+	return copy(arr, byt), errRead
+}
+
+func (p *Cursor) readSeekFrom(src cursorSource, offset int64, whence int) (int64, error) {
+	recordSize := src.RecordSize()
+	minPosition, maxPosition, errRange := src.positionRange()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if errRange != nil {
+		return p.position * recordSize, errRange
+	}
+	switch whence {
+	case io.SeekStart: // seek relative to the origin of the file
+		p.position = minPosition + offset/recordSize
+	case io.SeekCurrent: // seek relative to the current offset
+		p.position += offset / recordSize
+	case io.SeekEnd: //seek relative to the end
+		p.position = maxPosition + offset/recordSize
+	default:
+		return p.position * recordSize, fmt.Errorf("Whence %v unknow", whence)
+	}
+	//Set limits and report
+	if maxPosition < p.position {
+		p.position = maxPosition
+	}
+	if p.position < minPosition {
+		p.position = minPosition
+	}
+	return p.position * recordSize, nil
+}
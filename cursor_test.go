@@ -0,0 +1,130 @@
+package fixregsto
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TMPCURSORDIR = "/tmp/cursortest12356789"
+)
+
+type cursorStorage interface {
+	FixRegSto
+	NewCursor() (*Cursor, error)
+}
+
+//concurrentReadTest writes counter records on one goroutine while readers follow with own cursors and query latest
+//Run with -race
+func concurrentReadTest(t *testing.T, dut cursorStorage, total int) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < total; i++ {
+			record := make([]byte, 8)
+			binary.LittleEndian.PutUint64(record, uint64(i))
+			_, errWrite := dut.Write(record)
+			assert.Equal(t, nil, errWrite)
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		cursor, errCursor := dut.NewCursor()
+		assert.Equal(t, nil, errCursor)
+		wg.Add(1)
+		go func(cursor *Cursor) {
+			defer wg.Done()
+			previous := int64(-1)
+			arr := make([]byte, 8*5)
+			for previous < int64(total-1) {
+				n, errRead := cursor.Read(arr)
+				if errRead == io.EOF {
+					latest, errLatest := dut.GetLatest(1)
+					assert.Equal(t, nil, errLatest)
+					if len(latest) == 8 {
+						assert.True(t, previous <= int64(binary.LittleEndian.Uint64(latest)))
+					}
+					continue
+				}
+				assert.Equal(t, nil, errRead)
+				for i := 0; i < n; i += 8 {
+					value := int64(binary.LittleEndian.Uint64(arr[i:]))
+					assert.True(t, previous < value, "values must increase %v then %v", previous, value)
+					previous = value
+				}
+			}
+		}(cursor)
+	}
+	wg.Wait()
+
+	latest, _ := dut.GetLatest(1)
+	assert.Equal(t, uint64(total-1), binary.LittleEndian.Uint64(latest))
+}
+
+func TestFileStorageConcurrent(t *testing.T) {
+	os.RemoveAll(TMPCURSORDIR)
+	cfg := FileStorageConf{
+		Name:         "concurrent",
+		RecordSize:   8,
+		MaxFileCount: 5,
+		FileMaxSize:  64,
+		Path:         TMPCURSORDIR,
+	}
+	sto, errInit := cfg.InitFileStorage()
+	assert.Equal(t, nil, errInit)
+	concurrentReadTest(t, &sto, 300)
+}
+
+func TestMemloopConcurrent(t *testing.T) {
+	cfg := MemloopConf{RecordSize: 8, MaxRecords: 20}
+	mem, errInit := cfg.InitMemLoop()
+	assert.Equal(t, nil, errInit)
+	concurrentReadTest(t, &mem, 2000)
+}
+
+func TestCursorIndependent(t *testing.T) {
+	os.RemoveAll(TMPCURSORDIR)
+	cfg := FileStorageConf{
+		Name:         "independent",
+		RecordSize:   8,
+		MaxFileCount: 3,
+		FileMaxSize:  32,
+		Path:         TMPCURSORDIR,
+		Key:          KeyExtractor{Offset: 2, Width: 4, BigEndian: true},
+	}
+	sto, errInit := cfg.InitFileStorage()
+	assert.Equal(t, nil, errInit)
+	_, errWrite := sto.Write(keyTestRecords(0, 10, 1))
+	assert.Equal(t, nil, errWrite)
+
+	a, _ := sto.NewCursor()
+	b, _ := sto.NewCursor()
+	_, errSeek := b.SeekToKey(6)
+	assert.Equal(t, nil, errSeek)
+	assert.Equal(t, int64(6), b.Position())
+
+	arr := make([]byte, 16)
+	n, _ := a.Read(arr)
+	assert.Equal(t, keyTestRecords(0, 2, 1), arr[0:n])
+	n, _ = b.Read(arr)
+	assert.Equal(t, keyTestRecords(6, 8, 1), arr[0:n])
+
+	//Storage own Read is not moved by cursors
+	own, errOwn := io.ReadAll(&sto)
+	assert.Equal(t, nil, errOwn)
+	assert.Equal(t, keyTestRecords(0, 10, 1), own)
+
+	//Rotation drops first file, cursor continues from first available
+	_, errWrite = sto.Write(keyTestRecords(10, 16, 1))
+	assert.Equal(t, nil, errWrite)
+	n, _ = a.Read(arr)
+	assert.Equal(t, keyTestRecords(4, 6, 1), arr[0:n])
+	rest, _ := io.ReadAll(b)
+	assert.Equal(t, keyTestRecords(8, 16, 1), rest)
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package fixregsto
+
+import (
+	"syscall"
+)
+
+//freeBytes tells how many bytes unprivileged user can still write on filesystem of dirname
+func freeBytes(dirname string) (int64, error) {
+	if len(dirname) == 0 {
+		dirname = "."
+	}
+	var stat syscall.Statfs_t
+	if errStat := syscall.Statfs(dirname, &stat); errStat != nil {
+		return 0, errStat
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
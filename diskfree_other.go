@@ -0,0 +1,13 @@
+//go:build !linux
+
+package fixregsto
+
+import (
+	"fmt"
+	"runtime"
+)
+
+//freeBytes is not available, MinFreeBytes retention requires linux
+func freeBytes(dirname string) (int64, error) {
+	return 0, fmt.Errorf("free space query is not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,194 @@
+/*
+Durability policy of FileStorage. Syncing every Write is safest but costs flash wear and time on fast sensor data.
+
+	sync   every Write is synced to disk before returning (default)
+	group  records are synced after GroupRecords records or GroupInterval from first unsynced write (group commit)
+	os     operating system decides when to write, records are synced only on Flush, seal and Close
+
+Sealed files are always synced. Group and os modes use append only work file (see appendwork.go), rewriting
+whole work file without sync could lose already synced records on power cut. Unsynced tail is cut by recovery.
+Durable tells position (same as cursor positions) before which all records are synced
+*/
+package fixregsto
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const (
+	DURABILITY_SYNC  = "sync"
+	DURABILITY_GROUP = "group"
+	DURABILITY_OS    = "os"
+)
+
+//DurabilityPolicy tells when written records are synced to disk. Empty Mode is DURABILITY_SYNC
+type DurabilityPolicy struct {
+	Mode          string
+	GroupRecords  int64         //Group mode syncs when this many records are unsynced. 0 is no limit
+	GroupInterval time.Duration //Group mode syncs this long after first unsynced write. 0 is no limit
+}
+
+//CheckErrors tells is policy usable
+func (p *DurabilityPolicy) CheckErrors() error {
+	switch p.Mode {
+	case "", DURABILITY_SYNC, DURABILITY_OS:
+		return nil
+	case DURABILITY_GROUP:
+		if p.GroupRecords < 0 || p.GroupInterval < 0 {
+			return fmt.Errorf("Invalid group commit limits, records %v interval %v", p.GroupRecords, p.GroupInterval)
+		}
+		if p.GroupRecords == 0 && p.GroupInterval == 0 {
+			return fmt.Errorf("Group durability requires GroupRecords or GroupInterval")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown durability mode %v", p.Mode)
+}
+
+//syncsEachWrite tells is every Write synced before returning
+func (p *DurabilityPolicy) syncsEachWrite() bool {
+	return p.Mode == "" || p.Mode == DURABILITY_SYNC
+}
+
+//durabilityState is shared between copies of FileStorage, protected by FileStorage mu
+type durabilityState struct {
+	written  int64       //End position of written records
+	durable  int64       //End position of synced records
+	unsynced int64       //Records at end of work file that are not synced
+	timer    *time.Timer //Pending group commit
+	errTimer error       //Failed group commit from timer, returned by next Flush
+}
+
+//appendWork tells is work file appended. Unsynced writes are always appended
+func (p *FileStorageConf) appendWork() bool {
+	return p.AppendWork || !p.Durability.syncsEachWrite()
+}
+
+//syncDir makes renames and new files in directory durable. Windows can not sync directories
+func syncDir(dirname string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, errOpen := os.Open(dirname)
+	if errOpen != nil {
+		return errOpen
+	}
+	errSync := d.Sync()
+	errClose := d.Close()
+	if errSync != nil {
+		return errSync
+	}
+	return errClose
+}
+
+//syncWorkFile syncs work file and its directory. Missing work file has nothing to sync
+func (p *FileStorageConf) syncWorkFile() error {
+	f, errOpen := os.OpenFile(p.BaseFileName(), os.O_WRONLY, 0755)
+	if os.IsNotExist(errOpen) {
+		return nil
+	}
+	if errOpen != nil {
+		return errOpen
+	}
+	if errSync := f.Sync(); errSync != nil {
+		f.Close()
+		return errSync
+	}
+	if errClose := f.Close(); errClose != nil {
+		return errClose
+	}
+	return syncDir(filepath.Dir(p.BaseFileName()))
+}
+
+//endPosition is position after newest record. Writer only, uses numbers kept by writer
+func (p *FileStorage) endPosition() int64 {
+	end := int64(len(p.workBuffer)) / p.conf.RecordSize
+	if 0 < len(p.numbers) {
+		end += (p.numbers[len(p.numbers)-1] + 1) * p.conf.recordsPerFile()
+	}
+	return end
+}
+
+//wrote updates durability after write. Unsynced is how many records at end of work file are not synced
+func (p *FileStorage) wrote(unsynced int64) error {
+	state := p.durability
+	state.written = p.endPosition()
+	state.unsynced = unsynced
+	state.durable = state.written - unsynced //Records before unsynced ones are synced or on sealed files
+	if unsynced == 0 {
+		return p.flushLocked()
+	}
+	policy := p.conf.Durability
+	if policy.Mode != DURABILITY_GROUP {
+		return nil
+	}
+	if 0 < policy.GroupRecords && policy.GroupRecords <= unsynced {
+		return p.flushLocked()
+	}
+	if 0 < policy.GroupInterval && state.timer == nil {
+		mu, conf := p.mu, p.conf
+		state.timer = time.AfterFunc(policy.GroupInterval, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if state.timer == nil { //Flushed or closed meanwhile
+				return
+			}
+			state.timer = nil
+			state.errTimer = state.sync(&conf)
+		})
+	}
+	return nil
+}
+
+//sync syncs work file if there are unsynced records. Caller holds write lock
+func (p *durabilityState) sync(conf *FileStorageConf) error {
+	if 0 < p.unsynced {
+		if errSync := conf.syncWorkFile(); errSync != nil {
+			return errSync
+		}
+		p.unsynced = 0
+	}
+	p.durable = p.written
+	return nil
+}
+
+//flushLocked stops pending group commit and syncs. Error from group commit on timer is returned here
+func (p *FileStorage) flushLocked() error {
+	state := p.durability
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	if errSync := state.sync(&p.conf); errSync != nil {
+		return errSync
+	}
+	errTimer := state.errTimer
+	state.errTimer = nil
+	return errTimer
+}
+
+//Flush syncs written records to disk. After Flush returns without error, Durable covers all written records.
+//Read only storage has nothing to sync
+func (p *FileStorage) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return ErrClosed
+	}
+	if p.conf.ReadOnly {
+		return nil
+	}
+	return p.flushLocked()
+}
+
+//Durable returns position before which all records are synced to disk. Positions are same as on cursors,
+//records before Durable survive power cut. Read only storage returns 0
+func (p *FileStorage) Durable() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.durability.durable
+}
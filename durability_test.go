@@ -0,0 +1,130 @@
+package fixregsto
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDurabilityPolicy(t *testing.T) {
+	cfg := FileStorageConf{
+		Name:         "durable",
+		RecordSize:   4,
+		MaxFileCount: 4,
+		FileMaxSize:  4 * 8,
+		Path:         TMPTESTDIR,
+	}
+	for _, policy := range []DurabilityPolicy{{Mode: "fast"}, {Mode: DURABILITY_GROUP}, {Mode: DURABILITY_GROUP, GroupRecords: -1}} {
+		cfg.Durability = policy
+		assert.NotEqual(t, nil, cfg.CheckErrors(), "%#v", policy)
+	}
+	for _, policy := range []DurabilityPolicy{{}, {Mode: DURABILITY_SYNC}, {Mode: DURABILITY_OS}, {Mode: DURABILITY_GROUP, GroupInterval: time.Second}} {
+		cfg.Durability = policy
+		assert.Equal(t, nil, cfg.CheckErrors(), "%#v", policy)
+	}
+}
+
+func TestDurabilitySync(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "durable",
+		RecordSize:   4,
+		MaxFileCount: 4,
+		FileMaxSize:  4 * 8,
+		Path:         TMPTESTDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	for i := byte(0); i < 10; i++ {
+		_, errWrite := fl.Write([]byte{i, i, i, i})
+		assert.Equal(t, nil, errWrite)
+		assert.Equal(t, int64(i+1), fl.Durable())
+	}
+	assert.Equal(t, nil, fl.Close())
+	assert.Equal(t, ErrClosed, fl.Flush())
+
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, int64(10), fl.Durable())
+	assert.Equal(t, nil, fl.Close())
+}
+
+func TestDurabilityGroup(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "durable",
+		RecordSize:   4,
+		MaxFileCount: 4,
+		FileMaxSize:  4 * 8,
+		Path:         TMPTESTDIR,
+		Durability:   DurabilityPolicy{Mode: DURABILITY_GROUP, GroupRecords: 3},
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	durables := []int64{}
+	for i := byte(0); i < 7; i++ {
+		_, errWrite := fl.Write([]byte{i, i, i, i})
+		assert.Equal(t, nil, errWrite)
+		durables = append(durables, fl.Durable())
+	}
+	assert.Equal(t, []int64{0, 0, 3, 3, 3, 6, 6}, durables)
+	content, _ := os.ReadFile(cfg.BaseFileName())
+	assert.True(t, isAppendWork(content))
+
+	_, errWrite := fl.Write(make([]byte, 4*2)) //Seals first file, rest on work is not synced
+	assert.Equal(t, nil, errWrite)
+	assert.Equal(t, int64(8), fl.Durable())
+	_, errWrite = fl.Write(make([]byte, 4))
+	assert.Equal(t, nil, errWrite)
+	assert.Equal(t, int64(8), fl.Durable())
+	assert.Equal(t, nil, fl.Flush())
+	assert.Equal(t, int64(10), fl.Durable())
+	assert.Equal(t, nil, fl.Close())
+
+	//Interval
+	cfg.Durability = DurabilityPolicy{Mode: DURABILITY_GROUP, GroupInterval: 20 * time.Millisecond}
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, errWrite = fl.Write(make([]byte, 4))
+	assert.Equal(t, nil, errWrite)
+	assert.Equal(t, int64(10), fl.Durable())
+	assert.Eventually(t, func() bool { return fl.Durable() == 11 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, nil, fl.Close())
+}
+
+func TestDurabilityOS(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "durable",
+		RecordSize:   4,
+		MaxFileCount: 4,
+		FileMaxSize:  4 * 8,
+		Path:         TMPTESTDIR,
+		Durability:   DurabilityPolicy{Mode: DURABILITY_OS},
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	for i := byte(0); i < 5; i++ {
+		_, errWrite := fl.Write([]byte{i, i, i, i})
+		assert.Equal(t, nil, errWrite)
+	}
+	assert.Equal(t, int64(0), fl.Durable())
+	assert.Equal(t, nil, fl.Flush())
+	assert.Equal(t, int64(5), fl.Durable())
+	_, errWrite := fl.Write([]byte{5, 5, 5, 5})
+	assert.Equal(t, nil, errWrite)
+	assert.Equal(t, int64(5), fl.Durable())
+	assert.Equal(t, nil, fl.Close()) //Syncs rest
+
+	cfg.Durability = DurabilityPolicy{} //Work file is converted back
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	all, errAll := fl.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, 6*4, len(all))
+	content, _ := os.ReadFile(cfg.BaseFileName())
+	assert.False(t, isAppendWork(content))
+	assert.Equal(t, nil, fl.Close())
+}
@@ -0,0 +1,376 @@
+/*
+EEPROM based storage on top of ByteDevice (I2C or SPI EEPROM, FRAM etc...)
+
+Region is ring of record slots. Slot is sequence number uint64 + record + crc32.
+Sequence number does not wrap during lifetime of any device, so largest is always newest.
+There is no head pointer stored on fixed location, head is slot with largest valid sequence number.
+So every write goes to next slot and wear is spread evenly over whole region.
+Slot for sequence number seq is always seq % slotCount.
+
+Torn write can only damage slot being written (and the oldest record that was overwritten)
+*/
+package fixregsto
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+const (
+	eepromSeqSize = 8
+	eepromCrcSize = 4
+)
+
+//ByteDevice is byte addressable non-volatile memory like I2C or SPI EEPROM
+type ByteDevice interface {
+	ReadAt(p []byte, off int64) (n int, err error)
+	WriteAt(p []byte, off int64) (n int, err error) //Caller does not cross page boundary in one write
+	PageSize() int64                                //Write page size in bytes
+	Size() int64                                    //Total size in bytes
+	WriteCycles() int64                             //Rated write cycles per page, 0 if unknown
+}
+
+//EepromStorageConf tells what region of device is used
+//Offset and Size, region on device. Size 0 is rest of device after offset
+type EepromStorageConf struct {
+	Offset     int64
+	Size       int64
+	RecordSize int64
+}
+
+//EepromStorage implements FixRegSto on ByteDevice
+type EepromStorage struct {
+	conf      EepromStorageConf
+	dev       ByteDevice
+	slotCount int64
+
+	empty   bool
+	headSeq uint64 //Latest written
+	tailSeq uint64 //Oldest valid
+
+	mu      *sync.RWMutex //Write locks, reads share
+	cursor  *Cursor       //Used by Read and Seek
+	changes *changeNotifier
+	closed  *closeState
+}
+
+func (p *EepromStorageConf) slotSize() int64 {
+	return eepromSeqSize + p.RecordSize + eepromCrcSize
+}
+
+//CheckErrors tell is there problems with configuration on device
+func (p *EepromStorageConf) CheckErrors(dev ByteDevice) error {
+	if p.RecordSize < 1 {
+		return fmt.Errorf("Invalid RecordSize %v", p.RecordSize)
+	}
+	if p.Offset < 0 || dev.Size() < p.Offset+p.Size {
+		return fmt.Errorf("Region offset=%v size=%v is not inside device size %v", p.Offset, p.Size, dev.Size())
+	}
+	if dev.PageSize() < 1 {
+		return fmt.Errorf("Invalid device page size %v", dev.PageSize())
+	}
+	if p.regionSize(dev)/p.slotSize() < 2 {
+		return fmt.Errorf("Region is too small for two records of %v bytes", p.RecordSize)
+	}
+	return nil
+}
+
+func (p *EepromStorageConf) regionSize(dev ByteDevice) int64 {
+	if p.Size == 0 {
+		return dev.Size() - p.Offset
+	}
+	return p.Size
+}
+
+//InitEepromStorage scans device for head and tail
+func (p *EepromStorageConf) InitEepromStorage(dev ByteDevice) (EepromStorage, error) {
+	result := EepromStorage{conf: *p, mu: &sync.RWMutex{}, cursor: &Cursor{}, changes: newChangeNotifier(), closed: &closeState{}, dev: dev}
+	if errConf := p.CheckErrors(dev); errConf != nil {
+		return result, errConf
+	}
+	result.slotCount = p.regionSize(dev) / p.slotSize()
+
+	region := make([]byte, result.slotCount*p.slotSize())
+	if _, errRead := dev.ReadAt(region, p.Offset); errRead != nil {
+		return result, fmt.Errorf("Error reading eeprom err=%v", errRead.Error())
+	}
+	valid := make([]bool, result.slotCount)
+	found := false
+	for i := int64(0); i < result.slotCount; i++ {
+		seq, ok := result.decodeSlot(region[i*p.slotSize():(i+1)*p.slotSize()], i)
+		if !ok {
+			continue
+		}
+		valid[i] = true
+		if !found || result.headSeq < seq {
+			result.headSeq = seq
+		}
+		found = true
+	}
+	result.empty = !found
+	if found {
+		//Oldest possible is one round behind head. Skip what is not valid at tail end (torn write or never written)
+		result.tailSeq = 0
+		if uint64(result.slotCount) <= result.headSeq {
+			result.tailSeq = result.headSeq - uint64(result.slotCount) + 1
+		}
+		for result.tailSeq < result.headSeq && !valid[int64(result.tailSeq)%result.slotCount] {
+			result.tailSeq++
+		}
+	}
+	if _, errSeek := result.Seek(0, io.SeekStart); errSeek != nil {
+		return result, errSeek
+	}
+	return result, nil
+}
+
+//Close stops followers. Device is owned by caller and is not closed
+func (p *EepromStorage) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return ErrClosed
+	}
+	p.closed.closed = true
+	p.changes.notify()
+	return nil
+}
+
+//Flush flushes device if it implements Flusher. Writes go directly to device
+func (p *EepromStorage) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return ErrClosed
+	}
+	if flusher, ok := p.dev.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+//EstimatedLifetimeRecords tells how many records can be written before device is rated to wear out. 0 if unknown
+func (p *EepromStorage) EstimatedLifetimeRecords() int64 {
+	return p.dev.WriteCycles() * p.slotCount
+}
+
+func (p *EepromStorage) slotOffset(seq uint64) int64 {
+	return p.conf.Offset + (int64(seq)%p.slotCount)*p.conf.slotSize()
+}
+
+func (p *EepromStorage) encodeSlot(seq uint64, record []byte) []byte {
+	result := make([]byte, eepromSeqSize, p.conf.slotSize())
+	binary.LittleEndian.PutUint64(result, seq)
+	result = append(result, record...)
+	crc := make([]byte, eepromCrcSize)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(result))
+	return append(result, crc...)
+}
+
+//decodeSlot returns sequence number if slot is valid and on right place
+func (p *EepromStorage) decodeSlot(slot []byte, index int64) (uint64, bool) {
+	payloadEnd := eepromSeqSize + p.conf.RecordSize
+	if binary.LittleEndian.Uint32(slot[payloadEnd:]) != crc32.ChecksumIEEE(slot[0:payloadEnd]) {
+		return 0, false
+	}
+	seq := binary.LittleEndian.Uint64(slot)
+	return seq, int64(seq)%p.slotCount == index
+}
+
+//writePaged splits write on page boundaries
+func (p *EepromStorage) writePaged(content []byte, off int64) error {
+	pageSize := p.dev.PageSize()
+	for 0 < len(content) {
+		n := pageSize - off%pageSize
+		if int64(len(content)) < n {
+			n = int64(len(content))
+		}
+		if _, errWrite := p.dev.WriteAt(content[0:n], off); errWrite != nil {
+			return errWrite
+		}
+		content = content[n:]
+		off += n
+	}
+	return nil
+}
+
+func (p *EepromStorage) firstPosition() int64 {
+	if p.empty {
+		return 0
+	}
+	return int64(p.tailSeq)
+}
+
+func (p *EepromStorage) endPosition() int64 {
+	if p.empty {
+		return 0
+	}
+	return int64(p.headSeq) + 1
+}
+
+//Write implements writer interface. Only complete records are accepted
+func (p *EepromStorage) Write(raw []byte) (n int, err error) {
+	if len(raw)%int(p.conf.RecordSize) != 0 {
+		return 0, fmt.Errorf("Appended data length %v is not multiple of %v", len(raw), p.conf.RecordSize)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return 0, ErrClosed
+	}
+	defer p.changes.notify()
+	originalTotal := len(raw)
+	for 0 < len(raw) {
+		//Consecutive slots until end of region are written at once, less page writes
+		seq := uint64(p.endPosition())
+		startSeq := seq
+		chunk := []byte{}
+		written := 0
+		for written < len(raw) && (seq == startSeq || int64(seq)%p.slotCount != 0) {
+			chunk = append(chunk, p.encodeSlot(seq, raw[written:written+int(p.conf.RecordSize)])...)
+			written += int(p.conf.RecordSize)
+			seq++
+		}
+		if errWrite := p.writePaged(chunk, p.slotOffset(startSeq)); errWrite != nil {
+			return originalTotal - len(raw), errWrite
+		}
+		p.empty = false
+		p.headSeq = seq - 1
+		if uint64(p.slotCount) <= p.headSeq-p.tailSeq {
+			p.tailSeq = p.headSeq - uint64(p.slotCount) + 1
+		}
+		raw = raw[written:]
+	}
+	return originalTotal, nil
+}
+
+//readRecords reads records between sequence numbers
+func (p *EepromStorage) readRecords(from int64, to int64) ([]byte, error) {
+	result := make([]byte, 0, (to-from)*p.conf.RecordSize)
+	slot := make([]byte, p.conf.slotSize())
+	for seq := from; seq < to; seq++ {
+		if _, errRead := p.dev.ReadAt(slot, p.slotOffset(uint64(seq))); errRead != nil {
+			return result, errRead
+		}
+		readSeq, ok := p.decodeSlot(slot, seq%p.slotCount)
+		if !ok || int64(readSeq) != seq {
+			return result, &CorruptedError{Filename: "eeprom", Records: []int64{seq}}
+		}
+		result = append(result, slot[eepromSeqSize:eepromSeqSize+p.conf.RecordSize]...)
+	}
+	return result, nil
+}
+
+//Len returns how many records are stored
+func (p *EepromStorage) Len() (int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return 0, ErrClosed
+	}
+	return p.endPosition() - p.firstPosition(), nil
+}
+
+//GetLatest nRecords without moving seek cursor
+func (p *EepromStorage) GetLatest(nRecords int64) ([]byte, error) {
+	if nRecords < 1 {
+		return nil, fmt.Errorf("wrong parameter nRecords=%v", nRecords)
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
+	from := p.endPosition() - nRecords
+	if from < p.firstPosition() {
+		from = p.firstPosition()
+	}
+	return p.readRecords(from, p.endPosition())
+}
+
+//GetFirst nRecords without moving seek cursor
+func (p *EepromStorage) GetFirst(nRecords int64) ([]byte, error) {
+	if nRecords < 1 {
+		return nil, fmt.Errorf("wrong parameter nRecords=%v", nRecords)
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
+	to := p.firstPosition() + nRecords
+	if p.endPosition() < to {
+		to = p.endPosition()
+	}
+	return p.readRecords(p.firstPosition(), to)
+}
+
+//ReadAll gets all content
+func (p *EepromStorage) ReadAll() ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
+	return p.readRecords(p.firstPosition(), p.endPosition())
+}
+
+//Read implements Reader interface.  Except only array length must be multiple of recordsize for normal operation
+func (p *EepromStorage) Read(arr []byte) (n int, err error) {
+	return p.cursor.readFrom(p, arr)
+}
+
+//Seeks, For implementing seeker interface
+//Seeks with byte by byte but rounds new position to where record starts
+func (p *EepromStorage) Seek(offset int64, whence int) (int64, error) {
+	return p.cursor.readSeekFrom(p, offset, whence)
+}
+
+//NewCursor creates independent reader at first record. Cursor refers to this EepromStorage, do not copy EepromStorage after that
+func (p *EepromStorage) NewCursor() (*Cursor, error) {
+	return newCursor(p)
+}
+
+//Follow delivers records from offset and then new records as those are written.
+//Subscription refers to this EepromStorage, do not copy EepromStorage after that
+func (p *EepromStorage) Follow(ctx context.Context, offset int64, whence int) (*Subscription, error) {
+	return follow(ctx, p, p.changes, offset, whence, 0, nil)
+}
+
+//RecordSize tells how long one record is in bytes
+func (p *EepromStorage) RecordSize() int64 {
+	return p.conf.RecordSize
+}
+
+func (p *EepromStorage) positionRange() (int64, int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return 0, 0, ErrClosed
+	}
+	return p.firstPosition(), p.endPosition(), nil
+}
+
+func (p *EepromStorage) readRecordsAt(position int64, maxRecords int64) ([]byte, int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, position, ErrClosed
+	}
+	if position < p.firstPosition() { //If already overwritten
+		position = p.firstPosition()
+	}
+	to := position + maxRecords
+	if p.endPosition() < to {
+		to = p.endPosition()
+	}
+	if to <= position {
+		return []byte{}, position, nil
+	}
+	byt, errRead := p.readRecords(position, to)
+	return byt, position + int64(len(byt))/p.conf.RecordSize, errRead
+}
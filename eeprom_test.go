@@ -0,0 +1,116 @@
+package fixregsto
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEepromStorage(t *testing.T) {
+	dev := NewMemEeprom(336, 16, 1000000)
+	cfg := EepromStorageConf{RecordSize: 6} //slot is 18 bytes, not aligned to pages
+	sto, errInit := cfg.InitEepromStorage(dev)
+	assert.Equal(t, nil, errInit)
+	assert.Equal(t, int64(18), sto.slotCount)
+
+	n, _ := sto.Len()
+	assert.Equal(t, int64(0), n)
+	empty, errEmpty := io.ReadAll(&sto)
+	assert.Equal(t, nil, errEmpty)
+	assert.Equal(t, []byte{}, empty)
+
+	for i := 0; i < 10; i++ {
+		_, errWrite := sto.Write([]byte{byte(i), 1, 2, 3, 4, 5})
+		assert.Equal(t, nil, errWrite)
+	}
+	//Reboot
+	sto, errInit = cfg.InitEepromStorage(dev)
+	assert.Equal(t, nil, errInit)
+	n, _ = sto.Len()
+	assert.Equal(t, int64(10), n)
+	first, _ := sto.GetFirst(1)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5}, first)
+
+	//Over ring in one write
+	big := []byte{}
+	for i := 10; i < 40; i++ {
+		big = append(big, byte(i), 1, 2, 3, 4, 5)
+	}
+	_, errBig := sto.Write(big)
+	assert.Equal(t, nil, errBig)
+	n, _ = sto.Len()
+	assert.Equal(t, int64(18), n)
+
+	sto, errInit = cfg.InitEepromStorage(dev)
+	assert.Equal(t, nil, errInit)
+	first, _ = sto.GetFirst(1)
+	assert.Equal(t, []byte{22, 1, 2, 3, 4, 5}, first)
+	latest, _ := sto.GetLatest(1)
+	assert.Equal(t, []byte{39, 1, 2, 3, 4, 5}, latest)
+
+	//Wear is spread, no page gets much more writes than others
+	minWrites, maxWrites := dev.PageWrites[0], dev.PageWrites[0]
+	for _, w := range dev.PageWrites[0 : 18*18/16] {
+		if w < minWrites {
+			minWrites = w
+		}
+		if maxWrites < w {
+			maxWrites = w
+		}
+	}
+	assert.True(t, maxWrites-minWrites <= 3, "page writes %v", dev.PageWrites)
+
+	//Torn write. Record is not there after reboot, rest is ok
+	dev.TearNextWrite(5)
+	_, errTorn := sto.Write([]byte{40, 1, 2, 3, 4, 5})
+	assert.True(t, errors.Is(errTorn, ErrInjectedFault))
+	sto, errInit = cfg.InitEepromStorage(dev)
+	assert.Equal(t, nil, errInit)
+	n, _ = sto.Len()
+	assert.Equal(t, int64(17), n)
+	latest, _ = sto.GetLatest(1)
+	assert.Equal(t, []byte{39, 1, 2, 3, 4, 5}, latest)
+	first, _ = sto.GetFirst(1)
+	assert.Equal(t, []byte{23, 1, 2, 3, 4, 5}, first)
+
+	_, errWrite := sto.Write([]byte{40, 1, 2, 3, 4, 5})
+	assert.Equal(t, nil, errWrite)
+	latest, _ = sto.GetLatest(2)
+	assert.Equal(t, []byte{39, 1, 2, 3, 4, 5, 40, 1, 2, 3, 4, 5}, latest)
+
+	//Bit flip on stored record
+	dev.FlipBit(sto.slotOffset(30)+5, 2)
+	_, errAll := sto.ReadAll()
+	var corruptErr *CorruptedError
+	assert.True(t, errors.As(errAll, &corruptErr))
+	assert.Equal(t, []int64{30}, corruptErr.Records)
+
+	_, errSeek := sto.Seek(-6, io.SeekEnd)
+	assert.Equal(t, nil, errSeek)
+	last, errLast := io.ReadAll(&sto)
+	assert.Equal(t, nil, errLast)
+	assert.Equal(t, []byte{40, 1, 2, 3, 4, 5}, last)
+}
+
+func TestEepromSequenceOver32Bits(t *testing.T) {
+	dev := NewMemEeprom(18*4, 16, 1000000)
+	cfg := EepromStorageConf{RecordSize: 6}
+	sto, errInit := cfg.InitEepromStorage(dev)
+	assert.Equal(t, nil, errInit)
+	for seq := uint64(1<<32 - 2); seq < 1<<32+2; seq++ { //Ring written past 32 bit sequence numbers
+		assert.Equal(t, nil, sto.writePaged(sto.encodeSlot(seq, []byte{byte(seq), 1, 2, 3, 4, 5}), sto.slotOffset(seq)))
+	}
+	sto, errInit = cfg.InitEepromStorage(dev)
+	assert.Equal(t, nil, errInit)
+	first, _ := sto.GetFirst(1)
+	assert.Equal(t, []byte{0xFE, 1, 2, 3, 4, 5}, first)
+	latest, _ := sto.GetLatest(1)
+	assert.Equal(t, []byte{1, 1, 2, 3, 4, 5}, latest)
+	_, errWrite := sto.Write([]byte{2, 1, 2, 3, 4, 5})
+	assert.Equal(t, nil, errWrite)
+	all, errAll := sto.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, []byte{0xFF, 1, 2, 3, 4, 5, 0, 1, 2, 3, 4, 5, 1, 1, 2, 3, 4, 5, 2, 1, 2, 3, 4, 5}, all)
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"os"
 
 	"github.com/hjkoskel/fixregsto"
 )
@@ -80,6 +81,15 @@ func main() {
 		return
 	}
 	fmt.Printf("nextbuf %#v \nsize=%v\n", nextbuf, len(nextbuf))
-	//use io.copy and make databackup
 
+	//Backup keeps files as they are stored. Restore(f, conf) rebuilds storage from it
+	backup, errBackup := os.Create("./alpha.tar")
+	if errBackup != nil {
+		fmt.Printf("errBackup=%v\n", errBackup.Error())
+		return
+	}
+	defer backup.Close()
+	if errSnapshot := sto.Snapshot(backup); errSnapshot != nil {
+		fmt.Printf("errSnapshot=%v\n", errSnapshot.Error())
+	}
 }
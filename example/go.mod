@@ -4,4 +4,6 @@ go 1.18
 
 require github.com/hjkoskel/fixregsto v0.0.0
 
+require github.com/klauspost/compress v1.15.9 // indirect
+
 replace github.com/hjkoskel/fixregsto v0.0.0 => ./../
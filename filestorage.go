@@ -2,6 +2,8 @@
 package fixregsto
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,8 +11,12 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 //FileStorageConf tells what kind of FileStorage instance is going to be created
@@ -28,16 +34,60 @@ type FileStorageConf struct {
 	Path        string
 
 	//Compression settings
-	CompressionMethod string //Empty or "gz"
+	CompressionMethod string //Empty, "gz", "snappy", "zstd" or registered with RegisterCodec. See codec.go
+	CompressionLevel  int    //Codec specific, gz 1-9 and zstd 1-22. 0 is default
 	BitSlices         []int  //Empty array no slicing.Else give bitlengths (usually bit size of each variable in record)
+
+	Schema *RecordSchema //Optional description of record fields. Gives bit slices when BitSlices is empty. See schema.go
+
+	FieldTransforms []string //One per bit slice, like "delta", "delta2", "zigzag", "xor" or chained "delta+zigzag". Empty is no transform. See transform.go
+
+	//Framing settings
+	Framed          bool  //Files start with header and records are protected with CRC32. See framing.go
+	CrcBlockRecords int64 //How many records one CRC covers on framed files. 0 or 1 is CRC per record
+	SkipCorrupted   bool  //Reads drop corrupted records. Otherwise *CorruptedError is returned
+
+	Key KeyExtractor //Where sort key (like timestamp) is in record. Required by SeekToKey and RangeByKey
+
+	AppendWork bool //Work file is appended on write instead of rewriting it. Records have CRC32, torn end is cut on init. See appendwork.go
+
+	Durability DurabilityPolicy //When writes are synced to disk. Default syncs every Write. See durability.go
+
+	Retention RetentionPolicy //Removes old files by age, total bytes or free space in addition to MaxFileCount. See retention.go
+
+	Rotation RotationPolicy //What happens to oldest file when consumers have not committed it. See rotation.go
+
+	RawFiles int64 //Newest sealed files are kept without compression, older are recompressed in background. See tiering.go
+
+	Indexed bool //Keep sidecar index file of record counts and first/last keys per numbered file. See index.go
+
+	ReadOnly bool //Open without lock for inspecting storage while other process writes. Writes return ErrReadOnly. See lock.go
+
+	FollowPollInterval time.Duration //How often Follow on read only storage checks work file. 0 is DEFAULTFOLLOWPOLL
+
+	CacheFiles int //How many decompressed sealed files are kept in memory for reads. 0 is DEFAULTCACHEFILES, negative disables. See cache.go
 }
 
 //FileStorage, includes conf and cached data
 type FileStorage struct {
 	conf FileStorageConf
 
-	workBuffer   []byte //Latest
-	readPosition int64  //record counter
+	mu          *sync.RWMutex //Write locks, reads share. Pointer so FileStorage can be returned by value
+	workBuffer  []byte        //Latest
+	rewriteWork bool          //Append to work file failed, next Write rewrites whole work file
+	cursor      *Cursor       //Used by Read and Seek
+
+	recovery RecoveryReport  //What was repaired on init
+	index    *indexState     //Loaded if conf.Indexed
+	lock     *storageLock    //Held from init to Close, nil on read only
+	changes  *changeNotifier //Wakes followers on write
+	cache    *fileCache      //Decompressed sealed files
+	numbers  []int64         //Numbered files on disk, kept up to date by writer. Nil on read only
+
+	durability *durabilityState //Synced and unsynced records
+	tiering    *tieringState    //Background recompression, nil if RawFiles is not set or read only
+	rotation   *RotationStatus  //Unconsumed records removed by rotation
+	closed     *closeState
 }
 
 func (p *FileStorageConf) recordsPerFile() int64 {
@@ -59,7 +109,47 @@ func (p *FileStorageConf) CheckErrors() error {
 	if p.FileMaxSize < p.RecordSize {
 		return fmt.Errorf("MaxFileSize(%v) < RecordSize(%v)", p.FileMaxSize, p.RecordSize)
 	}
-	return nil
+	if p.CrcBlockRecords < 0 {
+		return fmt.Errorf("Invalid CrcBlockRecords %v", p.CrcBlockRecords)
+	}
+	if p.Schema != nil {
+		if errSchema := p.Schema.CheckErrors(p.RecordSize); errSchema != nil {
+			return errSchema
+		}
+		if 0 < len(p.BitSlices) && !reflect.DeepEqual(p.BitSlices, p.Schema.BitSlices()) {
+			return fmt.Errorf("BitSlices %v do not match schema %v", p.BitSlices, p.Schema.BitSlices())
+		}
+	}
+	if errDurability := p.Durability.CheckErrors(); errDurability != nil {
+		return errDurability
+	}
+	if errRetention := p.Retention.CheckErrors(p.Key); errRetention != nil {
+		return errRetention
+	}
+	if errRotation := p.Rotation.CheckErrors(p.Path); errRotation != nil {
+		return errRotation
+	}
+	if errTiering := p.checkTiering(); errTiering != nil {
+		return errTiering
+	}
+	coding := p.coding()
+	if errCoding := coding.CheckErrors(); errCoding != nil {
+		return errCoding
+	}
+	if 0 < len(p.CompressionMethod) {
+		if _, errCodec := GetCodec(p.CompressionMethod); errCodec != nil {
+			return errCodec
+		}
+	}
+	return p.Key.CheckErrors(p.RecordSize)
+}
+
+//bitSlices is BitSlices or from Schema
+func (p *FileStorageConf) bitSlices() []int {
+	if len(p.BitSlices) == 0 && p.Schema != nil {
+		return p.Schema.BitSlices()
+	}
+	return p.BitSlices
 }
 
 func (p *FileStorageConf) BaseFileName() string {
@@ -67,29 +157,131 @@ func (p *FileStorageConf) BaseFileName() string {
 }
 
 //InitFileStorage, Call this method after creating FileStorageConf.
-//This creates dir if required
+//This creates dir if required, takes lock (see lock.go) and runs recovery pass (see RecoveryReport)
+//Call Close when storage is not needed anymore, so other process can open it
 func (p *FileStorageConf) InitFileStorage() (FileStorage, error) {
-	result := FileStorage{conf: *p}
+	cacheFiles := p.CacheFiles
+	if cacheFiles == 0 {
+		cacheFiles = DEFAULTCACHEFILES
+	}
+	result := FileStorage{conf: *p, mu: &sync.RWMutex{}, cursor: &Cursor{}, changes: newChangeNotifier(), cache: newFileCache(cacheFiles), index: &indexState{}, durability: &durabilityState{}, rotation: &RotationStatus{}, closed: &closeState{}}
+	if p.ReadOnly {
+		return result, p.initReadOnly(&result)
+	}
 
 	errMkdir := os.MkdirAll(p.Path, os.ModePerm)
 	if errMkdir != nil {
 		return result, fmt.Errorf("Error creating dir %v  err=%v", errMkdir.Error(), errMkdir)
 	}
+	lock, stalePid, errLock := acquireLock(p.lockFileName())
+	if errLock != nil {
+		return result, errLock
+	}
+	result.lock = lock
+	errInit := p.initLocked(&result)
+	if errInit != nil {
+		lock.release()
+		return result, errInit
+	}
+	result.recovery.StaleLockPid = stalePid
+	if lock.staleEmpty {
+		result.recovery.Removed = append(result.recovery.Removed, p.lockFileName())
+	}
+	return result, nil
+}
+
+//initLocked recovers and loads state when lock is taken. Layout is checked first, recovery with wrong conf could remove files
+func (p *FileStorageConf) initLocked(result *FileStorage) error {
+	if errManifest := p.checkManifest(true); errManifest != nil {
+		return errManifest
+	}
+	var errRecover error
+	result.recovery, errRecover = p.Recover()
+	if errRecover != nil {
+		return fmt.Errorf("Recovery failed on init err=%v", errRecover.Error())
+	}
+	var errLost error
+	result.rotation.LostRecords, errLost = p.readLostRecords()
+	if errLost != nil {
+		return fmt.Errorf("Reading lost records failed on init err=%v", errLost.Error())
+	}
+	if p.Indexed {
+		var errIndex error
+		result.index.entries, errIndex = p.loadIndex()
+		if errIndex != nil {
+			return fmt.Errorf("Loading index failed on init err=%v", errIndex.Error())
+		}
+	}
+	var errNumbers error
+	result.numbers, errNumbers = p.existingFileNumbers()
+	if errNumbers != nil {
+		return fmt.Errorf("Listing files failed on init err=%v", errNumbers.Error())
+	}
 	//Read to work buffer
 	workfile := p.BaseFileName()
 	if fileExists(workfile) {
 		var errRead error
-		result.workBuffer, errRead = os.ReadFile(workfile)
+		result.workBuffer, errRead = p.readWorkFile()
 		if errRead != nil {
-			return result, fmt.Errorf("Error reading %v err=%v", workfile, errRead.Error())
+			return fmt.Errorf("Error reading %v err=%v", workfile, errRead.Error())
+		}
+	}
+	result.durability.written = result.endPosition() //Recovery synced what was on disk
+	result.durability.durable = result.durability.written
+	_, fixPointerErr := result.Seek(0, io.SeekStart)
+	if fixPointerErr != nil {
+		return fmt.Errorf("Reset read failed in init err=%v", fixPointerErr.Error())
+	}
+	if 0 < p.RawFiles {
+		var errTiering error
+		result.tiering, errTiering = p.newTieringState(result.numbers)
+		if errTiering != nil {
+			return fmt.Errorf("Checking raw files failed on init err=%v", errTiering.Error())
 		}
+		result.startTiering()
 	}
+	return nil
+}
+
+//initReadOnly does not touch files. Recovery is left to writer and index is not used, it could be out of date
+func (p *FileStorageConf) initReadOnly(result *FileStorage) error {
+	if _, errStat := os.Stat(p.Path); errStat != nil {
+		return fmt.Errorf("Storage path %v is not available err=%v", p.Path, errStat.Error())
+	}
+	if errManifest := p.checkManifest(false); errManifest != nil {
+		return errManifest
+	}
+	result.conf.Indexed = false
 	_, fixPointerErr := result.Seek(0, io.SeekStart)
 	if fixPointerErr != nil {
-		return result, fmt.Errorf("Reset read failed in init err=%v", fixPointerErr.Error())
+		return fmt.Errorf("Reset read failed in init err=%v", fixPointerErr.Error())
 	}
+	return nil
+}
 
-	return result, nil
+//Close syncs unsynced records, stops group commit, background recompression and followers and releases lock.
+//Calls after this return ErrClosed
+func (p *FileStorage) Close() error {
+	errTiering := p.tiering.halt() //Before lock, recompression takes it
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return ErrClosed
+	}
+	p.closed.closed = true
+	p.changes.notify()
+	var errFlush error
+	if !p.conf.ReadOnly {
+		errFlush = p.flushLocked()
+	}
+	errRelease := p.lock.release()
+	if errFlush != nil {
+		return errFlush
+	}
+	if errRelease != nil {
+		return errRelease
+	}
+	return errTiering
 }
 
 //getNumberRangeOnDisk, function gets minimum and maximum number in storage files and count of files  (count is important if missing files in between? Also decides is delete needed)
@@ -108,16 +300,17 @@ func (p *FileStorageConf) GetNumberRangeOnDisk() (int64, int64, int64, error) {
 		if !strings.HasPrefix(name, prefix) || finfo.IsDir() {
 			continue //It is not with correct name
 		}
-		count++
 		sNumber := strings.Replace(name, prefix, "", 1)
 		n, parseErr := strconv.ParseInt(sNumber, 10, 64)
-		if parseErr == nil {
-			if maxresult < n && 0 < finfo.Size() {
-				maxresult = n
-			}
-			if n < minresult {
-				minresult = n
-			}
+		if parseErr != nil {
+			continue //Leftover _TMP or other file, not storage file
+		}
+		count++
+		if maxresult < n && 0 < finfo.Size() {
+			maxresult = n
+		}
+		if n < minresult {
+			minresult = n
 		}
 	}
 	if maxresult == -1 {
@@ -127,6 +320,11 @@ func (p *FileStorageConf) GetNumberRangeOnDisk() (int64, int64, int64, error) {
 	return minresult, maxresult, count, nil
 }
 
+//RecoveryReport tells what was repaired when storage was initialized
+func (p *FileStorage) RecoveryReport() RecoveryReport {
+	return p.recovery
+}
+
 //gets filename for filestorage
 func (p *FileStorageConf) filename(n int64) string {
 	return fmt.Sprintf("%s_%v", p.BaseFileName(), n)
@@ -137,298 +335,472 @@ func (p *FileStorage) Write(raw []byte) (n int, err error) { //size must be reco
 	if len(raw)%int(p.conf.RecordSize) != 0 {
 		return 0, fmt.Errorf("Appended data length %v is not multiple of %v", len(raw), p.conf.RecordSize)
 	}
-
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return 0, ErrClosed
+	}
+	if p.conf.ReadOnly {
+		return 0, ErrReadOnly
+	}
 	newRecordCount := int64(len(raw)) / p.conf.RecordSize
+	if errFull := p.checkFull(newRecordCount); errFull != nil {
+		return 0, errFull
+	}
+	defer p.changes.notify()
+
 	recordsInWork := int64(len(p.workBuffer)) / p.conf.RecordSize
 	recordsFreeInWork := p.conf.recordsPerFile() - recordsInWork
+	syncNow := p.conf.Durability.syncsEachWrite()
 
 	//Easy case, just update work buffer and sync that to disk
 	if newRecordCount < recordsFreeInWork { //Not need yet to rename work
-		p.workBuffer = append(p.workBuffer, raw...) //Ok, fill up work buffer
-		_, wErr := writeWithFsyncCow(p.conf.BaseFileName(), p.workBuffer)
+		appendable := p.conf.appendWork() && 0 < len(p.workBuffer) && !p.rewriteWork //Work file exists with header
+		work := append(p.workBuffer, raw...)                                         //Work buffer grows only after write succeeds
+		var wErr error
+		if appendable {
+			wErr = p.conf.appendWorkFile(raw, syncNow)
+			p.rewriteWork = wErr != nil //Torn entry would hide later appends on recovery, rewrite covers it
+		} else {
+			wErr = p.conf.writeWorkFile(work, syncNow)
+			p.rewriteWork = p.rewriteWork && wErr != nil
+		}
 		if wErr != nil {
 			return 0, wErr
 		}
-		return len(raw), nil
+		p.workBuffer = work
+		if syncNow {
+			return len(raw), p.wrote(0)
+		}
+		return len(raw), p.wrote(p.durability.unsynced + newRecordCount)
 	}
 
 	originalTotal := len(raw)
 
 	//Put what is required, fill completely up and write to target file
 	newPiece := raw[0 : recordsFreeInWork*p.conf.RecordSize]
-	p.workBuffer = append(p.workBuffer, newPiece...)
-	raw = raw[recordsFreeInWork*p.conf.RecordSize:]
-
-	minFileNumber, maxFileNumber, filecount, errRange := p.conf.GetNumberRangeOnDisk()
-	if errRange != nil {
-		return 0, fmt.Errorf("FileStorage Write erro gettin number range err=%w", errRange)
-	}
-
-	_, wErr := writeWithFsyncCowCompressed(p.conf.filename(maxFileNumber+1), p.workBuffer, p.conf.CompressionMethod, p.conf.BitSlices)
+	wErr := p.sealRecords(append(append([]byte{}, p.workBuffer...), newPiece...), 0 < len(p.workBuffer))
 	if wErr != nil {
 		return 0, wErr
 	}
-
-	if p.conf.MaxFileCount <= filecount {
-		oldFileName := p.conf.filename(minFileNumber)
-		removeErr := os.Remove(oldFileName)
-		if removeErr != nil {
-			return 0, fmt.Errorf("Error removing file on FileStorage Write err=%v  conf.maxFileCount=%v, maxFileNumber=%v minFileNumber=%v", removeErr.Error(), p.conf.MaxFileCount, minFileNumber, maxFileNumber)
-		}
-	}
-
-	maxFileNumber++
+	raw = raw[recordsFreeInWork*p.conf.RecordSize:]
 	p.workBuffer = []byte{}
 	os.Remove(p.conf.BaseFileName()) //Remove that there would not be wrong material if fail
 
 	//Check is there need to write multiple files completely
 	bytesPerFile := p.conf.recordsPerFile() * p.conf.RecordSize
 	for int(bytesPerFile) <= len(raw) { //While there is data for enough for complete files
-		minFileNumber, maxFileNumber, filecount, errRange := p.conf.GetNumberRangeOnDisk()
-		if errRange != nil {
-			return 0, fmt.Errorf("FileStorage Write erro gettin number range err=%w", errRange)
-		}
-
-		_, wErr := writeWithFsyncCowCompressed(p.conf.filename(maxFileNumber+1), raw[0:bytesPerFile], p.conf.CompressionMethod, p.conf.BitSlices)
+		wErr := p.sealRecords(raw[0:bytesPerFile], false)
 		if wErr != nil {
 			return 0, wErr
 		}
 		raw = raw[bytesPerFile:]
-		if p.conf.MaxFileCount <= filecount {
-			oldFileName := p.conf.filename(minFileNumber)
-			removeErr := os.Remove(oldFileName)
-			if removeErr != nil {
-				return 0, fmt.Errorf("Error removing file on FileStorage Write err=%v  conf.maxFileCount=%v, maxFileNumber=%v minFileNumber=%v", removeErr.Error(), p.conf.MaxFileCount, minFileNumber, maxFileNumber)
-			}
-		}
 	}
 
-	p.workBuffer = raw //let this be work buffer
-	//Write work file
-	basefilename := p.conf.BaseFileName() //Known as work file
-	_, wErr = writeWithFsyncCow(basefilename, p.workBuffer)
+	p.workBuffer = append([]byte{}, raw...) //let this be work buffer, caller may reuse raw
+	//Write work file. Sealed files are synced, only rest on work file can be unsynced
+	wErr = p.conf.writeWorkFile(p.workBuffer, syncNow)
 	if wErr != nil {
 		return 0, wErr
 	}
-	return originalTotal, nil
+	p.rewriteWork = false
+	if syncNow {
+		return originalTotal, p.wrote(0)
+	}
+	return originalTotal, p.wrote(int64(len(raw)) / p.conf.RecordSize)
 }
 
-//Len returns how many records are stored
-func (p *FileStorage) Len() (int64, error) {
-	bytecount := int64(len(p.workBuffer))
-	minFileNumber, maxFileNumber, _, errRange := p.conf.GetNumberRangeOnDisk()
+//sealRecords writes full file of records as next numbered file and removes oldest file if MaxFileCount is reached.
+//With fromWork records start with work file, it is removed after seal. Seal mark tells recovery and readers that
+//work file left by power cut is already sealed
+func (p *FileStorage) sealRecords(records []byte, fromWork bool) error {
+	minFileNumber, maxFileNumber, filecount, errRange := p.conf.GetNumberRangeOnDisk()
 	if errRange != nil {
-		return 0, errRange
+		return fmt.Errorf("FileStorage Write erro gettin number range err=%w", errRange)
 	}
 
-	sizemap, errListFileSizes := listFileSizes(p.conf.Path, p.conf.Name)
-	if errListFileSizes != nil {
-		return 0, errListFileSizes
+	newFileNumber := maxFileNumber + 1
+	if fromWork {
+		if errMark := p.conf.markSeal(newFileNumber); errMark != nil {
+			return errMark
+		}
+	}
+	wErr := p.conf.sealingConf().writeSealedFile(p.conf.filename(newFileNumber), records)
+	if wErr != nil {
+		if fromWork {
+			p.conf.unmarkSeal()
+		}
+		return wErr
 	}
+	if fromWork {
+		if errRemove := os.Remove(p.conf.BaseFileName()); errRemove != nil && !os.IsNotExist(errRemove) {
+			return errRemove
+		}
+		if errMark := p.conf.unmarkSeal(); errMark != nil {
+			return errMark
+		}
+	}
+	if info, errStat := os.Stat(p.conf.filename(newFileNumber)); errStat == nil { //Likely read soon by followers
+		p.cache.put(newFileNumber, info, append([]byte{}, records...))
+	}
+	p.numbers = append(p.numbers, newFileNumber)
+	p.tiering.sealed(newFileNumber)
 
-	for i := minFileNumber; i <= maxFileNumber; i++ {
-		filesize, haz := sizemap[fmt.Sprintf("%s_%v", p.conf.Name, i)]
-		if haz {
-			bytecount += int64(filesize)
+	removed := int64(-1)
+	if p.conf.MaxFileCount <= filecount {
+		removeErr := p.rotate(minFileNumber)
+		if removeErr != nil {
+			return fmt.Errorf("Error removing file on FileStorage Write err=%v  conf.maxFileCount=%v, maxFileNumber=%v minFileNumber=%v", removeErr.Error(), p.conf.MaxFileCount, minFileNumber, maxFileNumber)
 		}
+		removed = minFileNumber
+		p.cache.remove(minFileNumber)
+		p.forgetFile(minFileNumber)
 	}
-	return bytecount / p.conf.RecordSize, nil
+	if errIndex := p.updateIndex(newFileNumber, records, removed); errIndex != nil {
+		return errIndex
+	}
+	_, errRetention := p.enforceLocked()
+	return errRetention
+}
+
+//forgetFile drops removed file from numbers
+func (p *FileStorage) forgetFile(fileNumber int64) {
+	kept := make([]int64, 0, len(p.numbers))
+	for _, n := range p.numbers {
+		if n != fileNumber {
+			kept = append(kept, n)
+		}
+	}
+	p.numbers = kept
+	p.tiering.forget(fileNumber)
+}
+
+//Len returns how many records are stored
+func (p *FileStorage) Len() (int64, error) {
+	return reading(p, func() (int64, error) {
+		bytecount := int64(len(p.workBuffer))
+		if p.conf.Indexed {
+			count := bytecount / p.conf.RecordSize
+			for _, entry := range p.index.entries {
+				count += entry.RecordCount
+			}
+			return count, nil
+		}
+		minFileNumber, maxFileNumber, _, errRange := p.conf.GetNumberRangeOnDisk()
+		if errRange != nil {
+			return 0, errRange
+		}
+
+		sizemap, errListFileSizes := listFileSizes(p.conf.Path, p.conf.Name)
+		if errListFileSizes != nil {
+			return 0, errListFileSizes
+		}
+
+		for i := minFileNumber; i <= maxFileNumber; i++ {
+			filesize, haz := sizemap[fmt.Sprintf("%s_%v", p.conf.Name, i)]
+			if !haz {
+				continue
+			}
+			if p.conf.Framed {
+				header, errHeader := readFramedFileHeader(p.conf.filename(i))
+				if errHeader == nil {
+					bytecount += header.RecordCount * p.conf.RecordSize
+					continue
+				}
+			}
+			bytecount += int64(filesize)
+		}
+		return bytecount / p.conf.RecordSize, nil
+	})
 }
 
 //Uses conf. Does not include state like FileStorage
+//Framed files are decoded as their header says, corrupted records are dropped and reported with *CorruptedError
 func (p *FileStorageConf) ReadFileWithNumber(fileNumber int64) ([]byte, error) {
-	return readCompressedFile(p.filename(fileNumber), p.CompressionMethod, p.BitSlices)
+	return p.readSealedFile(p.filename(fileNumber))
 }
 
-func (p *FileStorage) GetLatest(nRecords int64) ([]byte, error) {
-	if nRecords < 1 {
-		return nil, fmt.Errorf("wrong parameter nRecords=%v", nRecords)
+//skipCorrupted is for reading functions, drops CorruptedError if SkipCorrupted is set
+func (p *FileStorageConf) skipCorrupted(byt []byte, errRead error) ([]byte, error) {
+	var corruptErr *CorruptedError
+	if p.SkipCorrupted && errors.As(errRead, &corruptErr) {
+		return byt, nil
 	}
-	minFileNumber, maxFileNumber, filecount, errRange := p.conf.GetNumberRangeOnDisk()
-	if errRange != nil {
-		return nil, errRange
+	return byt, errRead
+}
+
+func (p *FileStorageConf) readSealedFile(filename string) ([]byte, error) {
+	content, errRead := os.ReadFile(filename)
+	if errRead != nil {
+		return nil, errRead
 	}
-	targetSize := nRecords * p.conf.RecordSize
-	result := append([]byte{}, p.workBuffer...)
-	if 0 < filecount {
-		for fileNumber := maxFileNumber; minFileNumber <= fileNumber; fileNumber-- {
-			byt, errRead := p.conf.ReadFileWithNumber(fileNumber)
-			if errRead != nil {
-				return result, errRead
-			}
-			result = append(byt, result...)
-			if int64(len(result)) <= targetSize {
-				break
-			}
+	if !p.Framed || !isFramed(content) { //Unframed or written before framing was enabled
+		payload, errDecompress := decompressDetect(content, p.CompressionMethod, p.recordsPerFile()*p.RecordSize) //Sealed files are full
+		if errDecompress != nil {
+			return nil, errDecompress
 		}
+		coding := p.coding()
+		return coding.decode(payload)
 	}
-
-	if int64(len(result)) <= targetSize {
-		return result, nil
+	_, records, errDecode := decodeFramed(content)
+	var corruptErr *CorruptedError
+	if errors.As(errDecode, &corruptErr) {
+		corruptErr.Filename = filename
 	}
-	return result[int64(len(result))-targetSize:], nil
+	return records, errDecode
 }
 
-//GetFirst nRecords without moving seek cursor
-func (p *FileStorage) GetFirst(nRecords int64) ([]byte, error) {
-	if nRecords < 1 {
-		return nil, fmt.Errorf("wrong parameter nRecords=%v", nRecords)
+//writeSealedFile writes full numbered file
+func (p *FileStorageConf) writeSealedFile(filename string, records []byte) error {
+	if !p.Framed {
+		_, wErr := writeWithFsyncCowCompressed(filename, records, p.CompressionMethod, p.CompressionLevel, p.coding())
+		return wErr
 	}
-	minFileNumber, maxFileNumber, filecount, errRange := p.conf.GetNumberRangeOnDisk()
-	if errRange != nil {
-		return nil, errRange
+	content, errEncode := p.encodeSealed(records)
+	if errEncode != nil {
+		return errEncode
 	}
-	targetSize := nRecords * p.conf.RecordSize
-	result := []byte{}
-	if 0 < filecount {
-		for fileNumber := minFileNumber; fileNumber <= maxFileNumber; fileNumber++ {
-			byt, errRead := p.conf.ReadFileWithNumber(fileNumber)
-			if errRead != nil {
-				return result, errRead
-			}
-			result = append(result, byt...)
-			if targetSize <= int64(len(result)) {
-				break
-			}
-		}
+	_, wErr := writeWithFsyncCow(filename, content)
+	if wErr != nil {
+		return wErr
 	}
-	result = append(result, p.workBuffer...)
+	return p.verifySealedFile(filename, records)
+}
 
-	if int64(len(result)) <= targetSize {
-		return result, nil
+//encodeSealed creates content of numbered file
+func (p *FileStorageConf) encodeSealed(records []byte) ([]byte, error) {
+	if p.Framed {
+		return encodeFramed(records, p.RecordSize, p.CompressionMethod, p.CompressionLevel, p.coding(), p.CrcBlockRecords)
+	}
+	coding := p.coding()
+	content, errCoding := coding.encode(records)
+	if errCoding != nil {
+		return nil, errCoding
 	}
-	return result[0:targetSize], nil
+	return compressBytes(content, p.CompressionMethod, p.CompressionLevel)
 }
 
-//ReadAll gets all content. Use with caution, small storages
-func (p *FileStorage) ReadAll() ([]byte, error) {
-	result := []byte{}
-	minFileNumber, maxFileNumber, filecount, errRange := p.conf.GetNumberRangeOnDisk()
-	if errRange != nil {
-		return result, errRange
+//verifySealedFile reads file back and compares it to records it was written from
+func (p *FileStorageConf) verifySealedFile(filename string, records []byte) error {
+	refContent, refReadErr := p.readSealedFile(filename)
+	if refReadErr != nil {
+		return fmt.Errorf("error reading back file %v, err=%v", filename, refReadErr)
 	}
-
-	if filecount == 0 {
-		return p.workBuffer, nil
+	if !bytes.Equal(records, refContent) {
+		return fmt.Errorf("read back does not match on file %v", filename)
 	}
+	return nil
+}
 
-	for fileNumber := minFileNumber; fileNumber <= maxFileNumber; fileNumber++ {
-		fname := p.conf.filename(fileNumber)
-		if fileExists(fname) {
-			byt, errRead := p.conf.ReadFileWithNumber(fileNumber)
-			if errRead != nil {
-				return result, errRead
-			}
-			result = append(result, byt...)
+//decodeWorkContent gets records from work file content. Torn end of append only work file is left out
+func (p *FileStorageConf) decodeWorkContent(content []byte) ([]byte, error) {
+	if isAppendWork(content) {
+		records, _, errDecode := decodeAppendWork(content, p.RecordSize)
+		if errDecode != nil && !p.appendWork() { //Unframed records that start like append work file
+			return content, nil
 		}
+		return records, errDecode
 	}
-	result = append(result, p.workBuffer...)
-	return result, nil
+	if !p.Framed || !isFramed(content) {
+		return content, nil
+	}
+	_, records, errDecode := decodeFramed(content)
+	var corruptErr *CorruptedError
+	if errors.As(errDecode, &corruptErr) {
+		corruptErr.Filename = p.BaseFileName()
+	}
+	return records, errDecode
 }
 
-//Read implements Reader interface.  Except only array length must be multiple of recordsize for normal operation
-func (p *FileStorage) Read(arr []byte) (n int, err error) {
-	if len(arr) < int(p.conf.RecordSize) { //Breaks read interface but it have to. Avoid io.ReadAll
-		//usually problem if non power of 2 record size and io.ReadAll kind of method
-		return 0, fmt.Errorf("Asked %v bytes, minimum record size is %v", len(arr), p.conf.RecordSize)
+func (p *FileStorageConf) readWorkFile() ([]byte, error) {
+	content, errRead := os.ReadFile(p.BaseFileName())
+	if errRead != nil {
+		return nil, errRead
 	}
+	return p.decodeWorkContent(content)
+}
 
-	minFileNumber, maxFileNumber, filecount, errRange := p.conf.GetNumberRangeOnDisk()
-	if errRange != nil {
-		return 0, errRange
+//writeWorkFile replaces work file. Synced if syncFile is set
+func (p *FileStorageConf) writeWorkFile(records []byte, syncFile bool) error {
+	if p.appendWork() {
+		_, wErr := writeCow(p.BaseFileName(), encodeAppendWork(records, p.RecordSize), syncFile)
+		return wErr
 	}
-	fileNumber := p.readPosition / p.conf.recordsPerFile()
-
-	if fileNumber < int64(minFileNumber) { //If already dropped
-		p.readPosition = int64(minFileNumber) * p.conf.recordsPerFile()
-		fileNumber = minFileNumber
+	if !p.Framed {
+		_, wErr := writeCow(p.BaseFileName(), records, syncFile)
+		return wErr
 	}
+	content, errEncode := encodeFramed(records, p.RecordSize, "", 0, fieldCoding{}, p.CrcBlockRecords)
+	if errEncode != nil {
+		return errEncode
+	}
+	_, wErr := writeCow(p.BaseFileName(), content, syncFile)
+	return wErr
+}
 
-	recordsNeeded := len(arr) / int(p.conf.RecordSize)             //rounded down
-	bytesNeeded := int64(p.conf.RecordSize) * int64(recordsNeeded) // return n is this or lower
-
-	crudeBuf := []byte{}                                                                //Crude way but minimize bugs first, then make unit tests and then optimize memory usage and speed
-	startIndex := (p.readPosition % p.conf.recordsPerFile()) * int64(p.conf.RecordSize) //Inside file or this crude buf
-	//Pick file numbers that are available, skip others. Break when enough
-	if 0 < filecount {
-		for ; fileNumber <= maxFileNumber; fileNumber++ {
-			fname := p.conf.filename(fileNumber)
-			if fileExists(fname) {
-				byt, errRead := p.conf.ReadFileWithNumber(fileNumber)
-				if errRead != nil {
-					return 0, errRead
-				}
-				crudeBuf = append(crudeBuf, byt...)
+//GetLatest returns up to nRecords latest records. Files are read from newest until there are enough records
+func (p *FileStorage) GetLatest(nRecords int64) ([]byte, error) {
+	if nRecords < 1 {
+		return nil, fmt.Errorf("wrong parameter nRecords=%v", nRecords)
+	}
+	return reading(p, func() ([]byte, error) {
+		numbers, errNumbers := p.fileNumbers()
+		if errNumbers != nil {
+			return nil, errNumbers
+		}
+		targetSize := nRecords * p.conf.RecordSize
+		parts := [][]byte{p.workBuffer} //Newest first
+		total := int64(len(p.workBuffer))
+		for i := len(numbers) - 1; 0 <= i && total < targetSize; i-- {
+			records, errRead := p.fileRecords(numbers[i])
+			if errRead != nil {
+				return nil, errRead
 			}
-			if int(bytesNeeded) <= len(crudeBuf)-int(startIndex) { //ok, got enough
-				resultPiece := crudeBuf[startIndex : startIndex+bytesNeeded]
-				if len(resultPiece) != int(bytesNeeded) {
-					return 0, fmt.Errorf("INTERNAL ERR!!! vääräpalakoko %v vs %v", len(resultPiece), int(bytesNeeded))
-				}
-				nCopied := copy(arr[0:], resultPiece)
-				if nCopied != int(bytesNeeded) {
-					return 0, fmt.Errorf("Copied wrong number (%v) asked %v", nCopied, bytesNeeded)
-				}
-				if len(resultPiece) == 0 {
-					return 0, io.EOF
-				}
-				p.readPosition += int64(len(resultPiece) / int(p.conf.RecordSize))
-				return len(resultPiece), nil
+			parts = append(parts, records)
+			total += int64(len(records))
+		}
+		skip := total - targetSize
+		if skip < 0 {
+			skip = 0
+		}
+		result := make([]byte, 0, total-skip)
+		for i := len(parts) - 1; 0 <= i; i-- {
+			if int64(len(parts[i])) <= skip {
+				skip -= int64(len(parts[i]))
+				continue
 			}
+			result = append(result, parts[i][skip:]...)
+			skip = 0
 		}
+		return result, nil
+	})
+}
+
+//GetFirst returns up to nRecords first records. Only files having those records are read
+func (p *FileStorage) GetFirst(nRecords int64) ([]byte, error) {
+	if nRecords < 1 {
+		return nil, fmt.Errorf("wrong parameter nRecords=%v", nRecords)
 	}
-	//Append what is is work buffer
-	crudeBuf = append(crudeBuf, p.workBuffer...)
-	endIndex := startIndex + bytesNeeded
-	resultPiece := []byte{}
-	if int(endIndex) < len(crudeBuf) {
-		resultPiece = crudeBuf[startIndex:endIndex]
-	} else {
-		resultPiece = crudeBuf[startIndex:]
-	}
-	nCopied := copy(arr[0:len(resultPiece)], resultPiece)
-	if nCopied != len(resultPiece) {
-		return 0, fmt.Errorf("Copied wrong number of bytes %v asked %v", nCopied, len(resultPiece))
-	}
-	if len(resultPiece) == 0 {
-		return 0, io.EOF
-	}
-	p.readPosition += int64(len(resultPiece) / int(p.conf.RecordSize))
-	return len(resultPiece), nil
+	return reading(p, func() ([]byte, error) {
+		result, _, errRead := p.recordsFrom(0, nRecords)
+		return result, errRead
+	})
+}
+
+//ReadAll returns all records
+func (p *FileStorage) ReadAll() ([]byte, error) {
+	return reading(p, func() ([]byte, error) {
+		numbers, errNumbers := p.fileNumbers()
+		if errNumbers != nil {
+			return nil, errNumbers
+		}
+		result := []byte{}
+		for _, fileNumber := range numbers {
+			records, errRead := p.fileRecords(fileNumber)
+			if errRead != nil {
+				return result, errRead
+			}
+			result = append(result, records...)
+		}
+		return append(result, p.workBuffer...), nil
+	})
+}
+
+//Read implements Reader interface.  Except only array length must be multiple of recordsize for normal operation
+func (p *FileStorage) Read(arr []byte) (n int, err error) {
+	return p.cursor.readFrom(p, arr)
 }
 
 //Seeks, For implementing seeker interface
 //Seeks file with byte by byte but rounds up new position where record starts (or ends)
 func (p *FileStorage) Seek(offset int64, whence int) (int64, error) {
-	minFileNumber, maxFileNumber, filecount, errRange := p.conf.GetNumberRangeOnDisk()
-	if errRange != nil {
-		return 0, errRange
-	}
+	return p.cursor.readSeekFrom(p, offset, whence)
+}
 
-	maxPosition := int64(len(p.workBuffer))/p.conf.RecordSize + int64(maxFileNumber+1)*p.conf.recordsPerFile()
-	minPosition := int64(minFileNumber) * p.conf.recordsPerFile()
+//NewCursor creates independent reader at first record. Cursor refers to this FileStorage, do not copy FileStorage after that
+func (p *FileStorage) NewCursor() (*Cursor, error) {
+	return newCursor(p)
+}
 
-	if filecount == 0 {
-		minPosition = 0
-		maxPosition = int64(len(p.workBuffer)) / int64(p.conf.RecordSize)
-	}
+//RecordSize tells how long one record is in bytes
+func (p *FileStorage) RecordSize() int64 {
+	return p.conf.RecordSize
+}
 
-	switch whence {
-	case io.SeekStart: // seek relative to the origin of the file
-		p.readPosition = minPosition + offset/int64(p.conf.RecordSize)
-	case io.SeekCurrent: // seek relative to the current offset
-		p.readPosition += offset / int64(p.conf.RecordSize)
-	case io.SeekEnd: //seek relative to the end
-		p.readPosition = maxPosition + offset/int64(p.conf.RecordSize)
-	default:
-		return p.readPosition * int64(p.conf.RecordSize), fmt.Errorf("Whence %v unknow", whence)
-	}
-	//Set limits and report
-	if maxPosition < p.readPosition {
-		p.readPosition = maxPosition
-	}
-	if p.readPosition < minPosition {
-		p.readPosition = minPosition
+//positionRange gets first position and end position. Position is fileNumber*recordsPerFile+index
+func (p *FileStorage) positionRange() (int64, int64, error) {
+	end := int64(0)
+	first, errRange := reading(p, func() (int64, error) {
+		numbers, errNumbers := p.fileNumbers()
+		if errNumbers != nil {
+			return 0, errNumbers
+		}
+		end = int64(len(p.workBuffer)) / p.conf.RecordSize
+		if len(numbers) == 0 {
+			return 0, nil
+		}
+		rpf := p.conf.recordsPerFile()
+		end += (numbers[len(numbers)-1] + 1) * rpf
+		return numbers[0] * rpf, nil
+	})
+	return first, end, errRange
+}
+
+//readRecordsAt reads from position over files and work buffer. Missing files and records dropped from files are skipped
+func (p *FileStorage) readRecordsAt(position int64, maxRecords int64) ([]byte, int64, error) {
+	next := position
+	result, errRead := reading(p, func() ([]byte, error) {
+		var result []byte
+		var errRead error
+		result, next, errRead = p.recordsFrom(position, maxRecords)
+		return result, errRead
+	})
+	return result, next, errRead
+}
+
+//recordsFrom is readRecordsAt without locking. File having position is found directly, files before it are not read
+func (p *FileStorage) recordsFrom(position int64, maxRecords int64) ([]byte, int64, error) {
+	numbers, errNumbers := p.fileNumbers()
+	if errNumbers != nil {
+		return nil, position, errNumbers
+	}
+	workNumber := int64(0)
+	if 0 < len(numbers) {
+		workNumber = numbers[len(numbers)-1] + 1
+	}
+	rpf := p.conf.recordsPerFile()
+	segments := append(numbers, workNumber)
+	first := sort.Search(len(segments), func(i int) bool { //First segment that ends after position
+		return position < (segments[i]+1)*rpf
+	})
+	result := []byte{}
+	for _, fileNumber := range segments[first:] {
+		if maxRecords <= 0 {
+			break
+		}
+		start := fileNumber * rpf
+		if position < start { //Already dropped or missing
+			position = start
+		}
+		records := p.workBuffer
+		if fileNumber != workNumber {
+			var errRead error
+			records, errRead = p.fileRecords(fileNumber)
+			if errRead != nil {
+				return result, position, errRead
+			}
+		}
+		index := position - start
+		count := int64(len(records))/p.conf.RecordSize - index
+		if count <= 0 {
+			continue //Short file, rest of records are on next
+		}
+		if maxRecords < count {
+			count = maxRecords
+		}
+		result = append(result, records[index*p.conf.RecordSize:(index+count)*p.conf.RecordSize]...)
+		position += count
+		maxRecords -= count
 	}
-	return p.readPosition * int64(p.conf.RecordSize), nil
+	return result, position, nil
 }
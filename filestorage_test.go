@@ -193,6 +193,7 @@ func TestFileOnTMP(t *testing.T) {
 	assert.Equal(t, nil, flErr)
 
 	emptytest(t, &fl)
+	fl.Close()
 
 	//Reload from disk
 	flReloaded, flReloadedErr := cfg.InitFileStorage()
@@ -204,6 +205,7 @@ func TestFileOnTMP(t *testing.T) {
 		t.Error(errFinalCount)
 	}
 	assert.Equal(t, int64(69), finalCount)
+	flReloaded.Close()
 	/*
 		Lets try with non matching file
 	*/
@@ -252,11 +254,11 @@ func TestGz(t *testing.T) {
 	testcontent := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
 	pattern := []int{8, 8}
 
-	n, errWrite := writeWithFsyncCowCompressed("/tmp/compressTest", testcontent, COMPRESSIONMETHOD_GZ, pattern)
+	n, errWrite := writeWithFsyncCowCompressed("/tmp/compressTest", testcontent, COMPRESSIONMETHOD_GZ, 0, fieldCoding{bitSlices: pattern})
 	assert.Equal(t, nil, errWrite)
 	assert.Equal(t, n, len(testcontent))
 
-	contentBack, errContent := readCompressedFile("/tmp/compressTest", COMPRESSIONMETHOD_GZ, pattern)
+	contentBack, errContent := readCompressedFile("/tmp/compressTest", COMPRESSIONMETHOD_GZ, fieldCoding{bitSlices: pattern})
 	assert.Equal(t, nil, errContent)
 	assert.EqualValues(t, testcontent, contentBack)
 
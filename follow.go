@@ -0,0 +1,177 @@
+/*
+Follow streams records as those are written, consumers do not have to poll Len.
+Writes on same process wake followers right away. Read only FileStorage also watches work file,
+so records written by other process are noticed
+*/
+package fixregsto
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//FOLLOWBATCHRECORDS is how many records follower reads at once
+const FOLLOWBATCHRECORDS = 64
+
+//Follower is storage that can stream new records
+type Follower interface {
+	//Follow starts from offset (bytes, like on Seek) and delivers existing and then new records until ctx is done
+	Follow(ctx context.Context, offset int64, whence int) (*Subscription, error)
+}
+
+//Subscription is running Follow
+type Subscription struct {
+	C <-chan []byte //One record per element. Closed when context is done or reading fails
+
+	mu  sync.Mutex
+	err error
+}
+
+//Err tells why C was closed. Nil while subscription is running
+func (p *Subscription) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *Subscription) finish(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+}
+
+//changeNotifier wakes everyone waiting when storage is written
+type changeNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{ch: make(chan struct{})}
+}
+
+//changed returns channel that is closed on next notify
+func (p *changeNotifier) changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ch
+}
+
+func (p *changeNotifier) notify() {
+	p.mu.Lock()
+	close(p.ch)
+	p.ch = make(chan struct{})
+	p.mu.Unlock()
+}
+
+//follow runs subscription on own cursor. If poll is set, it is called on every pollInterval and returns true when there might be new records
+func follow(ctx context.Context, src cursorSource, notifier *changeNotifier, offset int64, whence int, pollInterval time.Duration, poll func() bool) (*Subscription, error) {
+	cursor, errCursor := newCursor(src)
+	if errCursor != nil {
+		return nil, errCursor
+	}
+	if _, errSeek := cursor.Seek(offset, whence); errSeek != nil {
+		return nil, errSeek
+	}
+	out := make(chan []byte)
+	result := Subscription{C: out}
+
+	go func() {
+		defer close(out)
+		var tick <-chan time.Time
+		if poll != nil {
+			ticker := time.NewTicker(pollInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		recordSize := src.RecordSize()
+		buf := make([]byte, FOLLOWBATCHRECORDS*recordSize)
+		for {
+			changed := notifier.changed() //Before read, so write between read and wait is not missed
+			n, errRead := cursor.Read(buf)
+			if errRead != nil && errRead != io.EOF {
+				result.finish(errRead)
+				return
+			}
+			for i := int64(0); i < int64(n); i += recordSize {
+				select {
+				case out <- append([]byte{}, buf[i:i+recordSize]...):
+				case <-ctx.Done():
+					result.finish(ctx.Err())
+					return
+				}
+			}
+			if 0 < n {
+				continue
+			}
+			waiting := true
+			for waiting {
+				select {
+				case <-ctx.Done():
+					result.finish(ctx.Err())
+					return
+				case <-changed:
+					waiting = false
+				case <-tick:
+					waiting = !poll()
+				}
+			}
+		}
+	}()
+	return &result, nil
+}
+
+/*
+FileStorage
+*/
+
+//DEFAULTFOLLOWPOLL is used when FollowPollInterval is not set
+const DEFAULTFOLLOWPOLL = 250 * time.Millisecond
+
+//Follow delivers records from offset and then new records as those are written.
+//Read only storage checks work file on FollowPollInterval for records written by other process.
+//Subscription refers to this FileStorage, do not copy FileStorage after that
+func (p *FileStorage) Follow(ctx context.Context, offset int64, whence int) (*Subscription, error) {
+	if !p.conf.ReadOnly { //Only this process can write, lock prevents others
+		return follow(ctx, p, p.changes, offset, whence, 0, nil)
+	}
+	interval := p.conf.FollowPollInterval
+	if interval <= 0 {
+		interval = DEFAULTFOLLOWPOLL
+	}
+	previous, _ := p.conf.workFileStamp()
+	return follow(ctx, p, p.changes, offset, whence, interval, func() bool {
+		stamp, errStamp := p.conf.workFileStamp()
+		if errStamp != nil || stamp == previous {
+			return false
+		}
+		previous = stamp
+		return true
+	})
+}
+
+//workFileStamp changes on every write. Work file is rewritten (copy on write) or recreated after sealing
+func (p *FileStorageConf) workFileStamp() (string, error) {
+	fInfo, errStat := os.Stat(p.BaseFileName())
+	if os.IsNotExist(errStat) {
+		return "", nil
+	}
+	if errStat != nil {
+		return "", errStat
+	}
+	return fmt.Sprintf("%v/%v", fInfo.ModTime().UnixNano(), fInfo.Size()), nil
+}
+
+/*
+Memloop
+*/
+
+//Follow delivers records from offset and then new records as those are written.
+//Subscription refers to this Memloop, do not copy Memloop after that
+func (p *Memloop) Follow(ctx context.Context, offset int64, whence int) (*Subscription, error) {
+	return follow(ctx, p, p.changes, offset, whence, 0, nil)
+}
@@ -0,0 +1,95 @@
+package fixregsto
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func counterRecord(i int) []byte {
+	result := make([]byte, 8)
+	binary.LittleEndian.PutUint64(result, uint64(i))
+	return result
+}
+
+//followTest writes records while subscription started from end receives them
+func followTest(t *testing.T, writer FixRegSto, follower Follower, total int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, errFollow := follower.Follow(ctx, 0, io.SeekEnd)
+	assert.Equal(t, nil, errFollow)
+
+	go func() {
+		for i := 0; i < total; i++ {
+			_, errWrite := writer.Write(counterRecord(i))
+			assert.Equal(t, nil, errWrite)
+		}
+	}()
+
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < total; i++ {
+		select {
+		case record := <-sub.C:
+			assert.Equal(t, counterRecord(i), record)
+		case <-timeout:
+			t.Fatalf("timeout waiting record %v", i)
+		}
+	}
+	assert.Equal(t, nil, sub.Err())
+	cancel()
+	for range sub.C { //Drains until closed
+	}
+	assert.Equal(t, context.Canceled, sub.Err())
+}
+
+func TestMemloopFollow(t *testing.T) {
+	cfg := MemloopConf{RecordSize: 8, MaxRecords: 1000}
+	mem, _ := cfg.InitMemLoop()
+	_, errWrite := mem.Write(counterRecord(99)) //Before start, not delivered
+	assert.Equal(t, nil, errWrite)
+	followTest(t, &mem, &mem, 200)
+}
+
+func TestFileStorageFollow(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "follow",
+		RecordSize:   8,
+		MaxFileCount: 100,
+		FileMaxSize:  64,
+		Path:         TMPTESTDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	followTest(t, &fl, &fl, 100)
+
+	//Other process writes. Read only storage notices from work file
+	roCfg := cfg
+	roCfg.ReadOnly = true
+	roCfg.FollowPollInterval = time.Millisecond
+	ro, roErr := roCfg.InitFileStorage()
+	assert.Equal(t, nil, roErr)
+	followTest(t, &fl, &ro, 100)
+	assert.Equal(t, nil, fl.Close())
+}
+
+func TestEepromFollowFromStart(t *testing.T) {
+	dev := NewMemEeprom(1024, 16, 1000000)
+	cfg := EepromStorageConf{RecordSize: 8}
+	sto, _ := cfg.InitEepromStorage(dev)
+	for i := 0; i < 3; i++ {
+		sto.Write(counterRecord(i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, errFollow := sto.Follow(ctx, 0, io.SeekStart)
+	assert.Equal(t, nil, errFollow)
+	go sto.Write(counterRecord(3))
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, counterRecord(i), <-sub.C)
+	}
+}
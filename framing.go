@@ -0,0 +1,345 @@
+/*
+Framed file format.
+Header tells how file is encoded and CRC32 is calculated over each block of records.
+Tools can open framed file without knowing FileStorageConf
+
+	magic "FXRS", version uint8
+	recordSize, recordCount, crcBlockRecords uint32
+	compression method length uint8 + method
+	bitslice count uint16 + uint16 per slice
+	version 2: per slice flags uint8 (bit 0 big endian) + transform length uint8 + transform
+	crc32 per block, uint32 each
+	crc32 of header
+	payload (records sliced and compressed as header says)
+
+All integers are little endian
+*/
+package fixregsto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	FRAMEDMAGIC   = "FXRS"
+	FRAMEDVERSION = 2
+
+	FRAMEDVERSIONNOTRANSFORMS = 1 //Written when fields are not transformed, so older readers can open file
+
+	framedCrcChunk = 1024 //Block crcs are read in chunks of this many
+)
+
+//FileHeader is header of framed file
+type FileHeader struct {
+	Version           int
+	RecordSize        int64
+	RecordCount       int64
+	CrcBlockRecords   int64 //How many records one crc covers
+	CompressionMethod string
+	BitSlices         []int
+	Transforms        []string //Per bit slice, since version 2
+	BigEndian         []bool   //Per bit slice, byte order of transformed field. Since version 2
+	Crcs              []uint32 //One per block, calculated from records before slicing and compression
+}
+
+//CorruptedError is returned when framed file have records that do not match their CRC.
+//Records that are ok are returned with this error
+type CorruptedError struct {
+	Filename string
+	Records  []int64 //Index of corrupted records in file
+	Whole    bool    //Header or payload is not decodable, no records available
+	Reason   string
+}
+
+func (e *CorruptedError) Error() string {
+	if e.Whole {
+		return fmt.Sprintf("corrupted file %v: %v", e.Filename, e.Reason)
+	}
+	return fmt.Sprintf("corrupted file %v: %v records failed crc", e.Filename, len(e.Records))
+}
+
+func (p *FileHeader) blockCount() int64 {
+	if p.RecordCount == 0 {
+		return 0
+	}
+	return (p.RecordCount + p.CrcBlockRecords - 1) / p.CrcBlockRecords
+}
+
+//blockCrcs calculates crc for each block of records
+func blockCrcs(records []byte, recordSize int64, crcBlockRecords int64) []uint32 {
+	blockBytes := recordSize * crcBlockRecords
+	result := make([]uint32, 0, (int64(len(records))+blockBytes-1)/blockBytes)
+	for start := int64(0); start < int64(len(records)); start += blockBytes {
+		end := start + blockBytes
+		if int64(len(records)) < end {
+			end = int64(len(records))
+		}
+		result = append(result, crc32.ChecksumIEEE(records[start:end]))
+	}
+	return result
+}
+
+//Encode header to bytes, with header crc at end
+func (p *FileHeader) Encode() ([]byte, error) {
+	if 255 < len(p.CompressionMethod) {
+		return nil, fmt.Errorf("compression method name too long %v", p.CompressionMethod)
+	}
+	if int64(len(p.Crcs)) != p.blockCount() {
+		return nil, fmt.Errorf("header have %v crcs, expected %v", len(p.Crcs), p.blockCount())
+	}
+	var buf bytes.Buffer
+	buf.WriteString(FRAMEDMAGIC)
+	buf.WriteByte(byte(p.Version))
+	binary.Write(&buf, binary.LittleEndian, uint32(p.RecordSize))
+	binary.Write(&buf, binary.LittleEndian, uint32(p.RecordCount))
+	binary.Write(&buf, binary.LittleEndian, uint32(p.CrcBlockRecords))
+	buf.WriteByte(byte(len(p.CompressionMethod)))
+	buf.WriteString(p.CompressionMethod)
+	binary.Write(&buf, binary.LittleEndian, uint16(len(p.BitSlices)))
+	for _, slice := range p.BitSlices {
+		binary.Write(&buf, binary.LittleEndian, uint16(slice))
+	}
+	if 2 <= p.Version {
+		coding := p.coding()
+		for i := range p.BitSlices {
+			transform := ""
+			if i < len(p.Transforms) {
+				transform = p.Transforms[i]
+			}
+			if 255 < len(transform) {
+				return nil, fmt.Errorf("transform too long %v", transform)
+			}
+			flags := byte(0)
+			if coding.isBigEndian(i) {
+				flags |= 1
+			}
+			buf.WriteByte(flags)
+			buf.WriteByte(byte(len(transform)))
+			buf.WriteString(transform)
+		}
+	}
+	binary.Write(&buf, binary.LittleEndian, p.Crcs)
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+//crcReader keeps crc and count of all bytes read trough it
+type crcReader struct {
+	r     io.Reader
+	crc   uint32
+	count int64
+}
+
+func (p *crcReader) Read(arr []byte) (int, error) {
+	n, err := p.r.Read(arr)
+	p.crc = crc32.Update(p.crc, crc32.IEEETable, arr[0:n])
+	p.count += int64(n)
+	return n, err
+}
+
+//coding tells how payload records are coded
+func (p *FileHeader) coding() fieldCoding {
+	return fieldCoding{bitSlices: p.BitSlices, transforms: p.Transforms, bigEndian: p.BigEndian}
+}
+
+//DecodeFileHeader reads header from start of framed file. Returns also header length in bytes
+func DecodeFileHeader(r io.Reader) (FileHeader, int64, error) {
+	result := FileHeader{}
+	cr := crcReader{r: r}
+	fixedPart := struct {
+		Magic           [4]byte
+		Version         uint8
+		RecordSize      uint32
+		RecordCount     uint32
+		CrcBlockRecords uint32
+		MethodLen       uint8
+	}{}
+	if errRead := binary.Read(&cr, binary.LittleEndian, &fixedPart); errRead != nil {
+		return result, 0, errRead
+	}
+	if string(fixedPart.Magic[:]) != FRAMEDMAGIC {
+		return result, 0, fmt.Errorf("not framed file, magic %#v", fixedPart.Magic)
+	}
+	if fixedPart.Version < 1 || FRAMEDVERSION < fixedPart.Version {
+		return result, 0, fmt.Errorf("unsupported framed file version %v", fixedPart.Version)
+	}
+	result.Version = int(fixedPart.Version)
+	result.RecordSize = int64(fixedPart.RecordSize)
+	result.RecordCount = int64(fixedPart.RecordCount)
+	result.CrcBlockRecords = int64(fixedPart.CrcBlockRecords)
+	if result.RecordSize < 1 || result.CrcBlockRecords < 1 {
+		return result, 0, fmt.Errorf("invalid header recordSize=%v crcBlockRecords=%v", result.RecordSize, result.CrcBlockRecords)
+	}
+	method := make([]byte, fixedPart.MethodLen)
+	if _, errRead := io.ReadFull(&cr, method); errRead != nil {
+		return result, 0, errRead
+	}
+	result.CompressionMethod = string(method)
+
+	var sliceCount uint16
+	if errRead := binary.Read(&cr, binary.LittleEndian, &sliceCount); errRead != nil {
+		return result, 0, errRead
+	}
+	slices := make([]uint16, sliceCount)
+	if errRead := binary.Read(&cr, binary.LittleEndian, slices); errRead != nil {
+		return result, 0, errRead
+	}
+	result.BitSlices = make([]int, sliceCount)
+	for i, slice := range slices {
+		result.BitSlices[i] = int(slice)
+	}
+	if 2 <= result.Version {
+		result.Transforms = make([]string, sliceCount)
+		result.BigEndian = make([]bool, sliceCount)
+		for i := range slices {
+			var flagsAndLen [2]byte
+			if _, errRead := io.ReadFull(&cr, flagsAndLen[:]); errRead != nil {
+				return result, 0, errRead
+			}
+			transform := make([]byte, flagsAndLen[1])
+			if _, errRead := io.ReadFull(&cr, transform); errRead != nil {
+				return result, 0, errRead
+			}
+			result.BigEndian[i] = flagsAndLen[0]&1 == 1
+			result.Transforms[i] = string(transform)
+		}
+	}
+
+	//Header crc is after block crcs. Read those in chunks, so corrupted record count fails on end of content instead of huge allocation
+	blocks := result.blockCount()
+	result.Crcs = []uint32{}
+	for int64(len(result.Crcs)) < blocks {
+		chunk := make([]uint32, framedCrcChunk)
+		if remaining := blocks - int64(len(result.Crcs)); remaining < framedCrcChunk {
+			chunk = chunk[:remaining]
+		}
+		if errRead := binary.Read(&cr, binary.LittleEndian, chunk); errRead != nil {
+			return result, 0, errRead
+		}
+		result.Crcs = append(result.Crcs, chunk...)
+	}
+	calculated := cr.crc
+	var headerCrc uint32
+	if errRead := binary.Read(r, binary.LittleEndian, &headerCrc); errRead != nil {
+		return result, 0, errRead
+	}
+	if calculated != headerCrc {
+		return result, 0, fmt.Errorf("header crc mismatch %08X vs %08X", calculated, headerCrc)
+	}
+	return result, cr.count + 4, nil
+}
+
+//encodeFramed creates complete framed file content from records
+func encodeFramed(records []byte, recordSize int64, method string, level int, coding fieldCoding, crcBlockRecords int64) ([]byte, error) {
+	if crcBlockRecords < 1 {
+		crcBlockRecords = 1
+	}
+	if int64(len(records))%recordSize != 0 {
+		return nil, fmt.Errorf("got %v bytes, must be multiple of record size %v", len(records), recordSize)
+	}
+	header := FileHeader{
+		Version:           FRAMEDVERSIONNOTRANSFORMS,
+		RecordSize:        recordSize,
+		RecordCount:       int64(len(records)) / recordSize,
+		CrcBlockRecords:   crcBlockRecords,
+		CompressionMethod: method,
+		BitSlices:         coding.bitSlices,
+		Crcs:              blockCrcs(records, recordSize, crcBlockRecords),
+	}
+	if coding.hasTransforms() {
+		header.Version = FRAMEDVERSION
+		header.Transforms = coding.transforms
+		header.BigEndian = coding.bigEndian
+	}
+	headerBytes, errHeader := header.Encode()
+	if errHeader != nil {
+		return nil, errHeader
+	}
+	sliced, errSlice := coding.encode(records)
+	if errSlice != nil {
+		return nil, errSlice
+	}
+	payload, errCompress := compressBytes(sliced, method, level)
+	if errCompress != nil {
+		return nil, errCompress
+	}
+	return append(headerBytes, payload...), nil
+}
+
+//decodeFramed returns records from framed file content. Records with crc mismatch are dropped and reported with CorruptedError
+func decodeFramed(content []byte) (FileHeader, []byte, error) {
+	header, headerLen, errHeader := DecodeFileHeader(bytes.NewReader(content))
+	if errHeader != nil {
+		return header, nil, &CorruptedError{Whole: true, Reason: errHeader.Error()}
+	}
+	payload, errDecompress := decompressBytes(content[headerLen:], header.CompressionMethod)
+	if errDecompress != nil {
+		return header, nil, &CorruptedError{Whole: true, Reason: errDecompress.Error()}
+	}
+	coding := header.coding()
+	records, errUnslice := coding.decode(payload)
+	if errUnslice != nil {
+		return header, nil, &CorruptedError{Whole: true, Reason: errUnslice.Error()}
+	}
+	if int64(len(records)) != header.RecordCount*header.RecordSize {
+		return header, nil, &CorruptedError{Whole: true, Reason: fmt.Sprintf("payload is %v bytes, header tells %v records of %v bytes", len(records), header.RecordCount, header.RecordSize)}
+	}
+
+	crcs := blockCrcs(records, header.RecordSize, header.CrcBlockRecords)
+	blockBytes := header.RecordSize * header.CrcBlockRecords
+	result := make([]byte, 0, len(records))
+	corrupted := []int64{}
+	for i, crc := range crcs {
+		start := int64(i) * blockBytes
+		end := start + blockBytes
+		if int64(len(records)) < end {
+			end = int64(len(records))
+		}
+		if crc == header.Crcs[i] {
+			result = append(result, records[start:end]...)
+			continue
+		}
+		for recordIndex := start / header.RecordSize; recordIndex < end/header.RecordSize; recordIndex++ {
+			corrupted = append(corrupted, recordIndex)
+		}
+	}
+	if 0 < len(corrupted) {
+		return header, result, &CorruptedError{Records: corrupted}
+	}
+	return header, result, nil
+}
+
+//isFramed tells does content start like framed file
+func isFramed(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(FRAMEDMAGIC))
+}
+
+//ReadFramedFile reads framed file without knowing configuration. Corrupted records are reported with *CorruptedError
+func ReadFramedFile(filename string) (FileHeader, []byte, error) {
+	content, errRead := os.ReadFile(filename)
+	if errRead != nil {
+		return FileHeader{}, nil, errRead
+	}
+	header, records, errDecode := decodeFramed(content)
+	if corruptErr, isCorrupt := errDecode.(*CorruptedError); isCorrupt {
+		corruptErr.Filename = filename
+	}
+	return header, records, errDecode
+}
+
+//readFramedFileHeader reads only header of framed file
+func readFramedFileHeader(filename string) (FileHeader, error) {
+	f, errOpen := os.Open(filename)
+	if errOpen != nil {
+		return FileHeader{}, errOpen
+	}
+	defer f.Close()
+	header, _, errHeader := DecodeFileHeader(bufio.NewReader(f))
+	return header, errHeader
+}
@@ -0,0 +1,116 @@
+package fixregsto
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFramedFileOnTMP(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "framedTest",
+		RecordSize:        8,
+		MaxFileCount:      4,
+		FileMaxSize:       128,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		BitSlices:         []int{8, 8, 8, 8, 8, 8, 8, 8},
+		Framed:            true,
+		CrcBlockRecords:   4,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	emptytest(t, &fl)
+	assert.Equal(t, nil, fl.Close())
+
+	flReloaded, flReloadedErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flReloadedErr)
+	finalCount, errFinalCount := flReloaded.Len()
+	assert.Equal(t, nil, errFinalCount)
+	assert.Equal(t, int64(69), finalCount)
+
+	//Header tells everything needed for reading
+	_, maxFileNumber, _, errRange := cfg.GetNumberRangeOnDisk()
+	assert.Equal(t, nil, errRange)
+	header, records, errRead := ReadFramedFile(cfg.filename(maxFileNumber))
+	assert.Equal(t, nil, errRead)
+	assert.Equal(t, int64(8), header.RecordSize)
+	assert.Equal(t, int64(16), header.RecordCount)
+	assert.Equal(t, COMPRESSIONMETHOD_GZ, header.CompressionMethod)
+	assert.Equal(t, cfg.BitSlices, header.BitSlices)
+	assert.Equal(t, 128, len(records))
+}
+
+func TestFramedCorruption(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "framedCorrupt",
+		RecordSize:   4,
+		MaxFileCount: 4,
+		FileMaxSize:  16,
+		Path:         TMPTESTDIR,
+		Framed:       true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, errWrite := fl.Write([]byte{1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5})
+	assert.Equal(t, nil, errWrite)
+
+	//Flip bit in second record of sealed file
+	content, errContent := os.ReadFile(cfg.filename(0))
+	assert.Equal(t, nil, errContent)
+	content[len(content)-16+4] ^= 0x10
+	assert.Equal(t, nil, os.WriteFile(cfg.filename(0), content, 0755))
+
+	_, errAll := fl.ReadAll()
+	var corruptErr *CorruptedError
+	assert.True(t, errors.As(errAll, &corruptErr))
+	assert.Equal(t, []int64{1}, corruptErr.Records)
+	assert.Equal(t, cfg.filename(0), corruptErr.Filename)
+
+	good, errGood := cfg.ReadFileWithNumber(0)
+	assert.True(t, errors.As(errGood, &corruptErr))
+	assert.Equal(t, []byte{1, 1, 1, 1, 3, 3, 3, 3, 4, 4, 4, 4}, good)
+
+	cfg.SkipCorrupted = true
+	assert.Equal(t, nil, fl.Close())
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	all, errAll := fl.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, []byte{1, 1, 1, 1, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5}, all)
+
+	latest, errLatest := fl.GetLatest(2)
+	assert.Equal(t, nil, errLatest)
+	assert.Equal(t, []byte{4, 4, 4, 4, 5, 5, 5, 5}, latest)
+
+	//Broken header makes whole file unreadable
+	content[0] = 'X'
+	assert.Equal(t, nil, os.WriteFile(cfg.filename(0)+"_copy", content, 0755))
+	_, _, errHeader := ReadFramedFile(cfg.filename(0) + "_copy")
+	assert.True(t, errors.As(errHeader, &corruptErr))
+	assert.True(t, corruptErr.Whole)
+}
+
+func TestFramedHeaderHugeRecordCount(t *testing.T) {
+	content, errEncode := encodeFramed(make([]byte, 64), 8, "", 0, fieldCoding{}, 1)
+	assert.Equal(t, nil, errEncode)
+	copy(content[9:], []byte{0xFF, 0xFF, 0xFF, 0xFF}) //Record count after magic, version and record size
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, errHeader := DecodeFileHeader(bytes.NewReader(content))
+	runtime.ReadMemStats(&after)
+	assert.NotEqual(t, nil, errHeader)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	_, _, errDecode := decodeFramed(content)
+	var corruptErr *CorruptedError
+	assert.True(t, errors.As(errDecode, &corruptErr))
+	assert.True(t, corruptErr.Whole)
+}
@@ -2,7 +2,10 @@ module github.com/hjkoskel/fixregsto
 
 go 1.18
 
-require github.com/stretchr/testify v1.8.0
+require (
+	github.com/klauspost/compress v1.15.9
+	github.com/stretchr/testify v1.8.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
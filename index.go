@@ -0,0 +1,300 @@
+/*
+Sidecar index file for FileStorage. Tells for each numbered file record count, first and last key and checksum.
+Len and key queries are answered from index without opening data files.
+Index is written with same copy on write + fsync as data files. If index is lost or does not match
+files on disk, it is rebuilt from data files
+
+	magic "FXRI", version uint8, entry count uint32
+	entry: fileNumber int64, recordCount uint32, firstKey uint64, lastKey uint64, storedSize int64, checksum uint32
+	crc32 of all before
+
+All integers are little endian
+*/
+package fixregsto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+const (
+	INDEXMAGIC   = "FXRI"
+	INDEXVERSION = 1
+)
+
+//IndexEntry describes one numbered storage file
+type IndexEntry struct {
+	FileNumber  int64
+	RecordCount int64
+	FirstKey    uint64 //Zero if Key is not configured
+	LastKey     uint64
+	StoredSize  int64  //File size on disk
+	Checksum    uint32 //CRC32 of file as stored on disk
+}
+
+//indexState is shared between copies of FileStorage, background recompression updates it. Protected by FileStorage mu
+type indexState struct {
+	entries []IndexEntry
+}
+
+type indexEntryOnDisk struct {
+	FileNumber  int64
+	RecordCount uint32
+	FirstKey    uint64
+	LastKey     uint64
+	StoredSize  int64
+	Checksum    uint32
+}
+
+func (p *FileStorageConf) indexFileName() string {
+	return p.BaseFileName() + ".idx"
+}
+
+func encodeIndex(entries []IndexEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(INDEXMAGIC)
+	buf.WriteByte(INDEXVERSION)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(entries)))
+	for _, entry := range entries {
+		binary.Write(&buf, binary.LittleEndian, indexEntryOnDisk{
+			FileNumber:  entry.FileNumber,
+			RecordCount: uint32(entry.RecordCount),
+			FirstKey:    entry.FirstKey,
+			LastKey:     entry.LastKey,
+			StoredSize:  entry.StoredSize,
+			Checksum:    entry.Checksum,
+		})
+	}
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func decodeIndex(content []byte) ([]IndexEntry, error) {
+	if len(content) < 4+1+4+4 || string(content[0:4]) != INDEXMAGIC {
+		return nil, fmt.Errorf("not index file")
+	}
+	if content[4] != INDEXVERSION {
+		return nil, fmt.Errorf("unsupported index version %v", content[4])
+	}
+	body := content[0 : len(content)-4]
+	if binary.LittleEndian.Uint32(content[len(content)-4:]) != crc32.ChecksumIEEE(body) {
+		return nil, fmt.Errorf("index crc mismatch")
+	}
+	count := binary.LittleEndian.Uint32(body[5:9])
+	onDisk := make([]indexEntryOnDisk, count)
+	if errRead := binary.Read(bytes.NewReader(body[9:]), binary.LittleEndian, onDisk); errRead != nil {
+		return nil, fmt.Errorf("index is truncated err=%v", errRead)
+	}
+	result := make([]IndexEntry, count)
+	for i, entry := range onDisk {
+		result[i] = IndexEntry{
+			FileNumber:  entry.FileNumber,
+			RecordCount: int64(entry.RecordCount),
+			FirstKey:    entry.FirstKey,
+			LastKey:     entry.LastKey,
+			StoredSize:  entry.StoredSize,
+			Checksum:    entry.Checksum,
+		}
+	}
+	return result, nil
+}
+
+//indexEntryForRecords creates entry for file that is on disk and have records
+func (p *FileStorageConf) indexEntryForRecords(fileNumber int64, records []byte) (IndexEntry, error) {
+	stored, errRead := os.ReadFile(p.filename(fileNumber))
+	if errRead != nil {
+		return IndexEntry{}, errRead
+	}
+	result := IndexEntry{
+		FileNumber:  fileNumber,
+		RecordCount: int64(len(records)) / p.RecordSize,
+		StoredSize:  int64(len(stored)),
+		Checksum:    crc32.ChecksumIEEE(stored),
+	}
+	if p.Key.Width != 0 && 0 < result.RecordCount {
+		result.FirstKey = p.Key.Key(records)
+		result.LastKey = p.Key.Key(records[(result.RecordCount-1)*p.RecordSize:])
+	}
+	return result, nil
+}
+
+//RebuildIndex reads all numbered files and writes new index
+func (p *FileStorageConf) RebuildIndex() ([]IndexEntry, error) {
+	numbers, errNumbers := p.existingFileNumbers()
+	if errNumbers != nil {
+		return nil, errNumbers
+	}
+	result := make([]IndexEntry, 0, len(numbers))
+	for _, fileNumber := range numbers {
+		records, errRecords := p.ReadFileWithNumber(fileNumber) //Corrupted records are not counted
+		var corruptErr *CorruptedError
+		if errRecords != nil && !errors.As(errRecords, &corruptErr) {
+			return nil, errRecords
+		}
+		entry, errEntry := p.indexEntryForRecords(fileNumber, records)
+		if errEntry != nil {
+			return nil, errEntry
+		}
+		result = append(result, entry)
+	}
+	_, errWrite := writeWithFsyncCow(p.indexFileName(), encodeIndex(result))
+	return result, errWrite
+}
+
+//loadIndex reads index and checks that it matches files on disk. Rebuilds if there is mismatch
+func (p *FileStorageConf) loadIndex() ([]IndexEntry, error) {
+	content, errRead := os.ReadFile(p.indexFileName())
+	if errRead != nil {
+		return p.RebuildIndex()
+	}
+	entries, errDecode := decodeIndex(content)
+	if errDecode != nil {
+		return p.RebuildIndex()
+	}
+	sizemap, errListFileSizes := listFileSizes(p.Path, p.Name)
+	if errListFileSizes != nil {
+		return nil, errListFileSizes
+	}
+	numbers, errNumbers := p.existingFileNumbers()
+	if errNumbers != nil {
+		return nil, errNumbers
+	}
+	if len(numbers) != len(entries) {
+		return p.RebuildIndex()
+	}
+	for i, entry := range entries {
+		size, haz := sizemap[fmt.Sprintf("%s_%v", p.Name, entry.FileNumber)]
+		if !haz || entry.FileNumber != numbers[i] || int64(size) != entry.StoredSize {
+			return p.RebuildIndex()
+		}
+	}
+	return entries, nil
+}
+
+//updateIndex adds entry for new sealed file and drops removed file (-1 none)
+func (p *FileStorage) updateIndex(newFileNumber int64, records []byte, removedFileNumber int64) error {
+	if !p.conf.Indexed {
+		return nil
+	}
+	entry, errEntry := p.conf.indexEntryForRecords(newFileNumber, records)
+	if errEntry != nil {
+		return errEntry
+	}
+	entries := make([]IndexEntry, 0, len(p.index.entries)+1)
+	for _, old := range p.index.entries {
+		if old.FileNumber != removedFileNumber && old.FileNumber != newFileNumber {
+			entries = append(entries, old)
+		}
+	}
+	entries = append(entries, entry)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].FileNumber < entries[j].FileNumber })
+	_, errWrite := writeWithFsyncCow(p.conf.indexFileName(), encodeIndex(entries))
+	if errWrite != nil {
+		return errWrite
+	}
+	p.index.entries = entries
+	return nil
+}
+
+//replaceIndexEntry updates entry of file that was rewritten with same records, like recompressed
+func (p *FileStorage) replaceIndexEntry(fileNumber int64, records []byte) error {
+	if !p.conf.Indexed {
+		return nil
+	}
+	entry, errEntry := p.conf.indexEntryForRecords(fileNumber, records)
+	if errEntry != nil {
+		return errEntry
+	}
+	entries := append([]IndexEntry{}, p.index.entries...)
+	for i := range entries {
+		if entries[i].FileNumber == fileNumber {
+			entries[i] = entry
+		}
+	}
+	_, errWrite := writeWithFsyncCow(p.conf.indexFileName(), encodeIndex(entries))
+	if errWrite != nil {
+		return errWrite
+	}
+	p.index.entries = entries
+	return nil
+}
+
+//dropIndexEntries removes entries of removed files
+func (p *FileStorage) dropIndexEntries(removed map[int64]bool) error {
+	if !p.conf.Indexed || len(removed) == 0 {
+		return nil
+	}
+	entries := make([]IndexEntry, 0, len(p.index.entries))
+	for _, old := range p.index.entries {
+		if !removed[old.FileNumber] {
+			entries = append(entries, old)
+		}
+	}
+	_, errWrite := writeWithFsyncCow(p.conf.indexFileName(), encodeIndex(entries))
+	if errWrite != nil {
+		return errWrite
+	}
+	p.index.entries = entries
+	return nil
+}
+
+//Index returns copy of index entries. Nil if storage is not indexed
+func (p *FileStorage) Index() []IndexEntry {
+	if !p.conf.Indexed {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]IndexEntry{}, p.index.entries...)
+}
+
+//VerifyIndex checks numbered files against checksums on index. Returns error listing mismatching files
+func (p *FileStorage) VerifyIndex() error {
+	if !p.conf.Indexed {
+		return fmt.Errorf("storage is not indexed")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return ErrClosed
+	}
+	mismatch := []int64{}
+	for _, entry := range p.index.entries {
+		stored, errRead := os.ReadFile(p.conf.filename(entry.FileNumber))
+		if errRead != nil || crc32.ChecksumIEEE(stored) != entry.Checksum {
+			mismatch = append(mismatch, entry.FileNumber)
+		}
+	}
+	if 0 < len(mismatch) {
+		return fmt.Errorf("files %v do not match index", mismatch)
+	}
+	return nil
+}
+
+//findKeyPositionIndexed is findKeyPosition using index. Reads at most one data file
+func (p *FileStorage) findKeyPositionIndexed(key uint64) (int64, error) {
+	rpf := p.conf.recordsPerFile()
+	workNumber := int64(0)
+	if 0 < len(p.index.entries) {
+		workNumber = p.index.entries[len(p.index.entries)-1].FileNumber + 1
+	}
+	i := sort.Search(len(p.index.entries), func(i int) bool {
+		return p.index.entries[i].RecordCount == 0 || key <= p.index.entries[i].FirstKey
+	})
+	if 0 < i && key <= p.index.entries[i-1].LastKey {
+		records, errRead := p.fileRecords(p.index.entries[i-1].FileNumber)
+		if errRead != nil {
+			return 0, errRead
+		}
+		return p.index.entries[i-1].FileNumber*rpf + p.conf.Key.searchRecords(records, p.conf.RecordSize, key), nil
+	}
+	if i < len(p.index.entries) {
+		return p.index.entries[i].FileNumber * rpf, nil
+	}
+	return workNumber*rpf + p.conf.Key.searchRecords(p.workBuffer, p.conf.RecordSize, key), nil
+}
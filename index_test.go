@@ -0,0 +1,67 @@
+package fixregsto
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "indexTest",
+		RecordSize:        8,
+		MaxFileCount:      4,
+		FileMaxSize:       8 * 16,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		Key:               KeyExtractor{Offset: 2, Width: 4, BigEndian: true},
+		Indexed:           true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, errWrite := fl.Write(keyTestRecords(1000, 1000+100*10, 10)) //6 files sealed, 2 rotated away
+	assert.Equal(t, nil, errWrite)
+
+	index := fl.Index()
+	assert.Equal(t, 4, len(index))
+	assert.Equal(t, IndexEntry{FileNumber: 2, RecordCount: 16, FirstKey: 1320, LastKey: 1470, StoredSize: index[0].StoredSize, Checksum: index[0].Checksum}, index[0])
+	assert.Equal(t, int64(5), index[3].FileNumber)
+
+	n, errLen := fl.Len()
+	assert.Equal(t, nil, errLen)
+	assert.Equal(t, int64(4*16+4), n)
+
+	result, errRange := fl.RangeByKey(1465, 1485)
+	assert.Equal(t, nil, errRange)
+	assert.Equal(t, keyTestRecords(1470, 1485, 10), result)
+	result, errRange = fl.RangeByKey(0, 1335)
+	assert.Equal(t, nil, errRange)
+	assert.Equal(t, keyTestRecords(1320, 1335, 10), result)
+	result, errRange = fl.RangeByKey(1985, 3000)
+	assert.Equal(t, nil, errRange)
+	assert.Equal(t, keyTestRecords(1990, 2000, 10), result)
+	assert.Equal(t, nil, fl.VerifyIndex())
+
+	//Lost index is rebuilt
+	assert.Equal(t, nil, os.Remove(cfg.indexFileName()))
+	assert.Equal(t, nil, fl.Close())
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, index, fl.Index())
+
+	//Stale index (file sealed but crash before index write) is rebuilt
+	stale := encodeIndex(index[0:3])
+	assert.Equal(t, nil, os.WriteFile(cfg.indexFileName(), stale, 0755))
+	assert.Equal(t, nil, fl.Close())
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, index, fl.Index())
+
+	//Bit rot on data file is found by checksum
+	content, _ := os.ReadFile(cfg.filename(3))
+	content[len(content)-1] ^= 1
+	assert.Equal(t, nil, os.WriteFile(cfg.filename(3), content, 0755))
+	assert.NotEqual(t, nil, fl.VerifyIndex())
+}
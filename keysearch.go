@@ -0,0 +1,266 @@
+/*
+Key based queries. Usually records start with timestamp and are written in time order.
+KeyExtractor tells where key is in record and binary search finds records without reading everything
+*/
+package fixregsto
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+//ErrNoKey is returned from key queries when KeyExtractor is not configured
+var ErrNoKey = errors.New("key extractor is not configured")
+
+//KeyExtractor tells where unsigned integer key is in record. Records must be stored in non-decreasing key order
+type KeyExtractor struct {
+	Offset    int64 //Byte offset in record
+	Width     int64 //Key width in bytes 1-8. Zero disables key queries
+	BigEndian bool
+}
+
+//CheckErrors tell is key inside record
+func (p *KeyExtractor) CheckErrors(recordSize int64) error {
+	if p.Width == 0 {
+		return nil
+	}
+	if p.Width < 0 || 8 < p.Width {
+		return fmt.Errorf("Invalid key width %v", p.Width)
+	}
+	if p.Offset < 0 || recordSize < p.Offset+p.Width {
+		return fmt.Errorf("Key offset=%v width=%v does not fit to record size %v", p.Offset, p.Width, recordSize)
+	}
+	return nil
+}
+
+//Key extracts key from record
+func (p *KeyExtractor) Key(record []byte) uint64 {
+	result := uint64(0)
+	field := record[p.Offset : p.Offset+p.Width]
+	for i := range field {
+		if p.BigEndian {
+			result = result<<8 | uint64(field[i])
+		} else {
+			result = result<<8 | uint64(field[len(field)-1-i])
+		}
+	}
+	return result
+}
+
+//searchRecords returns index of first record in records having key >= key
+func (p *KeyExtractor) searchRecords(records []byte, recordSize int64, key uint64) int64 {
+	count := int(int64(len(records)) / recordSize)
+	return int64(sort.Search(count, func(i int) bool {
+		return key <= p.Key(records[int64(i)*recordSize:])
+	}))
+}
+
+/*
+FileStorage
+*/
+
+//existingFileNumbers lists numbered files in order
+func (p *FileStorageConf) existingFileNumbers() ([]int64, error) {
+	minFileNumber, maxFileNumber, filecount, errRange := p.GetNumberRangeOnDisk()
+	if errRange != nil {
+		return nil, errRange
+	}
+	result := []int64{}
+	if filecount == 0 {
+		return result, nil
+	}
+	for fileNumber := minFileNumber; fileNumber <= maxFileNumber; fileNumber++ {
+		if fileExists(p.filename(fileNumber)) {
+			result = append(result, fileNumber)
+		}
+	}
+	return result, nil
+}
+
+//fileNumbers lists numbered files from index, from list kept by writer or from disk. Result can be appended but not modified
+func (p *FileStorage) fileNumbers() ([]int64, error) {
+	if p.numbers != nil {
+		return p.numbers[:len(p.numbers):len(p.numbers)], nil
+	}
+	if !p.conf.Indexed {
+		return p.conf.existingFileNumbers()
+	}
+	result := make([]int64, len(p.index.entries))
+	for i, entry := range p.index.entries {
+		result[i] = entry.FileNumber
+	}
+	return result, nil
+}
+
+//keyPosition is findKeyPosition for cursors
+func (p *FileStorage) keyPosition(key uint64) (int64, error) {
+	return reading(p, func() (int64, error) {
+		return p.findKeyPosition(key)
+	})
+}
+
+//findKeyPosition gets record position of first record having key >= key. Binary search over files, only some files are read
+func (p *FileStorage) findKeyPosition(key uint64) (int64, error) {
+	if p.conf.Key.Width == 0 {
+		return 0, ErrNoKey
+	}
+	if p.conf.Indexed {
+		return p.findKeyPositionIndexed(key)
+	}
+	numbers, errNumbers := p.fileNumbers()
+	if errNumbers != nil {
+		return 0, errNumbers
+	}
+	workNumber := int64(0)
+	if 0 < len(numbers) {
+		workNumber = numbers[len(numbers)-1] + 1
+	}
+	segments := append(numbers, workNumber) //Last one is work buffer
+
+	loaded := make(map[int][]byte)
+	var errLoad error
+	load := func(i int) []byte {
+		if i == len(numbers) {
+			return p.workBuffer
+		}
+		byt, haz := loaded[i]
+		if !haz && errLoad == nil {
+			byt, errLoad = p.fileRecords(segments[i])
+			loaded[i] = byt
+		}
+		return byt
+	}
+
+	//First segment that starts with key >= key. Result is on previous segment or at start of this
+	i := sort.Search(len(segments), func(i int) bool {
+		records := load(i)
+		if len(records) == 0 {
+			return true
+		}
+		return key <= p.conf.Key.Key(records)
+	})
+	if errLoad != nil {
+		return 0, errLoad
+	}
+	if 0 < i {
+		records := load(i - 1)
+		if errLoad != nil {
+			return 0, errLoad
+		}
+		j := p.conf.Key.searchRecords(records, p.conf.RecordSize, key)
+		if j < int64(len(records))/p.conf.RecordSize {
+			return segments[i-1]*p.conf.recordsPerFile() + j, nil
+		}
+	}
+	if i < len(segments) {
+		return segments[i] * p.conf.recordsPerFile(), nil
+	}
+	return workNumber*p.conf.recordsPerFile() + int64(len(p.workBuffer))/p.conf.RecordSize, nil
+}
+
+//readPositions reads records from position to position. Position is fileNumber*recordsPerFile+index like in Seek
+func (p *FileStorage) readPositions(from int64, to int64) ([]byte, error) {
+	numbers, errNumbers := p.fileNumbers()
+	if errNumbers != nil {
+		return nil, errNumbers
+	}
+	workNumber := int64(0)
+	if 0 < len(numbers) {
+		workNumber = numbers[len(numbers)-1] + 1
+	}
+	result := []byte{}
+	rpf := p.conf.recordsPerFile()
+	for _, fileNumber := range append(numbers, workNumber) {
+		start := fileNumber * rpf
+		if to <= start {
+			break
+		}
+		if start+rpf <= from {
+			continue
+		}
+		records := p.workBuffer
+		if fileNumber != workNumber {
+			var errRead error
+			records, errRead = p.fileRecords(fileNumber)
+			if errRead != nil {
+				return result, errRead
+			}
+		}
+		first := from - start
+		if first < 0 {
+			first = 0
+		}
+		last := to - start
+		if int64(len(records))/p.conf.RecordSize < last {
+			last = int64(len(records)) / p.conf.RecordSize
+		}
+		if first < last {
+			result = append(result, records[first*p.conf.RecordSize:last*p.conf.RecordSize]...)
+		}
+	}
+	return result, nil
+}
+
+//SeekToKey moves read position to first record having key >= key. Returns new position in bytes like Seek
+func (p *FileStorage) SeekToKey(key uint64) (int64, error) {
+	return p.cursor.seekToKeyFrom(p, key)
+}
+
+//RangeByKey gets records having from <= key < to without moving read position
+func (p *FileStorage) RangeByKey(from uint64, to uint64) ([]byte, error) {
+	if to <= from {
+		return []byte{}, nil
+	}
+	return reading(p, func() ([]byte, error) {
+		start, errStart := p.findKeyPosition(from)
+		if errStart != nil {
+			return nil, errStart
+		}
+		end, errEnd := p.findKeyPosition(to)
+		if errEnd != nil {
+			return nil, errEnd
+		}
+		return p.readPositions(start, end)
+	})
+}
+
+/*
+Memloop
+*/
+
+//SeekToKey moves read position to first record having key >= key. Returns new position in bytes like Seek
+func (p *Memloop) SeekToKey(key uint64) (int64, error) {
+	return p.cursor.seekToKeyFrom(p, key)
+}
+
+//keyPosition is used by cursors
+func (p *Memloop) keyPosition(key uint64) (int64, error) {
+	if p.conf.Key.Width == 0 {
+		return 0, ErrNoKey
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return 0, ErrClosed
+	}
+	return p.dropped + p.conf.Key.searchRecords(p.mem, p.conf.RecordSize, key), nil
+}
+
+//RangeByKey gets records having from <= key < to without moving read position
+func (p *Memloop) RangeByKey(from uint64, to uint64) ([]byte, error) {
+	if p.conf.Key.Width == 0 {
+		return nil, ErrNoKey
+	}
+	if to <= from {
+		return []byte{}, nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
+	start := p.conf.Key.searchRecords(p.mem, p.conf.RecordSize, from) * p.conf.RecordSize
+	end := p.conf.Key.searchRecords(p.mem, p.conf.RecordSize, to) * p.conf.RecordSize
+	return append([]byte{}, p.mem[start:end]...), nil
+}
@@ -0,0 +1,103 @@
+package fixregsto
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//timestamp is 4 bytes big endian at offset 2
+func keyTestRecords(from uint32, to uint32, step uint32) []byte {
+	result := []byte{}
+	for ts := from; ts < to; ts += step {
+		record := make([]byte, 8)
+		binary.BigEndian.PutUint32(record[2:], ts)
+		result = append(result, record...)
+	}
+	return result
+}
+
+func TestKeyExtractor(t *testing.T) {
+	record := []byte{0, 1, 2, 3}
+	be := KeyExtractor{Offset: 1, Width: 2, BigEndian: true}
+	le := KeyExtractor{Offset: 1, Width: 2}
+	assert.Equal(t, uint64(0x0102), be.Key(record))
+	assert.Equal(t, uint64(0x0201), le.Key(record))
+	assert.NotEqual(t, nil, be.CheckErrors(2))
+}
+
+func TestFileStorageRangeByKey(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "keyTest",
+		RecordSize:        8,
+		MaxFileCount:      10,
+		FileMaxSize:       8 * 16,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		Key:               KeyExtractor{Offset: 2, Width: 4, BigEndian: true},
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+
+	_, errNoData := fl.SeekToKey(100)
+	assert.Equal(t, nil, errNoData)
+
+	_, errWrite := fl.Write(keyTestRecords(1000, 1000+100*10, 10)) //100 records, 6 full files and work
+	assert.Equal(t, nil, errWrite)
+
+	inside, errInside := fl.RangeByKey(1155, 1200)
+	assert.Equal(t, nil, errInside)
+	assert.Equal(t, keyTestRecords(1160, 1200, 10), inside)
+
+	spanning, errSpanning := fl.RangeByKey(1000, 1970)
+	assert.Equal(t, nil, errSpanning)
+	assert.Equal(t, keyTestRecords(1000, 1970, 10), spanning)
+
+	before, errBefore := fl.RangeByKey(0, 1000)
+	assert.Equal(t, nil, errBefore)
+	assert.Equal(t, []byte{}, before)
+
+	after, errAfter := fl.RangeByKey(1991, 5000)
+	assert.Equal(t, nil, errAfter)
+	assert.Equal(t, []byte{}, after)
+
+	pos, errSeek := fl.SeekToKey(1985)
+	assert.Equal(t, nil, errSeek)
+	assert.Equal(t, int64(99*8), pos)
+	tail, errTail := io.ReadAll(&fl)
+	assert.Equal(t, nil, errTail)
+	assert.Equal(t, keyTestRecords(1990, 2000, 10), tail)
+
+	//Writer searches files it reads, directory is not listed again on query
+	assert.Equal(t, nil, os.WriteFile(cfg.filename(20), keyTestRecords(5000, 5000+16*10, 10), 0644))
+	pos, errSeek = fl.SeekToKey(1985)
+	assert.Equal(t, nil, errSeek)
+	assert.Equal(t, int64(99*8), pos)
+	assert.Equal(t, nil, os.Remove(cfg.filename(20)))
+
+	fl.Close()
+	cfg.Key = KeyExtractor{}
+	noKey, _ := cfg.InitFileStorage()
+	_, errNoKey := noKey.RangeByKey(0, 1)
+	assert.Equal(t, ErrNoKey, errNoKey)
+}
+
+func TestMemloopRangeByKey(t *testing.T) {
+	cfg := MemloopConf{RecordSize: 8, MaxRecords: 50, Key: KeyExtractor{Offset: 2, Width: 4, BigEndian: true}}
+	mem, errInit := cfg.InitMemLoop()
+	assert.Equal(t, nil, errInit)
+	_, errWrite := mem.Write(keyTestRecords(0, 50, 1))
+	assert.Equal(t, nil, errWrite)
+
+	result, errRange := mem.RangeByKey(10, 13)
+	assert.Equal(t, nil, errRange)
+	assert.Equal(t, keyTestRecords(10, 13, 1), result)
+
+	pos, errSeek := mem.SeekToKey(48)
+	assert.Equal(t, nil, errSeek)
+	assert.Equal(t, int64(48*8), pos)
+}
@@ -0,0 +1,29 @@
+/*
+Lifecycle of storages. Flush syncs buffered writes, Close flushes and releases lock, device and background work.
+After Close every call returns ErrClosed and followers are stopped with it
+*/
+package fixregsto
+
+import (
+	"errors"
+	"io"
+)
+
+//ErrClosed is returned when storage is used after Close
+var ErrClosed = errors.New("storage is closed")
+
+//Flusher is storage that can buffer writes. After Flush returns without error, written records are on storage medium
+type Flusher interface {
+	Flush() error
+}
+
+//Lifecycle is implemented by all storages of this package. Use it for orderly shutdown, like on SIGTERM
+type Lifecycle interface {
+	io.Closer
+	Flusher
+}
+
+//closeState is shared between copies of storage. Protected by mu of storage
+type closeState struct {
+	closed bool
+}
@@ -0,0 +1,94 @@
+package fixregsto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type lifecycleStorage interface {
+	FixRegSto
+	Lifecycle
+	Follower
+}
+
+//lifecycleTest closes storage while follower waits. Storage must have 8 byte records
+func lifecycleTest(t *testing.T, sto lifecycleStorage) {
+	_, errWrite := sto.Write(counterRecord(1))
+	assert.Equal(t, nil, errWrite)
+	assert.Equal(t, nil, sto.Flush())
+
+	sub, errFollow := sto.Follow(context.Background(), 0, io.SeekStart)
+	assert.Equal(t, nil, errFollow)
+	assert.Equal(t, counterRecord(1), <-sub.C)
+
+	assert.Equal(t, nil, sto.Close())
+	select {
+	case _, open := <-sub.C:
+		assert.False(t, open)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("follower was not stopped by Close")
+	}
+	assert.True(t, errors.Is(sub.Err(), ErrClosed), "%v", sub.Err())
+
+	_, errWrite = sto.Write(counterRecord(2))
+	assert.Equal(t, ErrClosed, errWrite)
+	_, errLen := sto.Len()
+	assert.Equal(t, ErrClosed, errLen)
+	_, errLatest := sto.GetLatest(1)
+	assert.Equal(t, ErrClosed, errLatest)
+	_, errFirst := sto.GetFirst(1)
+	assert.Equal(t, ErrClosed, errFirst)
+	_, errAll := sto.ReadAll()
+	assert.Equal(t, ErrClosed, errAll)
+	_, errRead := sto.Read(make([]byte, 8))
+	assert.Equal(t, ErrClosed, errRead)
+	assert.Equal(t, ErrClosed, sto.Flush())
+	assert.Equal(t, ErrClosed, sto.Close())
+}
+
+func TestLifecycle(t *testing.T) {
+	memCfg := MemloopConf{RecordSize: 8, MaxRecords: 10}
+	mem, _ := memCfg.InitMemLoop()
+	lifecycleTest(t, &mem)
+
+	eeCfg := EepromStorageConf{RecordSize: 8}
+	ee, _ := eeCfg.InitEepromStorage(NewMemEeprom(1024, 16, 1000000))
+	lifecycleTest(t, &ee)
+
+	os.Remove(TMPBLOCKIMAGE)
+	blockCfg := BlockStorageConf{DevicePath: TMPBLOCKIMAGE, Size: 512 * 3, SectorSize: 512, RecordSize: 8, Format: true}
+	f, _ := os.Create(TMPBLOCKIMAGE)
+	f.Close()
+	block, errBlock := blockCfg.InitBlockStorage()
+	assert.Equal(t, nil, errBlock)
+	lifecycleTest(t, &block)
+
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{Name: "lifecycle", RecordSize: 8, MaxFileCount: 4, FileMaxSize: 64, Path: TMPTESTDIR}
+	cfg.Durability = DurabilityPolicy{Mode: DURABILITY_OS}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	roCfg := cfg
+	roCfg.ReadOnly = true
+	ro, roErr := roCfg.InitFileStorage()
+	assert.Equal(t, nil, roErr)
+	lifecycleTest(t, &fl)
+
+	//Lock is released on Close, next writer gets it
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	all, _ := fl.ReadAll()
+	assert.Equal(t, counterRecord(1), all)
+	assert.Equal(t, nil, fl.Close())
+
+	assert.Equal(t, nil, ro.Flush())
+	assert.Equal(t, nil, ro.Close())
+	_, errRo := ro.GetLatest(1)
+	assert.Equal(t, ErrClosed, errRo)
+}
@@ -0,0 +1,162 @@
+/*
+Cross process locking for FileStorage.
+Writer takes advisory lock on name.lock file at init so two programs can not rotate same files.
+Lock file contains PID of holder. If holder has died without releasing, lock is taken over and PID of it is reported
+
+Read only storages do not take lock. Those reload state from disk before each read
+*/
+package fixregsto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//ErrLocked is returned from InitFileStorage when other process is writing same storage
+var ErrLocked = errors.New("storage is locked by other process")
+
+//ErrReadOnly is returned when writing to storage opened with ReadOnly
+var ErrReadOnly = errors.New("storage is opened read only")
+
+//storageLock is shared between copies of FileStorage
+type storageLock struct {
+	f          *os.File
+	filename   string
+	released   bool
+	staleEmpty bool //Took over empty lock file left by crash before PID was written
+}
+
+func (p *FileStorageConf) lockFileName() string {
+	return p.BaseFileName() + ".lock"
+}
+
+//readLockPid gets PID written on lock file. 0 if not readable
+func readLockPid(f *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, errParse := strconv.Atoi(strings.TrimSpace(string(buf[0:n])))
+	if errParse != nil {
+		return 0
+	}
+	return pid
+}
+
+//writeLockPid replaces content of lock file with own PID
+func writeLockPid(f *os.File) error {
+	if errTruncate := f.Truncate(0); errTruncate != nil {
+		return errTruncate
+	}
+	if _, errWrite := f.WriteAt([]byte(fmt.Sprintf("%v\n", os.Getpid())), 0); errWrite != nil {
+		return errWrite
+	}
+	return f.Sync()
+}
+
+//lockedError tells who is holding lock
+func lockedError(pid int) error {
+	if pid == 0 {
+		return ErrLocked
+	}
+	return fmt.Errorf("%w, pid=%v", ErrLocked, pid)
+}
+
+//release clears PID so next holder does not report stale lock, then unlocks
+func (p *storageLock) release() error {
+	if p == nil || p.released {
+		return nil
+	}
+	p.released = true
+	errTruncate := p.f.Truncate(0)
+	errUnlock := p.unlockAndClose()
+	if errTruncate != nil {
+		return errTruncate
+	}
+	return errUnlock
+}
+
+//readOnlyRetries is how many times read is retried if writer process changes files during read
+const readOnlyRetries = 10
+
+//reading runs read operation with shared lock.
+//On read only storage work buffer is reloaded from disk first and operation is retried if writer process changed files meanwhile
+func reading[T any](p *FileStorage, op func() (T, error)) (T, error) {
+	var result T
+	if !p.conf.ReadOnly {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		if p.closed.closed {
+			return result, ErrClosed
+		}
+		return op()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return result, ErrClosed
+	}
+	errChanging := fmt.Errorf("storage kept changing during %v read attempts", readOnlyRetries)
+	errLast := errChanging
+	for attempt := 0; attempt < readOnlyRetries; attempt++ {
+		before, errBefore := p.conf.diskStamp()
+		if errBefore != nil {
+			return result, errBefore
+		}
+		if errReload := p.reloadWorkBuffer(); errReload != nil {
+			errLast = errReload //Work file might be replaced between listing and reading
+			continue
+		}
+		var errOp error
+		result, errOp = op()
+		after, errAfter := p.conf.diskStamp()
+		if errAfter != nil {
+			return result, errAfter
+		}
+		if before == after {
+			return result, errOp
+		}
+		errLast = errChanging
+	}
+	return result, errLast
+}
+
+//diskStamp changes when writer process changes any storage file
+func (p *FileStorageConf) diskStamp() (string, error) {
+	sizes, errSizes := listFileSizes(p.Path, p.Name)
+	if errSizes != nil {
+		return "", errSizes
+	}
+	workTime := int64(0)
+	fInfo, errStat := os.Stat(p.BaseFileName())
+	if errStat == nil {
+		workTime = fInfo.ModTime().UnixNano()
+	}
+	return fmt.Sprint(sizes, workTime), nil
+}
+
+//reloadWorkBuffer reads work file that writer process keeps updating.
+//Work file is left out if writer is just between sealing it and removing it
+func (p *FileStorage) reloadWorkBuffer() error {
+	workfile := p.conf.BaseFileName()
+	_, errStat := os.Stat(workfile)
+	if os.IsNotExist(errStat) {
+		p.workBuffer = []byte{}
+		return nil
+	}
+	if errStat != nil {
+		return errStat
+	}
+	records, errRead := p.conf.readWorkFile()
+	var corruptErr *CorruptedError
+	if errRead != nil && !(p.conf.SkipCorrupted && errors.As(errRead, &corruptErr)) {
+		return errRead
+	}
+	p.workBuffer = records
+	stale, errStale := p.conf.staleWork()
+	if stale {
+		p.workBuffer = []byte{}
+	}
+	return errStale
+}
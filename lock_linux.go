@@ -0,0 +1,45 @@
+//go:build linux
+
+package fixregsto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+//acquireLock takes flock on file. Kernel releases flock when process dies, so PID left on file is from holder that crashed.
+//Returns PID of stale holder (0 if none)
+func acquireLock(filename string) (*storageLock, int, error) {
+	f, errOpen := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if errOpen != nil {
+		return nil, 0, fmt.Errorf("Error opening lock file %v err=%v", filename, errOpen.Error())
+	}
+	errFlock := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errFlock != nil {
+		pid := readLockPid(f)
+		f.Close()
+		if errors.Is(errFlock, syscall.EWOULDBLOCK) {
+			return nil, 0, lockedError(pid)
+		}
+		return nil, 0, fmt.Errorf("Error locking %v err=%v", filename, errFlock.Error())
+	}
+	result := storageLock{f: f, filename: filename}
+	stalePid := readLockPid(f) //Clean release leaves file empty
+	if errWrite := writeLockPid(f); errWrite != nil {
+		result.unlockAndClose()
+		return nil, 0, errWrite
+	}
+	return &result, stalePid, nil
+}
+
+//unlockAndClose, file is left on disk. Removing it would race with other process taking lock
+func (p *storageLock) unlockAndClose() error {
+	errUnlock := syscall.Flock(int(p.f.Fd()), syscall.LOCK_UN)
+	errClose := p.f.Close()
+	if errUnlock != nil {
+		return errUnlock
+	}
+	return errClose
+}
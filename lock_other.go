@@ -0,0 +1,75 @@
+//go:build !linux
+
+package fixregsto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+//lockGracePeriod is how long empty lock file is waited for PID of its creator. Older one is left by crash
+const lockGracePeriod = 10 * time.Second
+
+//acquireLock creates lock file exclusively. Existing file is stale if process on it is not running anymore
+//or it is still empty after lockGracePeriod. Returns PID of stale holder (0 if none)
+func acquireLock(filename string) (*storageLock, int, error) {
+	stalePid := 0
+	staleEmpty := false
+	for attempt := 0; attempt < 2; attempt++ {
+		f, errOpen := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if errOpen == nil {
+			result := storageLock{f: f, filename: filename, staleEmpty: staleEmpty}
+			if errWrite := writeLockPid(f); errWrite != nil {
+				f.Close()
+				os.Remove(filename)
+				return nil, 0, errWrite
+			}
+			return &result, stalePid, nil
+		}
+		if !errors.Is(errOpen, os.ErrExist) {
+			return nil, 0, fmt.Errorf("Error creating lock file %v err=%v", filename, errOpen.Error())
+		}
+		existing, errExisting := os.Open(filename)
+		if errExisting != nil {
+			continue //Removed meanwhile
+		}
+		pid := readLockPid(existing)
+		info, errInfo := existing.Stat()
+		existing.Close()
+		if pid == 0 && (errInfo != nil || time.Since(info.ModTime()) < lockGracePeriod) { //Empty file is being written right now
+			return nil, 0, lockedError(pid)
+		}
+		if pid != 0 && processAlive(pid) {
+			return nil, 0, lockedError(pid)
+		}
+		stalePid = pid
+		staleEmpty = pid == 0
+		os.Remove(filename)
+	}
+	return nil, 0, ErrLocked
+}
+
+//unlockAndClose removes lock file, existence of file is the lock
+func (p *storageLock) unlockAndClose() error {
+	errClose := p.f.Close()
+	errRemove := os.Remove(p.filename)
+	if errClose != nil {
+		return errClose
+	}
+	return errRemove
+}
+
+func processAlive(pid int) bool {
+	proc, errFind := os.FindProcess(pid)
+	if errFind != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" { //FindProcess fails on windows if process does not exist
+		return true
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
@@ -0,0 +1,39 @@
+//go:build !linux
+
+package fixregsto
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmptyLockFile(t *testing.T) {
+	os.RemoveAll(TMPLOCKDIR)
+	cfg := FileStorageConf{
+		Name:         "locked",
+		RecordSize:   8,
+		MaxFileCount: 4,
+		FileMaxSize:  64,
+		Path:         TMPLOCKDIR,
+	}
+	assert.Equal(t, nil, os.MkdirAll(TMPLOCKDIR, os.ModePerm))
+
+	//Creator is writing PID right now
+	assert.Equal(t, nil, os.WriteFile(cfg.lockFileName(), []byte{}, 0644))
+	_, flErr := cfg.InitFileStorage()
+	assert.True(t, errors.Is(flErr, ErrLocked), "got %v", flErr)
+
+	//Crash between create and writing PID
+	crashed := time.Now().Add(-2 * lockGracePeriod)
+	assert.Equal(t, nil, os.Chtimes(cfg.lockFileName(), crashed, crashed))
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	report := fl.RecoveryReport()
+	assert.Equal(t, []string{cfg.lockFileName()}, report.Removed)
+	assert.Equal(t, 0, report.StaleLockPid)
+	assert.Equal(t, nil, fl.Close())
+}
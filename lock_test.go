@@ -0,0 +1,95 @@
+package fixregsto
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TMPLOCKDIR = "/tmp/locktest12356789"
+)
+
+func TestLock(t *testing.T) {
+	os.RemoveAll(TMPLOCKDIR)
+	cfg := FileStorageConf{
+		Name:         "locked",
+		RecordSize:   8,
+		MaxFileCount: 4,
+		FileMaxSize:  64,
+		Path:         TMPLOCKDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+
+	_, errSecond := cfg.InitFileStorage()
+	assert.True(t, errors.Is(errSecond, ErrLocked), "got %v", errSecond)
+
+	assert.Equal(t, nil, fl.Close())
+	_, errWrite := fl.Write(make([]byte, 8))
+	assert.NotEqual(t, nil, errWrite)
+
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, 0, fl.RecoveryReport().StaleLockPid)
+	assert.Equal(t, nil, fl.Close())
+
+	//Process crashed while holding lock
+	assert.Equal(t, nil, os.WriteFile(cfg.lockFileName(), []byte("999999\n"), 0644))
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, 999999, fl.RecoveryReport().StaleLockPid)
+	assert.Equal(t, nil, fl.Close())
+}
+
+func TestReadOnlyWhileWriting(t *testing.T) {
+	os.RemoveAll(TMPLOCKDIR)
+	cfg := FileStorageConf{
+		Name:         "locked",
+		RecordSize:   8,
+		MaxFileCount: 4,
+		FileMaxSize:  64,
+		Path:         TMPLOCKDIR,
+	}
+	writer, errWriter := cfg.InitFileStorage()
+	assert.Equal(t, nil, errWriter)
+	defer writer.Close()
+
+	roCfg := cfg
+	roCfg.ReadOnly = true
+	reader, errReader := roCfg.InitFileStorage()
+	assert.Equal(t, nil, errReader)
+	_, errWrite := reader.Write(make([]byte, 8))
+	assert.Equal(t, ErrReadOnly, errWrite)
+
+	total := 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < total; i++ {
+			record := make([]byte, 8)
+			binary.LittleEndian.PutUint64(record, uint64(i))
+			_, errWrite := writer.Write(record)
+			assert.Equal(t, nil, errWrite)
+		}
+	}()
+
+	for done := false; !done; {
+		all, errAll := reader.ReadAll()
+		assert.Equal(t, nil, errAll)
+		for i := 8; i < len(all); i += 8 { //Consistent snapshot has no holes
+			assert.Equal(t, binary.LittleEndian.Uint64(all[i-8:])+1, binary.LittleEndian.Uint64(all[i:]))
+		}
+		done = 0 < len(all) && binary.LittleEndian.Uint64(all[len(all)-8:]) == uint64(total-1)
+	}
+	wg.Wait()
+
+	n, errLen := reader.Len()
+	assert.Equal(t, nil, errLen)
+	assert.Equal(t, int64(4*8+total%8), n)
+}
@@ -0,0 +1,356 @@
+/*
+Manifest of FileStorage. JSON file name.manifest tells layout files were written with, so storage opened with
+conf that would misread or drop files is refused with ErrLayoutMismatch. Use Migrate to change layout.
+
+Framed files tell their compression and coding on header, so those can be changed freely on framed storage
+unless it has unframed files written before framing was enabled.
+Unframed storage can change compression only between codecs recognized from magic.
+Storage created before manifest gets manifest from conf it is opened with
+
+Migrate writes records to staging directory name.migrate with new conf. When staging is complete, manifest
+gets list of staged files (commit point) and files are moved in place. Power cut before commit leaves old storage,
+after commit next writer init completes moving files
+*/
+package fixregsto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+)
+
+const MANIFESTVERSION = 1
+
+//MIGRATEBATCHRECORDS is how many records Migrate copies at once
+const MIGRATEBATCHRECORDS = 4096
+
+//ErrLayoutMismatch is returned from InitFileStorage when conf does not match layout on manifest
+var ErrLayoutMismatch = errors.New("storage layout does not match configuration, use Migrate")
+
+//Layout is part of FileStorageConf that decides how files are written and read
+type Layout struct {
+	RecordSize        int64    `json:"recordSize"`
+	FileMaxSize       int64    `json:"fileMaxSize"`
+	MaxFileCount      int64    `json:"maxFileCount"`
+	CompressionMethod string   `json:"compressionMethod,omitempty"`
+	BitSlices         []int    `json:"bitSlices,omitempty"`
+	FieldTransforms   []string `json:"fieldTransforms,omitempty"`
+	Framed            bool     `json:"framed,omitempty"`
+	UnframedFiles     bool     `json:"unframedFiles,omitempty"` //Framing was enabled later, older files are decoded with this coding
+}
+
+//Manifest is stored as JSON next to storage files
+type Manifest struct {
+	Version   int        `json:"version"`
+	Layout    Layout     `json:"layout"`
+	Migration *Migration `json:"migration,omitempty"` //Set when migration is committed but files are not yet in place
+}
+
+//Migration tells staged files of new layout
+type Migration struct {
+	Layout Layout   `json:"layout"`
+	Files  []string `json:"files"`
+}
+
+//Layout gets layout of conf. Bit slices come from schema if not set
+func (p *FileStorageConf) Layout() Layout {
+	result := Layout{
+		RecordSize:        p.RecordSize,
+		FileMaxSize:       p.FileMaxSize,
+		MaxFileCount:      p.MaxFileCount,
+		CompressionMethod: p.CompressionMethod,
+		BitSlices:         p.bitSlices(),
+		FieldTransforms:   p.FieldTransforms,
+		Framed:            p.Framed,
+	}
+	if len(result.BitSlices) == 0 {
+		result.BitSlices = nil
+	}
+	if len(result.FieldTransforms) == 0 {
+		result.FieldTransforms = nil
+	}
+	return result
+}
+
+//Apply sets layout to conf. Tools use this for opening storage without knowing its settings
+func (p Layout) Apply(conf *FileStorageConf) {
+	conf.RecordSize = p.RecordSize
+	conf.FileMaxSize = p.FileMaxSize
+	conf.MaxFileCount = p.MaxFileCount
+	conf.CompressionMethod = p.CompressionMethod
+	conf.BitSlices = p.BitSlices
+	conf.FieldTransforms = p.FieldTransforms
+	conf.Framed = p.Framed
+}
+
+//compatible tells can storage written with layout on disk be opened with wanted layout
+func (p Layout) compatible(wanted Layout) error {
+	mismatch := func(what string, onDisk interface{}, configured interface{}) error {
+		return fmt.Errorf("%w, %v is %v on disk and %v on conf", ErrLayoutMismatch, what, onDisk, configured)
+	}
+	switch {
+	case p.RecordSize != wanted.RecordSize:
+		return mismatch("RecordSize", p.RecordSize, wanted.RecordSize)
+	case p.FileMaxSize != wanted.FileMaxSize:
+		return mismatch("FileMaxSize", p.FileMaxSize, wanted.FileMaxSize)
+	case p.MaxFileCount != wanted.MaxFileCount:
+		return mismatch("MaxFileCount", p.MaxFileCount, wanted.MaxFileCount)
+	case p.Framed && !wanted.Framed:
+		return mismatch("Framed", p.Framed, wanted.Framed)
+	case p.Framed && !p.UnframedFiles:
+		return nil //Headers tell coding
+	case !reflect.DeepEqual(p.BitSlices, wanted.BitSlices):
+		return mismatch("BitSlices", p.BitSlices, wanted.BitSlices)
+	case !reflect.DeepEqual(p.FieldTransforms, wanted.FieldTransforms):
+		return mismatch("FieldTransforms", p.FieldTransforms, wanted.FieldTransforms)
+	case p.CompressionMethod != wanted.CompressionMethod && !(recognizable(p.CompressionMethod) && recognizable(wanted.CompressionMethod)):
+		return mismatch("CompressionMethod", p.CompressionMethod, wanted.CompressionMethod)
+	}
+	return nil
+}
+
+//recognizable tells can files written with method be recognized from magic. No compression is recognized as no magic
+func recognizable(method string) bool {
+	if len(method) == 0 {
+		return true
+	}
+	codec, errCodec := GetCodec(method)
+	return errCodec == nil && 0 < len(codec.Magic())
+}
+
+func (p *FileStorageConf) manifestFileName() string {
+	return p.BaseFileName() + ".manifest"
+}
+
+func (p *FileStorageConf) stagingDir() string {
+	return p.BaseFileName() + ".migrate"
+}
+
+//ReadManifest reads manifest of storage. Nil if storage does not have manifest
+func (p *FileStorageConf) ReadManifest() (*Manifest, error) {
+	content, errRead := os.ReadFile(p.manifestFileName())
+	if os.IsNotExist(errRead) {
+		return nil, nil
+	}
+	if errRead != nil {
+		return nil, errRead
+	}
+	var result Manifest
+	if errParse := json.Unmarshal(content, &result); errParse != nil {
+		return nil, fmt.Errorf("Invalid manifest %v err=%v", p.manifestFileName(), errParse.Error())
+	}
+	if result.Version != MANIFESTVERSION {
+		return nil, fmt.Errorf("Unsupported manifest version %v on %v", result.Version, p.manifestFileName())
+	}
+	return &result, nil
+}
+
+func (p *FileStorageConf) writeManifest(manifest Manifest) error {
+	manifest.Version = MANIFESTVERSION
+	content, errMarshal := json.MarshalIndent(manifest, "", "  ")
+	if errMarshal != nil {
+		return errMarshal
+	}
+	_, errWrite := writeWithFsyncCow(p.manifestFileName(), content)
+	return errWrite
+}
+
+//checkManifest is run on init before recovery. Writer completes committed migration and updates manifest
+//to compatible conf, or creates manifest if there is none
+func (p *FileStorageConf) checkManifest(writer bool) error {
+	manifest, errManifest := p.ReadManifest()
+	if errManifest != nil {
+		return errManifest
+	}
+	wanted := p.Layout()
+	if manifest == nil {
+		if !writer {
+			return nil
+		}
+		return p.writeManifest(Manifest{Layout: wanted})
+	}
+	if manifest.Migration != nil {
+		if !writer {
+			return fmt.Errorf("%w, migration is not finished. Open storage for writing to finish it", ErrLayoutMismatch)
+		}
+		if errFinish := p.finishMigration(*manifest.Migration); errFinish != nil {
+			return errFinish
+		}
+		manifest = &Manifest{Layout: manifest.Migration.Layout}
+	}
+	if errCompatible := manifest.Layout.compatible(wanted); errCompatible != nil {
+		return errCompatible
+	}
+	wanted.UnframedFiles = manifest.Layout.UnframedFiles || (!manifest.Layout.Framed && wanted.Framed)
+	if writer && !reflect.DeepEqual(manifest.Layout, wanted) { //Compatible change, new files are written with it
+		return p.writeManifest(Manifest{Layout: wanted})
+	}
+	return nil
+}
+
+//finishMigration moves staged files in place, removes files of old layout and writes manifest of new layout.
+//Can be run again if interrupted
+func (p *FileStorageConf) finishMigration(migration Migration) error {
+	staged := make(map[string]bool)
+	for _, name := range migration.Files {
+		staged[name] = true
+		stagedName := path.Join(p.stagingDir(), name)
+		if !fileExists(stagedName) {
+			continue //Moved already
+		}
+		if errRename := os.Rename(stagedName, path.Join(p.Path, name)); errRename != nil {
+			return fmt.Errorf("Error moving staged %v err=%v", stagedName, errRename)
+		}
+	}
+	fEntries, errDir := os.ReadDir(p.Path)
+	if errDir != nil {
+		return errDir
+	}
+	for _, entry := range fEntries {
+		name := entry.Name()
+		obsolete := name == path.Base(p.indexFileName()) || name == path.Base(p.checkpointFileName()) //Files are renumbered, shipping starts again
+		if _, _, isStorageFile := p.parseStorageFileName(name); (!isStorageFile && !obsolete) || staged[name] {
+			continue
+		}
+		if errRemove := os.Remove(path.Join(p.Path, name)); errRemove != nil {
+			return fmt.Errorf("Error removing %v of old layout err=%v", name, errRemove)
+		}
+	}
+	if errSync := syncDir(p.Path); errSync != nil {
+		return errSync
+	}
+	if errManifest := p.writeManifest(Manifest{Layout: migration.Layout}); errManifest != nil {
+		return errManifest
+	}
+	return os.RemoveAll(p.stagingDir())
+}
+
+//Migrate rewrites storage written with oldConf to layout of newConf keeping record order.
+//Name and Path must be same and RecordSize can not change. Storage must not be open and must not have consumers.
+//Power cut leaves either old or new storage, unfinished migration is completed by next writer init or Migrate
+func Migrate(oldConf FileStorageConf, newConf FileStorageConf) error {
+	if oldConf.Name != newConf.Name || path.Clean(oldConf.Path) != path.Clean(newConf.Path) {
+		return fmt.Errorf("Migrate works in place, name and path must be same")
+	}
+	if oldConf.RecordSize != newConf.RecordSize {
+		return fmt.Errorf("RecordSize can not be migrated, %v to %v", oldConf.RecordSize, newConf.RecordSize)
+	}
+	if errConf := newConf.CheckErrors(); errConf != nil {
+		return errConf
+	}
+	oldConf.ReadOnly = false
+	old, errOld := oldConf.InitFileStorage()
+	if errors.Is(errOld, ErrLayoutMismatch) { //Migrated already, maybe finished by init just now
+		if manifest, _ := newConf.ReadManifest(); manifest != nil && manifest.Migration == nil && manifest.Layout.compatible(newConf.Layout()) == nil {
+			return nil
+		}
+	}
+	if errOld != nil {
+		return errOld
+	}
+	defer old.Close()
+	if errConsumers := oldConf.checkNoConsumers(); errConsumers != nil {
+		return errConsumers
+	}
+
+	migration, errStage := stageMigration(&old, newConf)
+	if errStage != nil {
+		return errStage
+	}
+	if errCommit := oldConf.writeManifest(Manifest{Layout: oldConf.Layout(), Migration: &migration}); errCommit != nil {
+		return errCommit
+	}
+	return oldConf.finishMigration(migration)
+}
+
+//stageMigration writes records of old to staging directory with newConf and lists staged files
+func stageMigration(old *FileStorage, newConf FileStorageConf) (Migration, error) {
+	migration := Migration{Layout: newConf.Layout(), Files: []string{}}
+	stagingConf := newConf
+	stagingConf.Path = old.conf.stagingDir()
+	stagingConf.ReadOnly = false
+	stagingConf.Durability = DurabilityPolicy{Mode: DURABILITY_OS}   //Synced on Close
+	if errClean := os.RemoveAll(stagingConf.Path); errClean != nil { //Left from migration that did not commit
+		return migration, errClean
+	}
+	staging, errStaging := stagingConf.InitFileStorage()
+	if errStaging != nil {
+		return migration, errStaging
+	}
+	errCopy := copyRecords(&staging, old)
+	errClose := staging.Close()
+	if errCopy != nil {
+		return migration, errCopy
+	}
+	if errClose != nil {
+		return migration, errClose
+	}
+
+	var errList error
+	migration.Files, errList = stagingConf.stagedFiles()
+	return migration, errList
+}
+
+//stagedFiles lists storage files and index on staging directory. Lock and manifest are not moved
+func (p *FileStorageConf) stagedFiles() ([]string, error) {
+	result := []string{}
+	fEntries, errDir := os.ReadDir(p.Path)
+	if errDir != nil {
+		return result, errDir
+	}
+	for _, entry := range fEntries {
+		name := entry.Name()
+		if _, isTmp, isStorageFile := p.parseStorageFileName(name); (isStorageFile && !isTmp) || name == path.Base(p.indexFileName()) {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+//copyRecords writes all records of src to dst in order. Files sealed on dst get modification time of src file
+//having their newest record, so retention by age is not reset
+func copyRecords(dst *FileStorage, src *FileStorage) error {
+	cursor, errCursor := src.NewCursor()
+	if errCursor != nil {
+		return errCursor
+	}
+	rpf := src.conf.recordsPerFile()
+	buf := make([]byte, MIGRATEBATCHRECORDS*src.RecordSize())
+	for {
+		batch := buf
+		if untilEnd := (rpf - cursor.Position()%rpf) * src.RecordSize(); untilEnd < int64(len(batch)) { //One src file per batch
+			batch = buf[:untilEnd]
+		}
+		n, errRead := cursor.Read(batch)
+		if 0 < n {
+			newest := int64(-1)
+			if 0 < len(dst.numbers) {
+				newest = dst.numbers[len(dst.numbers)-1]
+			}
+			if _, errWrite := dst.Write(batch[:n]); errWrite != nil {
+				return errWrite
+			}
+			srcName := src.conf.filename((cursor.Position() - 1) / rpf)
+			if !fileExists(srcName) {
+				srcName = src.conf.BaseFileName()
+			}
+			for _, fileNumber := range dst.numbers {
+				if newest < fileNumber {
+					if errTime := keepModTime(dst.conf.filename(fileNumber), srcName); errTime != nil {
+						return errTime
+					}
+				}
+			}
+		}
+		if errRead == io.EOF {
+			return nil
+		}
+		if errRead != nil {
+			return errRead
+		}
+	}
+}
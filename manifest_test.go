@@ -0,0 +1,191 @@
+package fixregsto
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestMismatch(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "manifested",
+		RecordSize:   8,
+		MaxFileCount: 10,
+		FileMaxSize:  64,
+		Path:         TMPTESTDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 0, 20)
+	assert.Equal(t, nil, fl.Close())
+	manifest, errManifest := cfg.ReadManifest()
+	assert.Equal(t, nil, errManifest)
+	assert.Equal(t, cfg.Layout(), manifest.Layout)
+
+	for _, change := range []func(*FileStorageConf){
+		func(c *FileStorageConf) { c.FileMaxSize = 128 },
+		func(c *FileStorageConf) { c.MaxFileCount = 2 },
+		func(c *FileStorageConf) { c.BitSlices = []int{32, 32} },
+		func(c *FileStorageConf) { c.FieldTransforms = []string{TRANSFORM_DELTA} },
+		func(c *FileStorageConf) { c.CompressionMethod = "xortest" },
+	} {
+		changed := cfg
+		change(&changed)
+		_, errOpen := changed.InitFileStorage()
+		assert.True(t, errors.Is(errOpen, ErrLayoutMismatch), "%v", errOpen)
+		changed.ReadOnly = true
+		_, errOpen = changed.InitFileStorage()
+		assert.True(t, errors.Is(errOpen, ErrLayoutMismatch), "%v", errOpen)
+	}
+
+	//Compatible changes are accepted and written to manifest
+	changed := cfg
+	changed.CompressionMethod = COMPRESSIONMETHOD_GZ
+	fl, flErr = changed.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, nil, fl.Close())
+	changed.Framed = true
+	fl, flErr = changed.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 20, 10)
+	expected, _ := fl.ReadAll()
+	assert.Equal(t, nil, fl.Close())
+	manifest, _ = cfg.ReadManifest()
+	assert.True(t, manifest.Layout.UnframedFiles)
+
+	changed.BitSlices = []int{32, 32} //Unframed files are still there
+	_, flErr = changed.InitFileStorage()
+	assert.True(t, errors.Is(flErr, ErrLayoutMismatch))
+	framedCfg := changed
+	framedCfg.BitSlices = nil
+	assert.Equal(t, nil, Migrate(framedCfg, framedCfg))
+
+	changed.CompressionMethod = "" //Headers of framed files tell coding
+	fl, flErr = changed.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 30, 10)
+	all, errAll := fl.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, expected, all[:30*8])
+	assert.Equal(t, 40*8, len(all))
+	assert.Equal(t, nil, fl.Close())
+	manifest, _ = cfg.ReadManifest()
+	assert.Equal(t, changed.Layout(), manifest.Layout)
+
+	changed.Framed = false //Framed files can not be read as unframed
+	_, flErr = changed.InitFileStorage()
+	assert.True(t, errors.Is(flErr, ErrLayoutMismatch))
+}
+
+func TestMigrate(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	oldCfg := FileStorageConf{
+		Name:         "manifested",
+		RecordSize:   8,
+		MaxFileCount: 10,
+		FileMaxSize:  64,
+		Path:         TMPTESTDIR,
+		BitSlices:    []int{16, 16, 32},
+	}
+	fl, flErr := oldCfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 0, 8*7+3)
+	expected, _ := fl.ReadAll()
+	assert.Equal(t, nil, fl.Close())
+	sealedAt := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	for fileNumber := int64(0); fileNumber < 7; fileNumber++ {
+		modTime := sealedAt.Add(time.Duration(fileNumber) * time.Hour)
+		assert.Equal(t, nil, os.Chtimes(oldCfg.filename(fileNumber), modTime, modTime))
+	}
+
+	newCfg := FileStorageConf{
+		Name:              "manifested",
+		RecordSize:        8,
+		MaxFileCount:      10,
+		FileMaxSize:       8 * 20,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		FieldTransforms:   []string{TRANSFORM_DELTA},
+		BitSlices:         []int{64},
+		Indexed:           true,
+	}
+	_, flErr = newCfg.InitFileStorage()
+	assert.True(t, errors.Is(flErr, ErrLayoutMismatch))
+
+	assert.Equal(t, nil, Migrate(oldCfg, newCfg))
+	assert.False(t, fileExists(oldCfg.filename(3)))
+	_, errStaging := os.Stat(oldCfg.stagingDir())
+	assert.True(t, os.IsNotExist(errStaging))
+	_, flErr = oldCfg.InitFileStorage()
+	assert.True(t, errors.Is(flErr, ErrLayoutMismatch))
+	fl, flErr = newCfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.True(t, fl.RecoveryReport().String() == "clean")
+	all, errAll := fl.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, expected, all)
+	assert.Equal(t, 2, len(fl.Index()))
+	assert.Equal(t, nil, fl.Close())
+	for fileNumber, oldNumber := range []int64{2, 4} { //Newest record of file comes from this old file
+		info, _ := os.Stat(newCfg.filename(int64(fileNumber)))
+		assert.True(t, info.ModTime().Equal(sealedAt.Add(time.Duration(oldNumber)*time.Hour)), "file %v", fileNumber)
+	}
+
+	assert.Equal(t, nil, Migrate(oldCfg, newCfg)) //Done already
+	assert.NotEqual(t, nil, Migrate(oldCfg, FileStorageConf{Name: "other", RecordSize: 8, FileMaxSize: 64, Path: TMPTESTDIR}))
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	oldCfg := FileStorageConf{
+		Name:         "manifested",
+		RecordSize:   8,
+		MaxFileCount: 10,
+		FileMaxSize:  64,
+		Path:         TMPTESTDIR,
+	}
+	fl, flErr := oldCfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 0, 8*5+3)
+	expected, _ := fl.ReadAll()
+	newCfg := oldCfg
+	newCfg.FileMaxSize = 8 * 16
+	newCfg.Framed = true
+
+	//Power cut before commit, old storage stays
+	_, errStage := stageMigration(&fl, newCfg)
+	assert.Equal(t, nil, errStage)
+	assert.Equal(t, nil, fl.Close())
+	fl, flErr = oldCfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	all, _ := fl.ReadAll()
+	assert.Equal(t, expected, all)
+
+	//Power cut after commit when some files are moved
+	migration, errStage := stageMigration(&fl, newCfg)
+	assert.Equal(t, nil, errStage)
+	assert.Equal(t, []string{"manifested", "manifested_0", "manifested_1"}, migration.Files)
+	assert.Equal(t, nil, oldCfg.writeManifest(Manifest{Layout: oldCfg.Layout(), Migration: &migration}))
+	assert.Equal(t, nil, os.Rename(path.Join(oldCfg.stagingDir(), "manifested_0"), oldCfg.filename(0)))
+	assert.Equal(t, nil, fl.Close())
+
+	roCfg := newCfg
+	roCfg.ReadOnly = true
+	_, errRo := roCfg.InitFileStorage()
+	assert.True(t, errors.Is(errRo, ErrLayoutMismatch))
+
+	fl, flErr = newCfg.InitFileStorage() //Completes migration
+	assert.Equal(t, nil, flErr)
+	all, _ = fl.ReadAll()
+	assert.Equal(t, expected, all)
+	assert.False(t, fileExists(oldCfg.filename(2)))
+	assert.Equal(t, nil, fl.Close())
+	manifest, _ := newCfg.ReadManifest()
+	assert.Equal(t, (*Migration)(nil), manifest.Migration)
+	assert.Equal(t, newCfg.Layout(), manifest.Layout)
+}
@@ -0,0 +1,92 @@
+/*
+Simulated EEPROM for testing EepromStorage without hardware.
+Behaves like real page write EEPROM: write crossing page boundary wraps to start of same page.
+Supports fault injection for torn writes and bit flips
+*/
+package fixregsto
+
+import (
+	"errors"
+	"fmt"
+)
+
+//ErrInjectedFault is returned from MemEeprom write that was torn on purpose
+var ErrInjectedFault = errors.New("injected fault, write torn")
+
+//MemEeprom is in-memory ByteDevice
+type MemEeprom struct {
+	mem         []byte
+	pageSize    int64
+	writeCycles int64
+
+	PageWrites []int64 //How many times each page is written, for checking wear
+
+	tearAfter int64 //Bytes written before tearing, -1 disabled
+}
+
+//NewMemEeprom creates erased (0xFF) eeprom
+func NewMemEeprom(size int64, pageSize int64, writeCycles int64) *MemEeprom {
+	result := MemEeprom{
+		mem:         make([]byte, size),
+		pageSize:    pageSize,
+		writeCycles: writeCycles,
+		PageWrites:  make([]int64, (size+pageSize-1)/pageSize),
+		tearAfter:   -1,
+	}
+	for i := range result.mem {
+		result.mem[i] = 0xFF
+	}
+	return &result
+}
+
+func (p *MemEeprom) PageSize() int64 {
+	return p.pageSize
+}
+
+func (p *MemEeprom) Size() int64 {
+	return int64(len(p.mem))
+}
+
+func (p *MemEeprom) WriteCycles() int64 {
+	return p.writeCycles
+}
+
+func (p *MemEeprom) ReadAt(arr []byte, off int64) (int, error) {
+	if off < 0 || int64(len(p.mem)) < off+int64(len(arr)) {
+		return 0, fmt.Errorf("read %v bytes at %v is outside of eeprom size %v", len(arr), off, len(p.mem))
+	}
+	return copy(arr, p.mem[off:]), nil
+}
+
+//WriteAt writes inside one page. Like on real device, address wraps to start of page if write goes over page boundary
+func (p *MemEeprom) WriteAt(arr []byte, off int64) (int, error) {
+	if off < 0 || int64(len(p.mem)) <= off {
+		return 0, fmt.Errorf("write at %v is outside of eeprom size %v", off, len(p.mem))
+	}
+	if p.pageSize < int64(len(arr)) {
+		return 0, fmt.Errorf("write of %v bytes is over page size %v", len(arr), p.pageSize)
+	}
+	pageStart := off - off%p.pageSize
+	p.PageWrites[pageStart/p.pageSize]++
+	for i, b := range arr {
+		if p.tearAfter == 0 {
+			p.tearAfter = -1
+			return i, ErrInjectedFault
+		}
+		if 0 < p.tearAfter {
+			p.tearAfter--
+		}
+		p.mem[pageStart+(off-pageStart+int64(i))%p.pageSize] = b
+	}
+	return len(arr), nil
+}
+
+//TearNextWrite makes write fail after n more bytes are written. Simulates power cut during write
+func (p *MemEeprom) TearNextWrite(n int64) {
+	p.tearAfter = n
+}
+
+//FlipBit inverts one bit on memory. Simulates bit rot
+func (p *MemEeprom) FlipBit(off int64, bit uint) {
+	p.mem[off] ^= 1 << bit
+}
@@ -4,28 +4,60 @@ package fixregsto
 
 import (
 	"fmt"
-	"io"
+	"sync"
 )
 
 type MemloopConf struct {
 	RecordSize int64 //One entry is this long
 	MaxRecords int64
+
+	Key KeyExtractor //Where sort key is in record. Required by SeekToKey and RangeByKey
 }
 
 type Memloop struct {
-	mem       []byte
-	conf      MemloopConf
-	readIndex int64 //index in mem where read was. Rotating memory also moves this index
+	mem     []byte
+	conf    MemloopConf
+	mu      *sync.RWMutex //Write locks, reads share
+	dropped int64         //How many records are rotated out. Keeps cursor positions valid over rotation
+	cursor  *Cursor       //Used by Read and Seek
+	changes *changeNotifier
+	closed  *closeState
 }
 
 func (p *MemloopConf) InitMemLoop() (Memloop, error) {
 	return Memloop{
-		mem:       make([]byte, 0),
-		conf:      *p,
-		readIndex: 0,
+		mem:     make([]byte, 0),
+		conf:    *p,
+		mu:      &sync.RWMutex{},
+		cursor:  &Cursor{},
+		changes: newChangeNotifier(),
+		closed:  &closeState{},
 	}, nil
 }
 
+//Flush does nothing, memory is not buffered. Implements Flusher
+func (p *Memloop) Flush() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+//Close frees memory and stops followers
+func (p *Memloop) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return ErrClosed
+	}
+	p.closed.closed = true
+	p.mem = nil
+	p.changes.notify()
+	return nil
+}
+
 //size must be recordsize*N
 func (p *Memloop) Write(raw []byte) (n int, err error) {
 	if len(raw)%int(p.conf.RecordSize) != 0 {
@@ -35,17 +67,29 @@ func (p *Memloop) Write(raw []byte) (n int, err error) {
 	if maxSize < len(raw) {
 		return 0, fmt.Errorf("Appended data length %v is over memory size %v", len(raw), maxSize)
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return 0, ErrClosed
+	}
+	defer p.changes.notify()
 	p.mem = append(p.mem, raw...)
 
 	if len(p.mem) <= maxSize {
 		return len(raw), nil
 	}
 	//Just cut?
+	p.dropped += int64(len(p.mem)-maxSize) / p.conf.RecordSize
 	p.mem = p.mem[len(p.mem)-maxSize : len(p.mem)]
 	return len(raw), nil
 }
 
 func (p *Memloop) Len() (int64, error) { //Number of records
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return 0, ErrClosed
+	}
 	if p.mem == nil {
 		return 0, fmt.Errorf("mem is nil")
 	}
@@ -53,85 +97,85 @@ func (p *Memloop) Len() (int64, error) { //Number of records
 }
 
 func (p *Memloop) GetLatest(nRecords int64) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
 	firstIndex := int64(len(p.mem)) - nRecords*p.conf.RecordSize
 	if firstIndex < 0 {
 		firstIndex = 0
 	}
-	return p.mem[firstIndex:len(p.mem)], nil
+	return append([]byte{}, p.mem[firstIndex:len(p.mem)]...), nil
 }
 
 func (p *Memloop) GetFirst(nRecords int64) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
 	n := int(nRecords * p.conf.RecordSize)
 	if len(p.mem) < n {
 		n = len(p.mem)
 	}
-	return p.mem[0:n], nil
+	return append([]byte{}, p.mem[0:n]...), nil
 }
 
 //ReadAll gets all content. Use with caution, small storages
 func (p *Memloop) ReadAll() ([]byte, error) {
-	return p.mem, nil
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
+	return append([]byte{}, p.mem...), nil
 }
 
 func (p *Memloop) Read(arr []byte) (n int, err error) {
-	if len(arr) < int(p.conf.RecordSize) { //Breaks read interface but it have to. Avoid io.ReadAll
-		//usually problem if non power of 2 record size and io.ReadAll kind of method
-		return 0, fmt.Errorf("Asked %v bytes, minimum record size is %v", len(arr), p.conf.RecordSize)
-	}
+	return p.cursor.readFrom(p, arr)
+}
 
-	if p.readIndex < 0 {
-		p.readIndex = 0
-	}
+//Seek position is in bytes and rounded down to record. SeekStart is relative to oldest record still in memory
+func (p *Memloop) Seek(offset int64, whence int) (int64, error) {
+	return p.cursor.readSeekFrom(p, offset, whence)
+}
 
-	maxRecords := int64(len(p.mem)) / p.conf.RecordSize
+//NewCursor creates independent reader at oldest record. Cursor refers to this Memloop, do not copy Memloop after that
+func (p *Memloop) NewCursor() (*Cursor, error) {
+	return newCursor(p)
+}
 
-	recordsNeeded := int64(len(arr)) / p.conf.RecordSize //rounded down
-	if maxRecords < recordsNeeded {
-		recordsNeeded = maxRecords
-	}
-	bytesNeeded := p.conf.RecordSize * recordsNeeded // return n is this or lower
+//RecordSize tells how long one record is in bytes
+func (p *Memloop) RecordSize() int64 {
+	return p.conf.RecordSize
+}
 
-	endIndex := bytesNeeded + p.readIndex + 1
-	if int64(len(p.mem)) < endIndex {
-		endIndex = int64(len(p.mem))
-	}
-	if endIndex <= p.readIndex {
-		return 0, io.EOF
+func (p *Memloop) positionRange() (int64, int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return 0, 0, ErrClosed
 	}
-
-	piece := p.mem[p.readIndex:endIndex]
-	/*	if len(piece) != int(bytesNeeded) {
-			return 0, fmt.Errorf("Internal error %v vs %v  (lenmem=%v readindex=%v endindex=%v)", len(piece), int(bytesNeeded), len(p.mem), p.readIndex, endIndex)
-		}
-	*/
-
-	written := copy(arr, piece)
-	p.readIndex += int64(written)
-	return written, nil
+	return p.dropped, p.dropped + int64(len(p.mem))/p.conf.RecordSize, nil
 }
 
-func (p *Memloop) Seek(offset int64, whence int) (int64, error) {
-	maxPosition := int64(len(p.mem)) / p.conf.RecordSize
-
-	off := p.conf.RecordSize * (offset / p.conf.RecordSize)
-
-	switch whence {
-	case io.SeekStart: // seek relative to the origin of the file
-		p.readIndex = off
-	case io.SeekCurrent: // seek relative to the current offset
-		p.readIndex += off
-	case io.SeekEnd: //seek relative to the end
-		p.readIndex = maxPosition + off
-	default:
-		return p.readIndex, fmt.Errorf("Whence %v unknow", whence)
+func (p *Memloop) readRecordsAt(position int64, maxRecords int64) ([]byte, int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.closed {
+		return nil, position, ErrClosed
 	}
-
-	if p.readIndex < 0 {
-		p.readIndex = 0
+	if position < p.dropped { //Rotated out
+		position = p.dropped
 	}
-
-	if maxPosition < p.readIndex {
-		p.readIndex = maxPosition
+	first := position - p.dropped
+	count := int64(len(p.mem))/p.conf.RecordSize - first
+	if maxRecords < count {
+		count = maxRecords
+	}
+	if count <= 0 {
+		return []byte{}, position, nil
 	}
-	return p.readIndex, nil
+	return append([]byte{}, p.mem[first*p.conf.RecordSize:(first+count)*p.conf.RecordSize]...), position + count, nil
 }
@@ -0,0 +1,277 @@
+/*
+Crash recovery for FileStorage.
+Power cut can happen between any two steps of copy on write, so leftovers are checked and fixed on init.
+Sealing records of work file writes seal mark name.seal with number of new file first and removes it after work
+file is removed, so work file left behind seal is recognized exactly, not by content or modification times
+*/
+package fixregsto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//RecoveryReport tells what recovery pass found and repaired on storage directory
+type RecoveryReport struct {
+	RolledForward    []string //_TMP files that were complete and renamed in place
+	RolledBack       []string //_TMP files that were incomplete or redundant and removed
+	TruncatedBytes   int64    //Bytes cut from end of work file because of partial record or torn append
+	CorruptedRecords int64    //Records dropped from framed work file because of CRC mismatch
+	DuplicateRecords int64    //Records dropped from work file because those were already sealed to numbered file
+	Removed          []string //Empty numbered files and files over MaxFileCount (by Rotation policy), empty lock file left by crash
+	Corrupted        []string //Numbered files that can not be decoded to complete records. Left in place
+	Gaps             []int64  //Missing file numbers between first and last numbered file
+	StaleLockPid     int      //Process that crashed while holding lock, lock was taken over. 0 none
+}
+
+//Clean tells that nothing had to be done
+func (p *RecoveryReport) Clean() bool {
+	return len(p.RolledForward) == 0 && len(p.RolledBack) == 0 && p.TruncatedBytes == 0 && p.CorruptedRecords == 0 && p.DuplicateRecords == 0 &&
+		len(p.Removed) == 0 && len(p.Corrupted) == 0 && len(p.Gaps) == 0 && p.StaleLockPid == 0
+}
+
+func (p RecoveryReport) String() string {
+	if p.Clean() {
+		return "clean"
+	}
+	return fmt.Sprintf("rolledForward=%v rolledBack=%v truncatedBytes=%v corruptedRecords=%v duplicateRecords=%v removed=%v corrupted=%v gaps=%v staleLockPid=%v",
+		p.RolledForward, p.RolledBack, p.TruncatedBytes, p.CorruptedRecords, p.DuplicateRecords, p.Removed, p.Corrupted, p.Gaps, p.StaleLockPid)
+}
+
+//parseStorageFileName splits name under storage to file number and tmp flag. Work file is number -1
+func (p *FileStorageConf) parseStorageFileName(name string) (int64, bool, bool) {
+	if name == p.Name {
+		return -1, false, true
+	}
+	if name == p.Name+"_TMP" {
+		return -1, true, true
+	}
+	prefix := p.Name + "_"
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false, false
+	}
+	s := strings.TrimPrefix(name, prefix)
+	isTmp := strings.HasSuffix(s, "_TMP")
+	s = strings.TrimSuffix(s, "_TMP")
+	n, parseErr := strconv.ParseInt(s, 10, 64)
+	if parseErr != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, isTmp, true
+}
+
+//Recover checks storage files on disk and fixes what power cut or crash have left behind.
+//InitFileStorage calls this. Call directly only when storage is not in use
+func (p *FileStorageConf) Recover() (RecoveryReport, error) {
+	report := RecoveryReport{}
+	fEntries, errDir := os.ReadDir(p.Path)
+	if errDir != nil {
+		return report, errDir
+	}
+
+	sealedSize := p.recordsPerFile() * p.RecordSize
+	workTmp := false
+	sealedTmps := []int64{}
+	for _, entry := range fEntries {
+		if entry.IsDir() {
+			continue
+		}
+		n, isTmp, ok := p.parseStorageFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		if !isTmp {
+			fInfo, errInfo := entry.Info()
+			if errInfo != nil {
+				return report, errInfo
+			}
+			if 0 <= n && fInfo.Size() == 0 { //Sealed files are never empty
+				fname := p.filename(n)
+				if errRemove := os.Remove(fname); errRemove != nil {
+					return report, fmt.Errorf("error removing %v err=%v", fname, errRemove)
+				}
+				report.Removed = append(report.Removed, fname)
+			}
+			continue
+		}
+		if n < 0 {
+			workTmp = true
+		} else {
+			sealedTmps = append(sealedTmps, n)
+		}
+	}
+
+	//Sealed file was written to _TMP but not renamed. Roll forward only if content is complete
+	for _, n := range sealedTmps {
+		target := p.filename(n)
+		tmpName := target + "_TMP"
+		if !fileExists(target) {
+			content, errRead := p.readSealedFile(tmpName)
+			if errRead == nil && int64(len(content)) == sealedSize {
+				if errRename := os.Rename(tmpName, target); errRename != nil {
+					return report, fmt.Errorf("error renaming %v err=%v", tmpName, errRename)
+				}
+				report.RolledForward = append(report.RolledForward, tmpName)
+				continue
+			}
+		}
+		if errRemove := os.Remove(tmpName); errRemove != nil {
+			return report, fmt.Errorf("error removing %v err=%v", tmpName, errRemove)
+		}
+		report.RolledBack = append(report.RolledBack, tmpName)
+	}
+
+	workfile := p.BaseFileName()
+	//Work file _TMP. Accept when it only appends complete records to current work file
+	if workTmp {
+		tmpName := workfile + "_TMP"
+		tmpRaw, errTmp := os.ReadFile(tmpName)
+		if errTmp != nil {
+			return report, errTmp
+		}
+		tmpContent, errDecode := p.decodeWorkContent(tmpRaw)
+		accept := errDecode == nil && 0 < len(tmpContent) && int64(len(tmpContent))%p.RecordSize == 0
+		if accept && fileExists(workfile) {
+			workContent, errWork := p.readWorkFile()
+			accept = errWork == nil && len(workContent) < len(tmpContent) && bytes.HasPrefix(tmpContent, workContent)
+		}
+		if accept {
+			if errRename := os.Rename(tmpName, workfile); errRename != nil {
+				return report, fmt.Errorf("error renaming %v err=%v", tmpName, errRename)
+			}
+			report.RolledForward = append(report.RolledForward, tmpName)
+		} else {
+			if errRemove := os.Remove(tmpName); errRemove != nil {
+				return report, fmt.Errorf("error removing %v err=%v", tmpName, errRemove)
+			}
+			report.RolledBack = append(report.RolledBack, tmpName)
+		}
+	}
+
+	//Check every numbered file against record size
+	minFileNumber, maxFileNumber, _, errRange := p.GetNumberRangeOnDisk()
+	if errRange != nil {
+		return report, errRange
+	}
+	existing := []int64{}
+	for fileNumber := minFileNumber; 0 <= fileNumber && fileNumber <= maxFileNumber; fileNumber++ {
+		if !fileExists(p.filename(fileNumber)) {
+			continue
+		}
+		existing = append(existing, fileNumber)
+		content, errRead := p.ReadFileWithNumber(fileNumber)
+		if errRead != nil || int64(len(content))%p.RecordSize != 0 || len(content) == 0 {
+			report.Corrupted = append(report.Corrupted, p.filename(fileNumber))
+		}
+	}
+
+	//Work file. Partial record at end is torn write. Work file left behind sealing is duplicate
+	stale, errStale := p.staleWork()
+	if errStale != nil {
+		return report, errStale
+	}
+	_, errWorkStat := os.Stat(workfile)
+	if errWorkStat == nil {
+		workRaw, errRaw := os.ReadFile(workfile)
+		if errRaw != nil {
+			return report, errRaw
+		}
+		if isAppendWork(workRaw) { //Torn append, cut to last complete entry
+			if _, valid, errDecode := decodeAppendWork(workRaw, p.RecordSize); errDecode == nil && valid < int64(len(workRaw)) {
+				if errTruncate := p.truncateWorkFile(valid); errTruncate != nil {
+					return report, errTruncate
+				}
+				report.TruncatedBytes = int64(len(workRaw)) - valid
+			}
+		}
+		rewrite := 0 < len(workRaw) && p.appendWork() != isAppendWork(workRaw) //Convert to configured format
+		workContent, errWork := p.readWorkFile()
+		var corruptErr *CorruptedError
+		if errors.As(errWork, &corruptErr) {
+			report.Corrupted = append(report.Corrupted, workfile)
+			report.CorruptedRecords = int64(len(corruptErr.Records))
+			rewrite = true
+		} else if errWork != nil {
+			return report, errWork
+		}
+		extra := int64(len(workContent)) % p.RecordSize
+		if 0 < extra {
+			workContent = workContent[0 : int64(len(workContent))-extra]
+			report.TruncatedBytes = extra
+			rewrite = true
+		}
+		if rewrite {
+			if errWrite := p.writeWorkFile(workContent, true); errWrite != nil {
+				return report, errWrite
+			}
+		}
+		if stale {
+			if errRemove := os.Remove(workfile); errRemove != nil {
+				return report, fmt.Errorf("error removing %v err=%v", workfile, errRemove)
+			}
+			report.DuplicateRecords = int64(len(workContent)) / p.RecordSize
+		}
+	} else if !os.IsNotExist(errWorkStat) {
+		return report, errWorkStat
+	}
+	if errMark := p.unmarkSeal(); errMark != nil { //Left by power cut during seal
+		return report, errMark
+	}
+
+	//Write removes oldest file after sealing new. Finish that if crash happened in between. Unconsumed file goes by Rotation
+	for 0 < p.MaxFileCount && p.MaxFileCount < int64(len(existing)) {
+		fname := p.filename(existing[0])
+		if _, _, errRotate := p.rotateFile(existing[0]); errRotate != nil {
+			return report, fmt.Errorf("error removing %v err=%v", fname, errRotate)
+		}
+		report.Removed = append(report.Removed, fname)
+		existing = existing[1:]
+	}
+
+	for i := 1; i < len(existing); i++ {
+		for missing := existing[i-1] + 1; missing < existing[i]; missing++ {
+			report.Gaps = append(report.Gaps, missing)
+		}
+	}
+	return report, nil
+}
+
+//sealMarkFileName is file telling number of file being sealed from work file records
+func (p *FileStorageConf) sealMarkFileName() string {
+	return p.BaseFileName() + ".seal"
+}
+
+//markSeal is written before work file records are sealed to numbered file. Removed after work file is removed
+func (p *FileStorageConf) markSeal(fileNumber int64) error {
+	_, errWrite := writeWithFsyncCow(p.sealMarkFileName(), []byte(strconv.FormatInt(fileNumber, 10)))
+	return errWrite
+}
+
+func (p *FileStorageConf) unmarkSeal() error {
+	errRemove := os.Remove(p.sealMarkFileName())
+	if os.IsNotExist(errRemove) {
+		return nil
+	}
+	return errRemove
+}
+
+//staleWork tells that work file records are already sealed. Seal mark exists and its file is complete, so
+//work file was not removed yet. Numbered files are renamed in place only when complete
+func (p *FileStorageConf) staleWork() (bool, error) {
+	content, errRead := os.ReadFile(p.sealMarkFileName())
+	if os.IsNotExist(errRead) {
+		return false, nil
+	}
+	if errRead != nil {
+		return false, errRead
+	}
+	fileNumber, errParse := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if errParse != nil { //Keep work file, records are not lost on invalid mark
+		return false, nil
+	}
+	return fileExists(p.filename(fileNumber)), nil
+}
@@ -0,0 +1,157 @@
+package fixregsto
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TMPRECOVERYDIR = "/tmp/recoverytest12356789"
+)
+
+func TestRecoveryClean(t *testing.T) {
+	os.RemoveAll(TMPRECOVERYDIR)
+	cfg := FileStorageConf{
+		Name:         "recovery",
+		RecordSize:   4,
+		MaxFileCount: 3,
+		FileMaxSize:  16,
+		Path:         TMPRECOVERYDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	report := fl.RecoveryReport()
+	assert.True(t, report.Clean())
+
+	for i := 0; i < 6; i++ {
+		_, errWrite := fl.Write([]byte{byte(i), byte(i), byte(i), byte(i)})
+		assert.Equal(t, nil, errWrite)
+	}
+	report, errRecover := cfg.Recover()
+	assert.Equal(t, nil, errRecover)
+	assert.True(t, report.Clean(), report.String())
+}
+
+func TestRecoveryLeftovers(t *testing.T) {
+	os.RemoveAll(TMPRECOVERYDIR)
+	cfg := FileStorageConf{
+		Name:         "recovery",
+		RecordSize:   4,
+		MaxFileCount: 3,
+		FileMaxSize:  16,
+		Path:         TMPRECOVERYDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, errWrite := fl.Write([]byte{1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5})
+	assert.Equal(t, nil, errWrite)
+
+	//Power cut after sealing _1 to tmp, old work file still present
+	assert.Equal(t, nil, cfg.markSeal(1))
+	sealed := []byte{5, 5, 5, 5, 6, 6, 6, 6, 7, 7, 7, 7, 8, 8, 8, 8}
+	assert.Equal(t, nil, os.WriteFile(cfg.filename(1)+"_TMP", sealed, 0755))
+	//Torn write of next work file
+	assert.Equal(t, nil, os.WriteFile(cfg.BaseFileName()+"_TMP", []byte{9, 9}, 0755))
+
+	_, _, count, errRange := cfg.GetNumberRangeOnDisk()
+	assert.Equal(t, nil, errRange)
+	assert.Equal(t, int64(1), count) //_TMP files are not storage files
+
+	assert.Equal(t, nil, fl.Close())
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	report := fl.RecoveryReport()
+	assert.Equal(t, []string{cfg.filename(1) + "_TMP"}, report.RolledForward)
+	assert.Equal(t, []string{cfg.BaseFileName() + "_TMP"}, report.RolledBack)
+	assert.Equal(t, int64(1), report.DuplicateRecords)
+	assert.False(t, fileExists(cfg.sealMarkFileName()))
+
+	all, errAll := fl.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, []byte{1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 6, 6, 6, 6, 7, 7, 7, 7, 8, 8, 8, 8}, all)
+}
+
+func TestRecoveryRepeatedRecordAfterSeal(t *testing.T) {
+	os.RemoveAll(TMPRECOVERYDIR)
+	cfg := FileStorageConf{
+		Name:         "recovery",
+		RecordSize:   4,
+		MaxFileCount: 3,
+		FileMaxSize:  16,
+		Path:         TMPRECOVERYDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, errWrite := fl.Write(make([]byte, 16))
+	assert.Equal(t, nil, errWrite)
+	_, errWrite = fl.Write(make([]byte, 4)) //Same as start of sealed file, written right after seal
+	assert.Equal(t, nil, errWrite)
+	sealedInfo, _ := os.Stat(cfg.filename(0))
+	assert.Equal(t, nil, os.Chtimes(cfg.BaseFileName(), sealedInfo.ModTime(), sealedInfo.ModTime())) //Coarse timestamps
+	assert.Equal(t, nil, fl.Close())
+
+	roCfg := cfg
+	roCfg.ReadOnly = true
+	ro, roErr := roCfg.InitFileStorage()
+	assert.Equal(t, nil, roErr)
+	n, errLen := ro.Len()
+	assert.Equal(t, nil, errLen)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, nil, ro.Close())
+
+	for i := 0; i < 2; i++ {
+		fl, flErr = cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		assert.Equal(t, int64(0), fl.RecoveryReport().DuplicateRecords)
+		n, errLen = fl.Len()
+		assert.Equal(t, nil, errLen)
+		assert.Equal(t, int64(5), n)
+		assert.Equal(t, nil, fl.Close())
+	}
+}
+
+func TestRecoveryTornWorkAndRotation(t *testing.T) {
+	os.RemoveAll(TMPRECOVERYDIR)
+	cfg := FileStorageConf{
+		Name:         "recovery",
+		RecordSize:   4,
+		MaxFileCount: 3,
+		FileMaxSize:  16,
+		Path:         TMPRECOVERYDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, errWrite := fl.Write(make([]byte, 16*3+4))
+	assert.Equal(t, nil, errWrite)
+
+	//Extra sealed file, rotation did not finish. Work file has partial record at end
+	assert.Equal(t, nil, os.WriteFile(cfg.filename(3), make([]byte, 16), 0755))
+	assert.Equal(t, nil, os.WriteFile(cfg.BaseFileName(), []byte{1, 2, 3, 4, 5, 6}, 0755))
+	assert.Equal(t, nil, os.WriteFile(cfg.filename(7), []byte{}, 0755))
+
+	assert.Equal(t, nil, fl.Close())
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	report := fl.RecoveryReport()
+	assert.Equal(t, int64(2), report.TruncatedBytes)
+	assert.Equal(t, []string{cfg.filename(7), cfg.filename(0)}, report.Removed)
+	assert.Equal(t, 0, len(report.Gaps))
+
+	latest, errLatest := fl.GetLatest(1)
+	assert.Equal(t, nil, errLatest)
+	assert.Equal(t, []byte{1, 2, 3, 4}, latest)
+
+	//Gap in numbering is reported and skipped on reads
+	assert.Equal(t, nil, os.Remove(cfg.filename(2)))
+	report, errRecover := cfg.Recover()
+	assert.Equal(t, nil, errRecover)
+	assert.Equal(t, []int64{2}, report.Gaps)
+	first, errFirst := fl.GetFirst(5)
+	assert.Equal(t, nil, errFirst)
+	assert.Equal(t, 20, len(first))
+	_, errSeek := fl.Seek(0, io.SeekStart)
+	assert.Equal(t, nil, errSeek)
+}
@@ -0,0 +1,172 @@
+/*
+Retention rules for FileStorage besides MaxFileCount. Oldest numbered files are removed while any rule is broken.
+Rules are checked after each sealed file and on Enforce. Files not consumed are spilled or counted, see rotation.go
+
+Age of file is age of its newest record. If KeyTimeUnit is set, Key of last record is unix time in that unit,
+otherwise modification time of file is used (file is sealed when its newest record is written).
+Recompression, Migrate and Restore keep modification times.
+Newest numbered file is always kept, numbering of next sealed file continues from it
+*/
+package fixregsto
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+//RetentionPolicy tells when old files are removed. Zero values are not used
+type RetentionPolicy struct {
+	MaxAge       time.Duration //Files having newest record older than this are removed
+	MaxBytes     int64         //Total bytes of storage files on disk, work file included
+	MinFreeBytes int64         //Free space wanted on filesystem. Requires linux
+	KeyTimeUnit  time.Duration //Key is unix time in this unit, like time.Millisecond. Zero uses file modification time
+}
+
+//CheckErrors tells is policy usable with key
+func (p *RetentionPolicy) CheckErrors(key KeyExtractor) error {
+	if p.MaxAge < 0 || p.MaxBytes < 0 || p.MinFreeBytes < 0 || p.KeyTimeUnit < 0 {
+		return fmt.Errorf("Invalid retention %#v", *p)
+	}
+	if 0 < p.KeyTimeUnit && key.Width == 0 {
+		return fmt.Errorf("Retention KeyTimeUnit requires Key")
+	}
+	return nil
+}
+
+func (p *RetentionPolicy) enabled() bool {
+	return 0 < p.MaxAge || 0 < p.MaxBytes || 0 < p.MinFreeBytes
+}
+
+//Enforce removes files breaking retention rules now. Returns removed filenames
+func (p *FileStorage) Enforce() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.closed {
+		return nil, ErrClosed
+	}
+	if p.conf.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	return p.enforceLocked()
+}
+
+//enforceLocked removes oldest files while retention is broken. Caller holds write lock
+func (p *FileStorage) enforceLocked() ([]string, error) {
+	policy := p.conf.Retention
+	if !policy.enabled() {
+		return nil, nil
+	}
+	totalBytes := int64(0)
+	sizes := make(map[int64]int64)
+	if 0 < policy.MaxBytes {
+		var errSizes error
+		totalBytes, errSizes = p.storedBytes(sizes)
+		if errSizes != nil {
+			return nil, errSizes
+		}
+	}
+	candidates := p.numbers
+	if 0 < len(candidates) {
+		candidates = candidates[:len(candidates)-1] //Newest is kept
+	}
+	removed := []string{}
+	removedNumbers := make(map[int64]bool)
+	var errEnforce error
+	for _, fileNumber := range candidates {
+		expired, errExpired := p.retentionBroken(fileNumber, totalBytes)
+		if errExpired != nil {
+			errEnforce = errExpired
+			break
+		}
+		if !expired {
+			break
+		}
+		fname := p.conf.filename(fileNumber)
+		if errRemove := p.rotate(fileNumber); errRemove != nil && !os.IsNotExist(errRemove) {
+			errEnforce = fmt.Errorf("Error removing %v on retention err=%v", fname, errRemove)
+			break
+		}
+		removed = append(removed, fname)
+		removedNumbers[fileNumber] = true
+		totalBytes -= sizes[fileNumber]
+		p.cache.remove(fileNumber)
+	}
+	for fileNumber := range removedNumbers {
+		p.forgetFile(fileNumber)
+	}
+	if errIndex := p.dropIndexEntries(removedNumbers); errIndex != nil && errEnforce == nil {
+		errEnforce = errIndex
+	}
+	return removed, errEnforce
+}
+
+//retentionBroken tells should oldest file be removed
+func (p *FileStorage) retentionBroken(fileNumber int64, totalBytes int64) (bool, error) {
+	policy := p.conf.Retention
+	if 0 < policy.MaxBytes && policy.MaxBytes < totalBytes {
+		return true, nil
+	}
+	if 0 < policy.MinFreeBytes {
+		free, errFree := freeBytes(p.conf.Path)
+		if errFree != nil {
+			return false, errFree
+		}
+		if free < policy.MinFreeBytes {
+			return true, nil
+		}
+	}
+	if 0 < policy.MaxAge {
+		newest, errNewest := p.newestRecordTime(fileNumber)
+		if errNewest != nil {
+			return false, errNewest
+		}
+		return newest.Before(time.Now().Add(-policy.MaxAge)), nil
+	}
+	return false, nil
+}
+
+//newestRecordTime is time of last record on file, from key or from modification time
+func (p *FileStorage) newestRecordTime(fileNumber int64) (time.Time, error) {
+	unit := p.conf.Retention.KeyTimeUnit
+	if 0 < unit {
+		for _, entry := range p.index.entries {
+			if entry.FileNumber == fileNumber && 0 < entry.RecordCount {
+				return time.Unix(0, 0).Add(time.Duration(entry.LastKey) * unit), nil
+			}
+		}
+		records, errRead := p.fileRecords(fileNumber)
+		if errRead != nil {
+			return time.Time{}, errRead
+		}
+		if p.conf.RecordSize <= int64(len(records)) {
+			key := p.conf.Key.Key(records[int64(len(records))-p.conf.RecordSize:])
+			return time.Unix(0, 0).Add(time.Duration(key) * unit), nil
+		}
+	}
+	info, errStat := os.Stat(p.conf.filename(fileNumber))
+	if errStat != nil {
+		return time.Time{}, errStat
+	}
+	return info.ModTime(), nil
+}
+
+//storedBytes sums sizes of numbered files and work file. Sizes of numbered files are put to sizes
+func (p *FileStorage) storedBytes(sizes map[int64]int64) (int64, error) {
+	total := int64(0)
+	for _, fileNumber := range p.numbers {
+		info, errStat := os.Stat(p.conf.filename(fileNumber))
+		if os.IsNotExist(errStat) {
+			continue
+		}
+		if errStat != nil {
+			return 0, errStat
+		}
+		sizes[fileNumber] = info.Size()
+		total += info.Size()
+	}
+	if info, errStat := os.Stat(p.conf.BaseFileName()); errStat == nil {
+		total += info.Size()
+	}
+	return total, nil
+}
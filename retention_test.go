@@ -0,0 +1,142 @@
+package fixregsto
+
+import (
+	"encoding/binary"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionBytes(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "retained",
+		RecordSize:   8,
+		MaxFileCount: 100,
+		FileMaxSize:  64,
+		Path:         TMPTESTDIR,
+		Retention:    RetentionPolicy{MaxBytes: 200},
+	}
+	assert.Equal(t, nil, cfg.CheckErrors())
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	writeCounters(t, &fl, 0, 8*10+2) //Seals keep 3 files, work file is written after sealing
+	assert.Equal(t, []int64{7, 8, 9}, fl.numbers)
+
+	removed, errEnforce := fl.Enforce()
+	assert.Equal(t, nil, errEnforce)
+	assert.Equal(t, []string{cfg.filename(7)}, removed)
+	n, _ := fl.Len()
+	assert.Equal(t, int64(8*2+2), n)
+	first, _ := fl.GetFirst(1)
+	assert.Equal(t, uint64(8*8), binary.LittleEndian.Uint64(first))
+}
+
+func TestRetentionAge(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "retained",
+		RecordSize:   8,
+		MaxFileCount: 100,
+		FileMaxSize:  64,
+		Path:         TMPTESTDIR,
+		Retention:    RetentionPolicy{MaxAge: time.Hour},
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	writeCounters(t, &fl, 0, 8*4+1)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, fileNumber := range []int64{0, 1, 3} {
+		assert.Equal(t, nil, os.Chtimes(cfg.filename(fileNumber), old, old))
+	}
+	removed, errEnforce := fl.Enforce()
+	assert.Equal(t, nil, errEnforce)
+	assert.Equal(t, []string{cfg.filename(0), cfg.filename(1)}, removed)
+
+	assert.Equal(t, nil, os.Chtimes(cfg.filename(2), old, old))
+	removed, errEnforce = fl.Enforce()
+	assert.Equal(t, nil, errEnforce)
+	assert.Equal(t, []string{cfg.filename(2)}, removed) //Newest is kept even if old
+	assert.Equal(t, []int64{3}, fl.numbers)
+}
+
+func TestRetentionKeyTime(t *testing.T) {
+	now := time.Now().Unix()
+	for _, indexed := range []bool{false, true} {
+		os.RemoveAll(TMPTESTDIR)
+		cfg := FileStorageConf{
+			Name:         "retained",
+			RecordSize:   8,
+			MaxFileCount: 100,
+			FileMaxSize:  64,
+			Path:         TMPTESTDIR,
+			Retention:    RetentionPolicy{MaxAge: 90 * 24 * time.Hour, KeyTimeUnit: time.Second},
+			Key:          KeyExtractor{Width: 8},
+			Indexed:      indexed,
+		}
+		assert.Equal(t, nil, cfg.CheckErrors())
+		fl, flErr := cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		records := make([]byte, 8*8*4)
+		for i := 0; i < 8*4; i++ {
+			age := int64(0)
+			if i < 8*2+4 { //Two full files and start of third are old
+				age = 100 * 24 * 3600
+			}
+			binary.LittleEndian.PutUint64(records[i*8:], uint64(now-age))
+		}
+		_, errWrite := fl.Write(records[:8*8*3]) //Third file has fresh records at end
+		assert.Equal(t, nil, errWrite)
+		assert.Equal(t, []int64{2}, fl.numbers)
+		_, errWrite = fl.Write(records[8*8*3:])
+		assert.Equal(t, nil, errWrite)
+		assert.Equal(t, []int64{2, 3}, fl.numbers)
+		if indexed {
+			assert.Equal(t, 2, len(fl.Index()))
+		}
+		assert.Equal(t, nil, fl.Close())
+	}
+
+	cfg := FileStorageConf{
+		Name:         "retained",
+		RecordSize:   8,
+		MaxFileCount: 100,
+		FileMaxSize:  64,
+		Path:         TMPTESTDIR,
+		Retention:    RetentionPolicy{KeyTimeUnit: time.Second},
+	}
+	assert.NotEqual(t, nil, cfg.CheckErrors())
+}
+
+func TestRetentionFreeSpace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("free space is available on linux")
+	}
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:         "retained",
+		RecordSize:   8,
+		MaxFileCount: 100,
+		FileMaxSize:  64,
+		Path:         TMPTESTDIR,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 0, 8*4)
+	assert.Equal(t, nil, fl.Close())
+
+	cfg.Retention.MinFreeBytes = 1 << 62 //Never enough
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	removed, errEnforce := fl.Enforce()
+	assert.Equal(t, nil, errEnforce)
+	assert.Equal(t, 3, len(removed))
+	writeCounters(t, &fl, 8*4, 8)
+	assert.Equal(t, []int64{4}, fl.numbers) //Numbering continues
+}
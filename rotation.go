@@ -0,0 +1,209 @@
+/*
+Rotation policy of FileStorage. When MaxFileCount is reached, oldest file is removed on seal. If named consumer
+(see consumer.go) or shipper has not consumed all records of it, policy decides
+
+	delete  file is removed anyway and lost records are counted on RotationStatus (default)
+	refuse  Write returns ErrStorageFull before anything is written, until consumers commit
+	spill   file is moved to OverflowPath with copy of manifest, so overflow can be opened as read only storage
+
+Files removed by RetentionPolicy or by recovery over MaxFileCount are spilled or counted same way. Those are not
+refused, refuse counts those as lost. Lost records are kept on file name.lost, so count survives restart
+*/
+package fixregsto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	ROTATION_DELETE = "delete"
+	ROTATION_REFUSE = "refuse"
+	ROTATION_SPILL  = "spill"
+)
+
+//ErrStorageFull is returned from Write when ROTATION_REFUSE would remove records consumer has not committed
+var ErrStorageFull = errors.New("storage is full of unconsumed records")
+
+//RotationPolicy tells what happens to oldest file having unconsumed records. Empty Mode is ROTATION_DELETE
+type RotationPolicy struct {
+	Mode         string
+	OverflowPath string //Directory where ROTATION_SPILL moves files
+}
+
+//RotationStatus counts unconsumed records that rotation has removed from storage
+type RotationStatus struct {
+	LostRecords  int64 //Deleted before consumers committed them, total over restarts
+	SpilledFiles int64 //Moved to OverflowPath after init
+}
+
+//CheckErrors tells is policy usable with storage on path
+func (p *RotationPolicy) CheckErrors(storagePath string) error {
+	switch p.Mode {
+	case "", ROTATION_DELETE, ROTATION_REFUSE:
+		return nil
+	case ROTATION_SPILL:
+		if len(p.OverflowPath) == 0 {
+			return fmt.Errorf("Spill rotation requires OverflowPath")
+		}
+		if path.Clean(p.OverflowPath) == path.Clean(storagePath) {
+			return fmt.Errorf("OverflowPath must be other directory than storage")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown rotation mode %v", p.Mode)
+}
+
+//RotationStatus tells how many unconsumed records are lost and how many files are spilled after init
+func (p *FileStorage) RotationStatus() RotationStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return *p.rotation
+}
+
+//unconsumedRecords tells how many records of file are not committed by slowest consumer
+func (p *FileStorageConf) unconsumedRecords(fileNumber int64) (int64, string, error) {
+	consumed, name, found, errConsumed := p.slowestConsumer()
+	if errConsumed != nil || !found {
+		return 0, name, errConsumed
+	}
+	rpf := p.recordsPerFile()
+	start := fileNumber * rpf
+	if consumed < start {
+		consumed = start
+	}
+	if end := start + rpf; consumed < end {
+		return end - consumed, name, nil
+	}
+	return 0, name, nil
+}
+
+func (p *FileStorageConf) lostRecordsFileName() string {
+	return p.BaseFileName() + ".lost"
+}
+
+//readLostRecords returns count of lost records kept on disk, 0 if none are lost
+func (p *FileStorageConf) readLostRecords() (int64, error) {
+	content, errRead := os.ReadFile(p.lostRecordsFileName())
+	if os.IsNotExist(errRead) {
+		return 0, nil
+	}
+	if errRead != nil {
+		return 0, errRead
+	}
+	n, errParse := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if errParse != nil {
+		return 0, fmt.Errorf("Invalid lost records count on %v err=%v", p.lostRecordsFileName(), errParse)
+	}
+	return n, nil
+}
+
+//addLostRecords adds count of lost records on disk
+func (p *FileStorageConf) addLostRecords(n int64) error {
+	lost, errLost := p.readLostRecords()
+	if errLost != nil {
+		return errLost
+	}
+	_, errWrite := writeWithFsyncCow(p.lostRecordsFileName(), []byte(strconv.FormatInt(lost+n, 10)))
+	return errWrite
+}
+
+//checkFull refuses write that would rotate out unconsumed records. Nothing is written when refused
+func (p *FileStorage) checkFull(newRecordCount int64) error {
+	if p.conf.Rotation.Mode != ROTATION_REFUSE {
+		return nil
+	}
+	rpf := p.conf.recordsPerFile()
+	seals := (int64(len(p.workBuffer))/p.conf.RecordSize + newRecordCount) / rpf
+	removals := int64(len(p.numbers)) + seals - p.conf.MaxFileCount
+	if seals < removals {
+		removals = seals //One file is removed per seal
+	}
+	if removals <= 0 {
+		return nil
+	}
+	var lastRemoved int64
+	if removals <= int64(len(p.numbers)) {
+		lastRemoved = p.numbers[removals-1]
+	} else { //Removes also files sealed on this write
+		newest := int64(-1)
+		if 0 < len(p.numbers) {
+			newest = p.numbers[len(p.numbers)-1]
+		}
+		lastRemoved = newest + removals - int64(len(p.numbers))
+	}
+	unconsumed, name, errUnconsumed := p.conf.unconsumedRecords(lastRemoved)
+	if errUnconsumed != nil {
+		return errUnconsumed
+	}
+	if 0 < unconsumed {
+		return fmt.Errorf("%w, consumer %v has not committed file %v", ErrStorageFull, name, lastRemoved)
+	}
+	return nil
+}
+
+//rotate removes file on rotation or retention and updates RotationStatus. Error of remove is returned as is
+func (p *FileStorage) rotate(fileNumber int64) error {
+	spilled, lost, errRotate := p.conf.rotateFile(fileNumber)
+	if spilled {
+		p.rotation.SpilledFiles++
+	}
+	p.rotation.LostRecords += lost
+	return errRotate
+}
+
+//rotateFile removes file on rotation, retention or recovery. Unconsumed file is spilled or its records are counted
+//as lost on disk. Tells was file spilled and how many records were lost. Error of remove is returned as is
+func (p *FileStorageConf) rotateFile(fileNumber int64) (bool, int64, error) {
+	unconsumed, _, errUnconsumed := p.unconsumedRecords(fileNumber)
+	if errUnconsumed != nil {
+		return false, 0, errUnconsumed
+	}
+	if 0 < unconsumed && p.Rotation.Mode == ROTATION_SPILL {
+		if errSpill := p.spill(fileNumber); errSpill != nil {
+			return false, 0, errSpill
+		}
+		return true, 0, nil
+	}
+	if errRemove := os.Remove(p.filename(fileNumber)); errRemove != nil {
+		return false, 0, errRemove
+	}
+	if unconsumed == 0 {
+		return false, 0, nil
+	}
+	return false, unconsumed, p.addLostRecords(unconsumed)
+}
+
+//spill moves numbered file to overflow directory. File is copied if directory is on other filesystem
+func (p *FileStorageConf) spill(fileNumber int64) error {
+	overflow := p.Rotation.OverflowPath
+	if errMkdir := os.MkdirAll(overflow, os.ModePerm); errMkdir != nil {
+		return errMkdir
+	}
+	manifestName := path.Join(overflow, path.Base(p.manifestFileName()))
+	if content, errManifest := os.ReadFile(p.manifestFileName()); errManifest == nil {
+		if _, errWrite := writeWithFsyncCow(manifestName, content); errWrite != nil {
+			return errWrite
+		}
+	}
+	filename := p.filename(fileNumber)
+	target := path.Join(overflow, path.Base(filename))
+	if errRename := os.Rename(filename, target); errRename == nil {
+		if errSync := syncDir(overflow); errSync != nil {
+			return errSync
+		}
+		return syncDir(p.Path)
+	}
+	content, errRead := os.ReadFile(filename)
+	if errRead != nil {
+		return errRead
+	}
+	if _, errWrite := writeWithFsyncCow(target, content); errWrite != nil {
+		return fmt.Errorf("Error spilling %v to %v err=%v", filename, overflow, errWrite)
+	}
+	return os.Remove(filename)
+}
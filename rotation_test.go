@@ -0,0 +1,207 @@
+package fixregsto
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotationDelete(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "audit",
+		RecordSize:        8,
+		MaxFileCount:      3,
+		FileMaxSize:       8 * 4,
+		Path:              path.Join(TMPTESTDIR, "audit"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	writeCounters(t, &fl, 0, 12)
+	consumer, errConsumer := fl.Consumer("uploader")
+	assert.Equal(t, nil, errConsumer)
+
+	writeCounters(t, &fl, 12, 4) //File 0 is removed before consumer got it
+	assert.Equal(t, RotationStatus{LostRecords: 4}, fl.RotationStatus())
+	buf := make([]byte, 8*4)
+	n, errRead := consumer.Read(buf)
+	assert.Equal(t, nil, errRead)
+	assert.Equal(t, counterRange(4, 4), buf[:n])
+	assert.Equal(t, nil, consumer.Commit())
+
+	writeCounters(t, &fl, 16, 4) //Consumed file 1 is removed without loss
+	assert.Equal(t, RotationStatus{LostRecords: 4}, fl.RotationStatus())
+
+	assert.Equal(t, nil, fl.RemoveConsumer("uploader"))
+	writeCounters(t, &fl, 20, 4)
+	assert.Equal(t, RotationStatus{LostRecords: 4}, fl.RotationStatus())
+
+	//Lost records are counted over restart
+	assert.Equal(t, nil, fl.Close())
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, RotationStatus{LostRecords: 4}, fl.RotationStatus())
+}
+
+func TestRotationRefuse(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "audit",
+		RecordSize:        8,
+		MaxFileCount:      3,
+		FileMaxSize:       8 * 4,
+		Path:              path.Join(TMPTESTDIR, "audit"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		Rotation:          RotationPolicy{Mode: ROTATION_REFUSE},
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	consumer, errConsumer := fl.Consumer("uploader")
+	assert.Equal(t, nil, errConsumer)
+
+	//Write sealing more files than MaxFileCount would remove its own files
+	n, errWrite := fl.Write(counterRange(0, 20))
+	assert.True(t, errors.Is(errWrite, ErrStorageFull))
+	assert.Equal(t, 0, n)
+	writeCounters(t, &fl, 0, 12)
+	expected, _ := fl.ReadAll()
+
+	n, errWrite = fl.Write(counterRange(12, 4))
+	assert.True(t, errors.Is(errWrite, ErrStorageFull))
+	assert.True(t, strings.Contains(errWrite.Error(), "uploader"))
+	assert.Equal(t, 0, n)
+	all, _ := fl.ReadAll()
+	assert.Equal(t, expected, all)
+	writeCounters(t, &fl, 12, 3) //Fits on work file
+	_, errWrite = fl.Write(counterRecord(15))
+	assert.True(t, errors.Is(errWrite, ErrStorageFull))
+
+	buf := make([]byte, 8*4)
+	_, errRead := consumer.Read(buf)
+	assert.Equal(t, nil, errRead)
+	assert.Equal(t, nil, consumer.Commit())
+	writeCounters(t, &fl, 15, 1) //File 0 is consumed
+	_, errWrite = fl.Write(counterRange(16, 8))
+	assert.True(t, errors.Is(errWrite, ErrStorageFull))
+	buf = make([]byte, 8*8)
+	_, errRead = consumer.Read(buf)
+	assert.Equal(t, nil, errRead)
+	assert.Equal(t, nil, consumer.Commit())
+	writeCounters(t, &fl, 16, 8)
+	assert.Equal(t, RotationStatus{}, fl.RotationStatus())
+
+	//Shipper checkpoint guards files too
+	assert.Equal(t, nil, fl.RemoveConsumer("uploader"))
+	writeCounters(t, &fl, 24, 4)
+	assert.Equal(t, nil, cfg.writeCheckpoint(fl.numbers[0]))
+	writeCounters(t, &fl, 28, 4)
+	_, errWrite = fl.Write(counterRange(32, 4))
+	assert.True(t, errors.Is(errWrite, ErrStorageFull))
+	assert.True(t, strings.Contains(errWrite.Error(), "shipper"))
+}
+
+func TestRotationSpill(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "audit",
+		RecordSize:        8,
+		MaxFileCount:      3,
+		FileMaxSize:       8 * 4,
+		Path:              path.Join(TMPTESTDIR, "audit"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		Rotation:          RotationPolicy{Mode: ROTATION_SPILL, OverflowPath: path.Join(TMPTESTDIR, "overflow")},
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	writeCounters(t, &fl, 0, 12)
+	consumer, errConsumer := fl.Consumer("uploader")
+	assert.Equal(t, nil, errConsumer)
+
+	writeCounters(t, &fl, 12, 8)
+	assert.Equal(t, RotationStatus{SpilledFiles: 2}, fl.RotationStatus())
+	assert.False(t, fileExists(cfg.filename(0)))
+	assert.True(t, fileExists(path.Join(cfg.Rotation.OverflowPath, "audit_1")))
+
+	//Overflow opens as storage with manifest copied there
+	overflowCfg := cfg
+	overflowCfg.Path = cfg.Rotation.OverflowPath
+	overflowCfg.Rotation = RotationPolicy{}
+	overflowCfg.ReadOnly = true
+	overflow, errOverflow := overflowCfg.InitFileStorage()
+	assert.Equal(t, nil, errOverflow)
+	all, errAll := overflow.ReadAll()
+	assert.Equal(t, nil, errAll)
+	assert.Equal(t, counterRange(0, 8), all)
+	assert.Equal(t, nil, overflow.Close())
+
+	buf := make([]byte, 8*12)
+	_, errRead := consumer.Read(buf)
+	assert.Equal(t, nil, errRead)
+	assert.Equal(t, nil, consumer.Commit())
+	writeCounters(t, &fl, 20, 4) //Consumed file is deleted
+	assert.Equal(t, RotationStatus{SpilledFiles: 2}, fl.RotationStatus())
+	assert.False(t, fileExists(path.Join(cfg.Rotation.OverflowPath, "audit_2")))
+}
+
+func TestRotationRecovery(t *testing.T) {
+	for _, mode := range []string{ROTATION_DELETE, ROTATION_REFUSE, ROTATION_SPILL} {
+		os.RemoveAll(TMPTESTDIR)
+		cfg := FileStorageConf{
+			Name:              "audit",
+			RecordSize:        8,
+			MaxFileCount:      3,
+			FileMaxSize:       8 * 4,
+			Path:              path.Join(TMPTESTDIR, "audit"),
+			CompressionMethod: COMPRESSIONMETHOD_GZ,
+			Rotation:          RotationPolicy{Mode: mode, OverflowPath: path.Join(TMPTESTDIR, "overflow")},
+		}
+		fl, flErr := cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		writeCounters(t, &fl, 0, 12)
+		oldest, _ := os.ReadFile(cfg.filename(0))
+		writeCounters(t, &fl, 12, 4)
+		assert.Equal(t, nil, fl.Close())
+
+		//Crash between seal and rotation leaves file over MaxFileCount. Recovery removes it by policy
+		assert.Equal(t, nil, os.WriteFile(cfg.filename(0), oldest, 0666))
+		assert.Equal(t, nil, writeConsumerPosition(cfg.consumerFileName("uploader"), 0))
+		fl, flErr = cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr, mode)
+		assert.Equal(t, []string{cfg.filename(0)}, fl.RecoveryReport().Removed, mode)
+		assert.False(t, fileExists(cfg.filename(0)), mode)
+		if mode == ROTATION_SPILL {
+			assert.True(t, fileExists(path.Join(cfg.Rotation.OverflowPath, "audit_0")))
+			assert.Equal(t, RotationStatus{}, fl.RotationStatus())
+		} else { //Recovery is not refused
+			assert.Equal(t, RotationStatus{LostRecords: 4}, fl.RotationStatus(), mode)
+		}
+		assert.Equal(t, nil, fl.Close())
+	}
+}
+
+func TestRotationConf(t *testing.T) {
+	cfg := FileStorageConf{
+		Name:              "audit",
+		RecordSize:        8,
+		MaxFileCount:      3,
+		FileMaxSize:       8 * 4,
+		Path:              path.Join(TMPTESTDIR, "audit"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		Rotation:          RotationPolicy{Mode: "sometimes", OverflowPath: path.Join(TMPTESTDIR, "overflow")},
+	}
+	assert.NotEqual(t, nil, cfg.CheckErrors())
+	cfg.Rotation.Mode = ROTATION_SPILL
+	assert.Equal(t, nil, cfg.CheckErrors())
+	cfg.Rotation.OverflowPath = ""
+	assert.NotEqual(t, nil, cfg.CheckErrors())
+	cfg.Rotation.OverflowPath = cfg.Path + "/"
+	assert.NotEqual(t, nil, cfg.CheckErrors())
+}
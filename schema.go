@@ -0,0 +1,371 @@
+/*
+Record schema. Declares what fields record has, so records can be decoded without hand copied struct layouts.
+Fields are packed on bit level in declared order, first field starts from most significant bit of first byte
+(same order as bit slicing uses). Schema also gives bit slices for better compression
+*/
+package fixregsto
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+//FieldType tells how field bits are interpreted
+type FieldType string
+
+const (
+	FIELDTYPE_UNSIGNED FieldType = "unsigned"
+	FIELDTYPE_SIGNED   FieldType = "signed" //Two's complement
+	FIELDTYPE_FLOAT    FieldType = "float"  //IEEE 754, 32 or 64 bits
+	FIELDTYPE_BOOL     FieldType = "bool"   //Non zero is true
+	FIELDTYPE_ENUM     FieldType = "enum"   //Unsigned index to Enum names
+)
+
+//SCHEMATAG is struct tag for giving schema field name, like `fixregsto:"temperature"`. Without tag field name is matched ignoring case
+const SCHEMATAG = "fixregsto"
+
+//SchemaField is one variable in record
+type SchemaField struct {
+	Name      string    `json:"name"`
+	Bits      int       `json:"bits"` //1-64
+	Type      FieldType `json:"type"`
+	BigEndian bool      `json:"bigEndian,omitempty"` //Byte order when Bits is multiple of 8. Other widths are always most significant bit first
+	Enum      []string  `json:"enum,omitempty"`      //Names of values 0,1,2.. on FIELDTYPE_ENUM
+}
+
+//RecordSchema describes record. Can be stored as JSON and shared between tools
+type RecordSchema struct {
+	Fields []SchemaField `json:"fields"`
+}
+
+//CheckErrors tells is schema valid and does it cover whole record
+func (p *RecordSchema) CheckErrors(recordSize int64) error {
+	names := make(map[string]bool)
+	for _, field := range p.Fields {
+		if len(field.Name) == 0 {
+			return fmt.Errorf("schema field without name")
+		}
+		if names[strings.ToLower(field.Name)] {
+			return fmt.Errorf("duplicate schema field %v", field.Name)
+		}
+		names[strings.ToLower(field.Name)] = true
+		if errField := field.CheckErrors(); errField != nil {
+			return errField
+		}
+	}
+	if p.TotalBits() != recordSize*8 {
+		return fmt.Errorf("schema has %v bits, record size %v bytes is %v bits", p.TotalBits(), recordSize, recordSize*8)
+	}
+	return nil
+}
+
+//CheckErrors tells is field type and width compatible
+func (p *SchemaField) CheckErrors() error {
+	if p.Bits < 1 || 64 < p.Bits {
+		return fmt.Errorf("field %v: invalid bit width %v", p.Name, p.Bits)
+	}
+	switch p.Type {
+	case FIELDTYPE_UNSIGNED, FIELDTYPE_SIGNED, FIELDTYPE_BOOL:
+	case FIELDTYPE_FLOAT:
+		if p.Bits != 32 && p.Bits != 64 {
+			return fmt.Errorf("field %v: float must be 32 or 64 bits, not %v", p.Name, p.Bits)
+		}
+	case FIELDTYPE_ENUM:
+		if p.Bits < 64 && uint64(1)<<p.Bits < uint64(len(p.Enum)) {
+			return fmt.Errorf("field %v: %v enum values do not fit to %v bits", p.Name, len(p.Enum), p.Bits)
+		}
+	default:
+		return fmt.Errorf("field %v: unknown type %#v", p.Name, p.Type)
+	}
+	return nil
+}
+
+//TotalBits is sum of field widths
+func (p *RecordSchema) TotalBits() int64 {
+	result := int64(0)
+	for _, field := range p.Fields {
+		result += int64(field.Bits)
+	}
+	return result
+}
+
+//BitSlices gives field widths for FileStorageConf.BitSlices, each field is sliced separately
+func (p *RecordSchema) BitSlices() []int {
+	result := make([]int, len(p.Fields))
+	for i, field := range p.Fields {
+		result[i] = field.Bits
+	}
+	return result
+}
+
+/*
+Bit level access, see bitoper.go
+*/
+
+//raw gives field bits as number, byte order fixed
+func (p *SchemaField) raw(record []byte, offset int) uint64 {
+	return readField(record, offset, p.Bits, p.BigEndian)
+}
+
+func (p *SchemaField) setRaw(record []byte, offset int, value uint64) {
+	writeField(record, offset, p.Bits, p.BigEndian, value)
+}
+
+func (p *SchemaField) maxRaw() uint64 {
+	return math.MaxUint64 >> (64 - uint(p.Bits))
+}
+
+/*
+Values. Decoded as uint64, int64, float64, bool or string (enum name, uint64 if value have no name)
+*/
+
+//value converts raw bits to go value
+func (p *SchemaField) value(raw uint64) interface{} {
+	switch p.Type {
+	case FIELDTYPE_SIGNED:
+		shift := 64 - uint(p.Bits)
+		return int64(raw<<shift) >> shift
+	case FIELDTYPE_FLOAT:
+		if p.Bits == 32 {
+			return float64(math.Float32frombits(uint32(raw)))
+		}
+		return math.Float64frombits(raw)
+	case FIELDTYPE_BOOL:
+		return raw != 0
+	case FIELDTYPE_ENUM:
+		if raw < uint64(len(p.Enum)) {
+			return p.Enum[raw]
+		}
+	}
+	return raw
+}
+
+//encodeValue converts go value to raw bits. Accepts any integer, float, bool and enum name
+func (p *SchemaField) encodeValue(v reflect.Value) (uint64, error) {
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return 0, nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() { //nil on map
+		return 0, nil
+	}
+	switch p.Type {
+	case FIELDTYPE_FLOAT:
+		f, errFloat := toFloat(v)
+		if errFloat != nil {
+			return 0, fmt.Errorf("field %v: %v", p.Name, errFloat)
+		}
+		if p.Bits == 32 {
+			return uint64(math.Float32bits(float32(f))), nil
+		}
+		return math.Float64bits(f), nil
+	case FIELDTYPE_BOOL:
+		if v.Kind() == reflect.Bool {
+			if v.Bool() {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case FIELDTYPE_ENUM:
+		if v.Kind() == reflect.String {
+			for i, name := range p.Enum {
+				if name == v.String() {
+					return uint64(i), nil
+				}
+			}
+			return 0, fmt.Errorf("field %v: unknown enum value %#v", p.Name, v.String())
+		}
+	case FIELDTYPE_SIGNED:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n := v.Int()
+			limit := int64(1) << (uint(p.Bits) - 1)
+			if p.Bits < 64 && (n < -limit || limit <= n) {
+				return 0, fmt.Errorf("field %v: value %v does not fit to %v bits", p.Name, n, p.Bits)
+			}
+			return uint64(n) & p.maxRaw(), nil
+		}
+	}
+
+	var n uint64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() < 0 {
+			return 0, fmt.Errorf("field %v: negative value %v on %v field", p.Name, v.Int(), p.Type)
+		}
+		n = uint64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n = v.Uint()
+	default:
+		return 0, fmt.Errorf("field %v: can not encode %v as %v", p.Name, v.Type(), p.Type)
+	}
+	if p.maxRaw() < n || (p.Type == FIELDTYPE_SIGNED && p.maxRaw()>>1 < n) {
+		return 0, fmt.Errorf("field %v: value %v does not fit to %v bits", p.Name, n, p.Bits)
+	}
+	return n, nil
+}
+
+func toFloat(v reflect.Value) (float64, error) {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	}
+	return 0, fmt.Errorf("can not encode %v as float", v.Type())
+}
+
+//assign sets decoded value to struct field
+func (p *SchemaField) assign(target reflect.Value, raw uint64) error {
+	decoded := reflect.ValueOf(p.value(raw))
+	switch target.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := int64(raw)
+		if decoded.Kind() == reflect.Int64 {
+			n = decoded.Int()
+		} else if raw > math.MaxInt64 {
+			return fmt.Errorf("field %v: value %v overflows %v", p.Name, raw, target.Type())
+		}
+		if p.Type == FIELDTYPE_FLOAT || target.OverflowInt(n) {
+			return fmt.Errorf("field %v: can not decode %v to %v", p.Name, decoded.Interface(), target.Type())
+		}
+		target.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if p.Type == FIELDTYPE_FLOAT || (p.Type == FIELDTYPE_SIGNED && decoded.Int() < 0) || target.OverflowUint(raw) {
+			return fmt.Errorf("field %v: can not decode %v to %v", p.Name, decoded.Interface(), target.Type())
+		}
+		target.SetUint(raw)
+	case reflect.Float32, reflect.Float64:
+		f, errFloat := toFloat(decoded)
+		if errFloat != nil {
+			return fmt.Errorf("field %v: %v", p.Name, errFloat)
+		}
+		target.SetFloat(f)
+	case reflect.Bool:
+		target.SetBool(raw != 0)
+	case reflect.String:
+		if p.Type != FIELDTYPE_ENUM {
+			return fmt.Errorf("field %v: can not decode %v to string", p.Name, p.Type)
+		}
+		target.SetString(fmt.Sprint(decoded.Interface()))
+	default:
+		return fmt.Errorf("field %v: unsupported struct field type %v", p.Name, target.Type())
+	}
+	return nil
+}
+
+/*
+Records
+*/
+
+func (p *RecordSchema) recordBytes() int {
+	return int((p.TotalBits() + 7) / 8)
+}
+
+//DecodeMap decodes one record to field name - value map
+func (p *RecordSchema) DecodeMap(record []byte) (map[string]interface{}, error) {
+	if len(record) < p.recordBytes() {
+		return nil, fmt.Errorf("record is %v bytes, schema needs %v", len(record), p.recordBytes())
+	}
+	result := make(map[string]interface{}, len(p.Fields))
+	offset := 0
+	for i := range p.Fields {
+		result[p.Fields[i].Name] = p.Fields[i].value(p.Fields[i].raw(record, offset))
+		offset += p.Fields[i].Bits
+	}
+	return result, nil
+}
+
+//EncodeMap encodes one record. Fields missing from values are zero
+func (p *RecordSchema) EncodeMap(values map[string]interface{}) ([]byte, error) {
+	result := make([]byte, p.recordBytes())
+	offset := 0
+	for i := range p.Fields {
+		v, haz := values[p.Fields[i].Name]
+		if haz {
+			raw, errEncode := p.Fields[i].encodeValue(reflect.ValueOf(v))
+			if errEncode != nil {
+				return nil, errEncode
+			}
+			p.Fields[i].setRaw(result, offset, raw)
+		}
+		offset += p.Fields[i].Bits
+	}
+	return result, nil
+}
+
+//structFields maps schema field index to struct field. Struct fields not in schema are ignored
+func (p *RecordSchema) structFields(t reflect.Type) (map[int][]int, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("schema needs struct, got %v", t)
+	}
+	result := make(map[int][]int)
+	for i := range p.Fields {
+		for j := 0; j < t.NumField(); j++ {
+			sf := t.Field(j)
+			tag := sf.Tag.Get(SCHEMATAG)
+			if sf.IsExported() && (tag == p.Fields[i].Name || (len(tag) == 0 && strings.EqualFold(sf.Name, p.Fields[i].Name))) {
+				result[i] = sf.Index
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+//Decode decodes one record to struct pointed by target
+func (p *RecordSchema) Decode(record []byte, target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("decode target must be non nil pointer to struct")
+	}
+	v = v.Elem()
+	if len(record) < p.recordBytes() {
+		return fmt.Errorf("record is %v bytes, schema needs %v", len(record), p.recordBytes())
+	}
+	mapping, errMapping := p.structFields(v.Type())
+	if errMapping != nil {
+		return errMapping
+	}
+	offset := 0
+	for i := range p.Fields {
+		if index, haz := mapping[i]; haz {
+			if errAssign := p.Fields[i].assign(v.FieldByIndex(index), p.Fields[i].raw(record, offset)); errAssign != nil {
+				return errAssign
+			}
+		}
+		offset += p.Fields[i].Bits
+	}
+	return nil
+}
+
+//Encode encodes struct (or pointer to struct) to record. Schema fields missing from struct are zero
+func (p *RecordSchema) Encode(source interface{}) ([]byte, error) {
+	v := reflect.Indirect(reflect.ValueOf(source))
+	if !v.IsValid() {
+		return nil, fmt.Errorf("nothing to encode")
+	}
+	mapping, errMapping := p.structFields(v.Type())
+	if errMapping != nil {
+		return nil, errMapping
+	}
+	result := make([]byte, p.recordBytes())
+	offset := 0
+	for i := range p.Fields {
+		if index, haz := mapping[i]; haz {
+			raw, errEncode := p.Fields[i].encodeValue(v.FieldByIndex(index))
+			if errEncode != nil {
+				return nil, errEncode
+			}
+			p.Fields[i].setRaw(result, offset, raw)
+		}
+		offset += p.Fields[i].Bits
+	}
+	return result, nil
+}
@@ -0,0 +1,109 @@
+package fixregsto
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type schemaTestRecord struct {
+	Timestamp   uint32
+	Temperature float32 `fixregsto:"temp"`
+	Delta       int16
+	State       string
+	Alarm       bool
+	Counter     uint8
+	notInSchema int
+}
+
+func schemaTestSchema() RecordSchema {
+	return RecordSchema{Fields: []SchemaField{
+		{Name: "timestamp", Bits: 32, Type: FIELDTYPE_UNSIGNED},
+		{Name: "temp", Bits: 32, Type: FIELDTYPE_FLOAT},
+		{Name: "delta", Bits: 16, Type: FIELDTYPE_SIGNED, BigEndian: true},
+		{Name: "state", Bits: 3, Type: FIELDTYPE_ENUM, Enum: []string{"off", "heating", "cooling"}},
+		{Name: "alarm", Bits: 1, Type: FIELDTYPE_BOOL},
+		{Name: "counter", Bits: 4, Type: FIELDTYPE_UNSIGNED},
+		{Name: "spare", Bits: 8, Type: FIELDTYPE_UNSIGNED},
+	}}
+}
+
+func TestSchemaStruct(t *testing.T) {
+	schema := schemaTestSchema()
+	assert.Equal(t, nil, schema.CheckErrors(12))
+	assert.NotEqual(t, nil, schema.CheckErrors(8))
+	assert.Equal(t, []int{32, 32, 16, 3, 1, 4, 8}, schema.BitSlices())
+
+	rec := schemaTestRecord{Timestamp: 0x01020304, Temperature: 21.5, Delta: -2, State: "cooling", Alarm: true, Counter: 9}
+	raw, errEncode := schema.Encode(rec)
+	assert.Equal(t, nil, errEncode)
+	assert.Equal(t, []byte{4, 3, 2, 1, 0, 0, 0xac, 0x41, 0xff, 0xfe, 0x59, 0}, raw)
+
+	var back schemaTestRecord
+	assert.Equal(t, nil, schema.Decode(raw, &back))
+	assert.Equal(t, rec, back)
+
+	m, errMap := schema.DecodeMap(raw)
+	assert.Equal(t, nil, errMap)
+	assert.Equal(t, map[string]interface{}{"timestamp": uint64(0x01020304), "temp": 21.5, "delta": int64(-2), "state": "cooling", "alarm": true, "counter": uint64(9), "spare": uint64(0)}, m)
+	fromMap, errFromMap := schema.EncodeMap(m)
+	assert.Equal(t, nil, errFromMap)
+	assert.Equal(t, raw, fromMap)
+
+	rec.Counter = 16
+	_, errOverflow := schema.Encode(rec)
+	assert.NotEqual(t, nil, errOverflow)
+	_, errEnum := schema.EncodeMap(map[string]interface{}{"state": "melting"})
+	assert.NotEqual(t, nil, errEnum)
+	assert.NotEqual(t, nil, schema.Decode(raw, back))
+
+	//Shared as JSON
+	js, errJson := json.Marshal(schema)
+	assert.Equal(t, nil, errJson)
+	var fromJson RecordSchema
+	assert.Equal(t, nil, json.Unmarshal(js, &fromJson))
+	assert.Equal(t, schema, fromJson)
+}
+
+func TestSchemaStorage(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	schema := schemaTestSchema()
+	cfg := FileStorageConf{
+		Name:              "schema",
+		RecordSize:        12,
+		MaxFileCount:      4,
+		FileMaxSize:       12 * 16,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		Schema:            &schema,
+	}
+	assert.Equal(t, nil, cfg.CheckErrors())
+	cfg.BitSlices = []int{32, 32, 32}
+	assert.NotEqual(t, nil, cfg.CheckErrors())
+	cfg.BitSlices = nil
+
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	for i := 0; i < 40; i++ {
+		raw, errEncode := schema.Encode(schemaTestRecord{Timestamp: uint32(i), Delta: int16(-i), State: "heating"})
+		assert.Equal(t, nil, errEncode)
+		_, errWrite := fl.Write(raw)
+		assert.Equal(t, nil, errWrite)
+	}
+	first, errFirst := fl.GetFirst(1)
+	assert.Equal(t, nil, errFirst)
+	var rec schemaTestRecord
+	assert.Equal(t, nil, schema.Decode(first, &rec))
+	assert.Equal(t, schemaTestRecord{Delta: 0, State: "heating"}, rec)
+
+	//Sealed file is sliced by schema
+	sealed, errSealed := readCompressedFile(cfg.filename(0), COMPRESSIONMETHOD_GZ, fieldCoding{})
+	assert.Equal(t, nil, errSealed)
+	firstFile, _ := fl.GetFirst(16)
+	expected, _ := sliceBitArr(firstFile, schema.BitSlices())
+	assert.Equal(t, expected, sealed)
+	assert.Equal(t, []byte{0, 0, 0, 0, 1, 0, 0, 0}, sealed[:8]) //Timestamps of first records are next to each other
+}
@@ -0,0 +1,317 @@
+/*
+Shipper pushes sealed numbered files to Sink, like server over intermittent uplink. Files are shipped in order as they
+are stored (compressed). Number of last shipped file is kept on checkpoint file name.shipped, so shipping continues
+after restart without sending files again. Failed ship is retried with exponential backoff.
+
+Shipper runs also on read only storage, so separate uploader process can ship files of writer process.
+Files removed by rotation before shipping are counted as missed. Migrate and Restore renumber files, checkpoint is
+removed when they commit and all files are shipped again
+*/
+package fixregsto
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULTSHIPPOLL       = time.Second     //Used when PollInterval is not set
+	DEFAULTSHIPMINBACKOFF = time.Second     //Used when MinBackoff is not set
+	DEFAULTSHIPMAXBACKOFF = 5 * time.Minute //Used when MaxBackoff is not set
+)
+
+//SealedFile is numbered file as stored
+type SealedFile struct {
+	Name       string //Filename without path, like name_12
+	FileNumber int64
+	ModTime    time.Time
+	Content    []byte
+}
+
+//Sink receives sealed files. Same file can be shipped again if checkpoint was not saved, so sink should accept duplicates
+type Sink interface {
+	Ship(ctx context.Context, file SealedFile) error
+}
+
+//HTTPSink posts file content to URL. File is told on X-Fixregsto-File and X-Fixregsto-File-Number headers
+type HTTPSink struct {
+	URL    string
+	Client *http.Client //Nil is http.DefaultClient
+	Header http.Header  //Added to every request, like Authorization
+}
+
+//Ship posts file. Response other than 2xx is error
+func (p *HTTPSink) Ship(ctx context.Context, file SealedFile) error {
+	req, errReq := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(file.Content))
+	if errReq != nil {
+		return errReq
+	}
+	for key, values := range p.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Fixregsto-File", file.Name)
+	req.Header.Set("X-Fixregsto-File-Number", strconv.FormatInt(file.FileNumber, 10))
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, errDo := client.Do(req)
+	if errDo != nil {
+		return errDo
+	}
+	io.Copy(io.Discard, resp.Body) //Connection can be reused
+	resp.Body.Close()
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		return fmt.Errorf("shipping %v to %v failed with status %v", file.Name, p.URL, resp.Status)
+	}
+	return nil
+}
+
+//DirSink copies files to directory, like mounted network share or removable media
+type DirSink struct {
+	Path string
+}
+
+//Ship writes file to directory with same name and modification time
+func (p *DirSink) Ship(ctx context.Context, file SealedFile) error {
+	if errMkdir := os.MkdirAll(p.Path, os.ModePerm); errMkdir != nil {
+		return errMkdir
+	}
+	filename := path.Join(p.Path, file.Name)
+	if _, errWrite := writeWithFsyncCow(filename, file.Content); errWrite != nil {
+		return errWrite
+	}
+	return os.Chtimes(filename, file.ModTime, file.ModTime)
+}
+
+//ShipperConf tells where and how sealed files are shipped
+type ShipperConf struct {
+	Sink         Sink
+	PollInterval time.Duration //How often read only storage checks files sealed by other process. 0 is DEFAULTSHIPPOLL
+	MinBackoff   time.Duration //Delay after first failed ship, doubled on each failure. 0 is DEFAULTSHIPMINBACKOFF
+	MaxBackoff   time.Duration //Longest delay between retries. 0 is DEFAULTSHIPMAXBACKOFF
+}
+
+//ShipperStatus tells progress of shipping
+type ShipperStatus struct {
+	Checkpoint int64 //Number of last shipped file, -1 if none
+	Shipped    int64 //Files shipped after start
+	Missed     int64 //Files removed before those were shipped
+	Failures   int   //Failed attempts after last shipped file
+	LastErr    error //Error of last failed attempt
+}
+
+//Shipper is running shipping started with Ship
+type Shipper struct {
+	done chan struct{}
+
+	mu     sync.Mutex
+	status ShipperStatus
+	err    error
+}
+
+//Status tells progress
+func (p *Shipper) Status() ShipperStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+//Done is closed when shipper stops on context or storage Close
+func (p *Shipper) Done() <-chan struct{} {
+	return p.done
+}
+
+//Err tells why shipper stopped. Nil while running
+func (p *Shipper) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *Shipper) update(f func(status *ShipperStatus)) {
+	p.mu.Lock()
+	f(&p.status)
+	p.mu.Unlock()
+}
+
+func (p *FileStorageConf) checkpointFileName() string {
+	return p.BaseFileName() + ".shipped"
+}
+
+//readCheckpoint returns number of last shipped file, -1 if nothing is shipped
+func (p *FileStorageConf) readCheckpoint() (int64, error) {
+	content, errRead := os.ReadFile(p.checkpointFileName())
+	if os.IsNotExist(errRead) {
+		return -1, nil
+	}
+	if errRead != nil {
+		return -1, errRead
+	}
+	n, errParse := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if errParse != nil {
+		return -1, fmt.Errorf("Invalid checkpoint %v err=%v", p.checkpointFileName(), errParse)
+	}
+	return n, nil
+}
+
+func (p *FileStorageConf) writeCheckpoint(fileNumber int64) error {
+	_, errWrite := writeWithFsyncCow(p.checkpointFileName(), []byte(strconv.FormatInt(fileNumber, 10)))
+	return errWrite
+}
+
+//Ship starts shipping sealed files newer than checkpoint to sink until ctx is done or storage is closed.
+//Shipper refers to this FileStorage, do not copy FileStorage after that
+func (p *FileStorage) Ship(ctx context.Context, conf ShipperConf) (*Shipper, error) {
+	if conf.Sink == nil {
+		return nil, fmt.Errorf("Shipper requires Sink")
+	}
+	if conf.PollInterval <= 0 {
+		conf.PollInterval = DEFAULTSHIPPOLL
+	}
+	if conf.MinBackoff <= 0 {
+		conf.MinBackoff = DEFAULTSHIPMINBACKOFF
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = DEFAULTSHIPMAXBACKOFF
+	}
+	checkpoint, errCheckpoint := p.conf.readCheckpoint()
+	if errCheckpoint != nil {
+		return nil, errCheckpoint
+	}
+	result := Shipper{done: make(chan struct{}), status: ShipperStatus{Checkpoint: checkpoint}}
+	go p.runShipper(ctx, conf, &result)
+	return &result, nil
+}
+
+func (p *FileStorage) runShipper(ctx context.Context, conf ShipperConf, shipper *Shipper) {
+	defer close(shipper.done)
+	finish := func(err error) {
+		shipper.mu.Lock()
+		shipper.err = err
+		shipper.mu.Unlock()
+	}
+	var tick <-chan time.Time
+	if p.conf.ReadOnly { //Writer process does not wake this one
+		ticker := time.NewTicker(conf.PollInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	backoff := conf.MinBackoff
+	for {
+		changed := p.changes.changed() //Before listing, so seal between listing and wait is not missed
+		shipped, errShip := p.shipNext(ctx, conf.Sink, shipper)
+		if ctx.Err() != nil {
+			finish(ctx.Err())
+			return
+		}
+		if errShip == ErrClosed {
+			finish(errShip)
+			return
+		}
+		if errShip != nil {
+			shipper.update(func(status *ShipperStatus) {
+				status.Failures++
+				status.LastErr = errShip
+			})
+			if errWait := p.waitBackoff(ctx, backoff, changed); errWait != nil {
+				finish(errWait)
+				return
+			}
+			backoff *= 2
+			if conf.MaxBackoff < backoff {
+				backoff = conf.MaxBackoff
+			}
+			continue
+		}
+		backoff = conf.MinBackoff
+		if shipped {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			finish(ctx.Err())
+			return
+		case <-changed:
+		case <-tick:
+		}
+	}
+}
+
+//waitBackoff waits before retry. Writes do not end waiting, but Close does
+func (p *FileStorage) waitBackoff(ctx context.Context, backoff time.Duration, changed <-chan struct{}) error {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-changed:
+			changed = p.changes.changed()
+			p.mu.RLock()
+			closed := p.closed.closed
+			p.mu.RUnlock()
+			if closed {
+				return ErrClosed
+			}
+		}
+	}
+}
+
+//shipNext ships oldest sealed file after checkpoint. Returns false if there is nothing to ship
+func (p *FileStorage) shipNext(ctx context.Context, sink Sink, shipper *Shipper) (bool, error) {
+	checkpoint := shipper.Status().Checkpoint
+	numbers, errNumbers := reading(p, p.fileNumbers)
+	if errNumbers != nil {
+		return false, errNumbers
+	}
+	for _, fileNumber := range numbers {
+		if fileNumber <= checkpoint {
+			continue
+		}
+		filename := p.conf.filename(fileNumber)
+		info, errStat := os.Stat(filename)
+		if os.IsNotExist(errStat) {
+			continue //Rotated after listing, counted as missed when next one is shipped
+		}
+		if errStat != nil {
+			return false, errStat
+		}
+		content, errRead := os.ReadFile(filename)
+		if os.IsNotExist(errRead) {
+			continue
+		}
+		if errRead != nil {
+			return false, errRead
+		}
+		if errShip := sink.Ship(ctx, SealedFile{Name: path.Base(filename), FileNumber: fileNumber, ModTime: info.ModTime(), Content: content}); errShip != nil {
+			return false, errShip
+		}
+		if errCheckpoint := p.conf.writeCheckpoint(fileNumber); errCheckpoint != nil {
+			return false, errCheckpoint
+		}
+		shipper.update(func(status *ShipperStatus) {
+			if 0 <= checkpoint {
+				status.Missed += fileNumber - checkpoint - 1
+			}
+			status.Checkpoint = fileNumber
+			status.Shipped++
+			status.Failures = 0
+			status.LastErr = nil
+		})
+		return true, nil
+	}
+	return false, nil
+}
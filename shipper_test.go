@@ -0,0 +1,187 @@
+package fixregsto
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//testServer receives files and fails first requests
+type testServer struct {
+	mu       sync.Mutex
+	failures int
+	files    map[string][]byte
+	order    []string
+}
+
+func (p *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	content, _ := io.ReadAll(r.Body)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if 0 < p.failures {
+		p.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	name := r.Header.Get("X-Fixregsto-File")
+	p.files[name] = content
+	p.order = append(p.order, name+"/"+r.Header.Get("X-Fixregsto-File-Number"))
+}
+
+func (p *testServer) received() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.order...)
+}
+
+func TestShipperHTTP(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	received := &testServer{failures: 2, files: make(map[string][]byte)}
+	server := httptest.NewServer(received)
+	defer server.Close()
+	shipperConf := ShipperConf{Sink: &HTTPSink{URL: server.URL}, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+	cfg := FileStorageConf{
+		Name:              "shipping",
+		RecordSize:        8,
+		MaxFileCount:      3,
+		FileMaxSize:       64,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 0, 8*2+1)
+	ctx, cancel := context.WithCancel(context.Background())
+	shipper, errShip := fl.Ship(ctx, shipperConf)
+	assert.Equal(t, nil, errShip)
+	writeCounters(t, &fl, 8*2+1, 8)
+	assert.Eventually(t, func() bool { return shipper.Status().Checkpoint == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"shipping_0/0", "shipping_1/1", "shipping_2/2"}, received.received())
+	for name, content := range received.files {
+		stored, _ := os.ReadFile(path.Join(TMPTESTDIR, name))
+		assert.Equal(t, stored, content)
+	}
+	status := shipper.Status()
+	assert.Equal(t, int64(3), status.Shipped)
+	assert.Equal(t, 0, status.Failures)
+	cancel()
+	<-shipper.Done()
+	assert.Equal(t, context.Canceled, shipper.Err())
+
+	//Uplink is down while rotation removes files
+	writeCounters(t, &fl, 8*3+1, 8*4)
+	shipper, errShip = fl.Ship(context.Background(), shipperConf)
+	assert.Equal(t, nil, errShip)
+	assert.Equal(t, int64(2), shipper.Status().Checkpoint)
+	assert.Eventually(t, func() bool { return shipper.Status().Checkpoint == 6 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, int64(1), shipper.Status().Missed)
+	assert.Equal(t, []string{"shipping_0/0", "shipping_1/1", "shipping_2/2", "shipping_4/4", "shipping_5/5", "shipping_6/6"}, received.received())
+
+	server.Close()
+	writeCounters(t, &fl, 8*7+1, 8)
+	assert.Eventually(t, func() bool { return 2 <= shipper.Status().Failures }, 5*time.Second, time.Millisecond)
+	assert.NotEqual(t, nil, shipper.Status().LastErr)
+	assert.Equal(t, nil, fl.Close())
+	<-shipper.Done()
+	assert.Equal(t, ErrClosed, shipper.Err())
+	checkpoint, _ := cfg.readCheckpoint()
+	assert.Equal(t, int64(6), checkpoint)
+}
+
+func TestShipperDir(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "shipping",
+		RecordSize:        8,
+		MaxFileCount:      10,
+		FileMaxSize:       64,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	writeCounters(t, &fl, 0, 8+1)
+
+	//Separate uploader process
+	roCfg := cfg
+	roCfg.ReadOnly = true
+	ro, roErr := roCfg.InitFileStorage()
+	assert.Equal(t, nil, roErr)
+	shipDir := path.Join(TMPTESTDIR, "shipped")
+	shipper, errShip := ro.Ship(context.Background(), ShipperConf{Sink: &DirSink{Path: shipDir}, PollInterval: time.Millisecond})
+	assert.Equal(t, nil, errShip)
+	writeCounters(t, &fl, 8+1, 8*2)
+	assert.Eventually(t, func() bool { return shipper.Status().Checkpoint == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, nil, ro.Close())
+	<-shipper.Done()
+	assert.Equal(t, ErrClosed, shipper.Err())
+
+	//Shipped files with manifest are readable storage
+	manifest, _ := os.ReadFile(cfg.manifestFileName())
+	assert.Equal(t, nil, os.WriteFile(path.Join(shipDir, path.Base(cfg.manifestFileName())), manifest, 0644))
+	shippedCfg := roCfg
+	shippedCfg.Path = shipDir
+	shipped, errShipped := shippedCfg.InitFileStorage()
+	assert.Equal(t, nil, errShipped)
+	all, _ := shipped.ReadAll()
+	expected, _ := fl.GetFirst(8 * 3)
+	assert.Equal(t, expected, all)
+	assert.Equal(t, nil, shipped.Close())
+
+	_, errShip = fl.Ship(context.Background(), ShipperConf{})
+	assert.NotEqual(t, nil, errShip)
+}
+
+func TestShipperAfterMigrate(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "shipping",
+		RecordSize:        8,
+		MaxFileCount:      10,
+		FileMaxSize:       64,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 0, 8*4+1)
+	shipDir := path.Join(TMPTESTDIR, "shipped")
+	shipperConf := ShipperConf{Sink: &DirSink{Path: shipDir}, PollInterval: time.Millisecond}
+	shipper, errShip := fl.Ship(context.Background(), shipperConf)
+	assert.Equal(t, nil, errShip)
+	assert.Eventually(t, func() bool { return shipper.Status().Checkpoint == 3 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, nil, fl.Close())
+	<-shipper.Done()
+
+	//Bigger files, old checkpoint would skip new files 0 and 1
+	newCfg := cfg
+	newCfg.FileMaxSize = 64 * 2
+	assert.Equal(t, nil, Migrate(cfg, newCfg))
+	assert.False(t, fileExists(cfg.checkpointFileName()))
+	fl, flErr = newCfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	_, _, found, errConsumed := newCfg.slowestConsumer() //Unshipped files are not consumed
+	assert.Equal(t, nil, errConsumed)
+	assert.False(t, found)
+	shipper, errShip = fl.Ship(context.Background(), shipperConf)
+	assert.Equal(t, nil, errShip)
+	assert.Equal(t, int64(-1), shipper.Status().Checkpoint)
+	assert.Eventually(t, func() bool { return shipper.Status().Checkpoint == 1 }, 5*time.Second, time.Millisecond)
+	for fileNumber := int64(0); fileNumber < 2; fileNumber++ {
+		stored, _ := os.ReadFile(newCfg.filename(fileNumber))
+		shipped, _ := os.ReadFile(path.Join(shipDir, path.Base(newCfg.filename(fileNumber))))
+		assert.Equal(t, stored, shipped)
+	}
+	assert.Equal(t, nil, fl.Close())
+	<-shipper.Done()
+}
@@ -0,0 +1,309 @@
+/*
+Snapshot and restore of FileStorage as tar archive. Archive has manifest first, then numbered files as they are stored
+(compressed and framed) and work file. Extracting archive with tar gives directory that can be opened as storage.
+
+Snapshot lists files and reads work file under lock, then streams sealed files to archive one by one, so memory use
+does not grow with storage size. Sealed files do not change, so archive is consistent.
+Restore extracts to staging directory, reads all records back and commits with manifest like Migrate (see manifest.go),
+power cut leaves either old storage or restored one
+*/
+package fixregsto
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//snapshotFile is file read for archive
+type snapshotFile struct {
+	name    string
+	modTime time.Time
+	content []byte
+}
+
+//snapshotState is storage when snapshot starts. Sealed files are opened one by one while archive is written
+type snapshotState struct {
+	manifest snapshotFile
+	numbers  []int64
+	work     *snapshotFile //Nil if there is no work file
+}
+
+//Snapshot writes consistent tar archive of storage to w. Works also on read only storage while other process writes.
+//Files are listed and work file is read under lock, sealed files are streamed to archive one by one.
+//Sealed files do not change, file rotated away before it is archived is left out, so archive starts from later file
+func (p *FileStorage) Snapshot(w io.Writer) error {
+	state, errState := reading(p, p.snapshotStart)
+	if errState != nil {
+		return errState
+	}
+	tw := tar.NewWriter(w)
+	if errManifest := writeSnapshotFile(tw, state.manifest); errManifest != nil {
+		return errManifest
+	}
+	for _, fileNumber := range state.numbers {
+		errFile := p.snapshotSealed(tw, fileNumber)
+		if os.IsNotExist(errFile) {
+			continue //Rotated away after listing
+		}
+		if errFile != nil {
+			return errFile
+		}
+	}
+	if state.work != nil {
+		if errWork := writeSnapshotFile(tw, *state.work); errWork != nil {
+			return errWork
+		}
+	}
+	return tw.Close()
+}
+
+//snapshotStart reads manifest and work file and lists sealed files. Manifest is created from conf if storage does not have it
+func (p *FileStorage) snapshotStart() (snapshotState, error) {
+	result := snapshotState{}
+	manifest, errManifest := p.conf.ReadManifest()
+	if errManifest != nil {
+		return result, errManifest
+	}
+	if manifest == nil {
+		manifest = &Manifest{Version: MANIFESTVERSION, Layout: p.conf.Layout()}
+	}
+	manifestContent, errMarshal := json.MarshalIndent(manifest, "", "  ")
+	if errMarshal != nil {
+		return result, errMarshal
+	}
+	result.manifest = snapshotFile{name: path.Base(p.conf.manifestFileName()), modTime: time.Now(), content: manifestContent}
+
+	var errNumbers error
+	result.numbers, errNumbers = p.fileNumbers()
+	if errNumbers != nil {
+		return result, errNumbers
+	}
+	stale, errStale := p.conf.staleWork()
+	if stale || errStale != nil { //Records of work file left behind seal are on sealed file
+		return result, errStale
+	}
+	workfile := p.conf.BaseFileName()
+	f, errOpen := os.Open(workfile)
+	if os.IsNotExist(errOpen) { //Sealed meanwhile on read only storage, reading tries again
+		return result, nil
+	}
+	if errOpen != nil {
+		return result, errOpen
+	}
+	defer f.Close()
+	info, errStat := f.Stat()
+	if errStat != nil {
+		return result, errStat
+	}
+	content, errRead := io.ReadAll(f) //Work file is at most one file of records
+	if errRead != nil {
+		return result, errRead
+	}
+	result.work = &snapshotFile{name: path.Base(workfile), modTime: info.ModTime(), content: content}
+	return result, nil
+}
+
+//snapshotSealed opens sealed file under lock and streams it to archive without lock. Open file keeps its content
+//even if file is replaced by recompression or removed meanwhile
+func (p *FileStorage) snapshotSealed(tw *tar.Writer, fileNumber int64) error {
+	filename := p.conf.filename(fileNumber)
+	var f *os.File
+	_, errOpen := reading(p, func() (bool, error) {
+		if f != nil { //Read only storage tries again when files changed
+			f.Close()
+		}
+		var errOpen error
+		f, errOpen = os.Open(filename)
+		return true, errOpen
+	})
+	if errOpen != nil {
+		if f != nil {
+			f.Close()
+		}
+		return errOpen
+	}
+	defer f.Close()
+	info, errStat := f.Stat()
+	if errStat != nil {
+		return errStat
+	}
+	header := tar.Header{Name: path.Base(filename), Mode: 0644, Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+	if errHeader := tw.WriteHeader(&header); errHeader != nil {
+		return errHeader
+	}
+	_, errCopy := io.Copy(tw, io.LimitReader(f, info.Size()))
+	return errCopy
+}
+
+func writeSnapshotFile(tw *tar.Writer, f snapshotFile) error {
+	header := tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), ModTime: f.modTime, Typeflag: tar.TypeReg}
+	if errHeader := tw.WriteHeader(&header); errHeader != nil {
+		return errHeader
+	}
+	_, errWrite := tw.Write(f.content)
+	return errWrite
+}
+
+//Restore rebuilds storage conf.Name on conf.Path from Snapshot archive. Existing storage there is replaced and must not be open
+//or have consumers.
+//Archive can be from storage with other name. Layout comes from archive, open restored storage with conf matching ReadManifest
+func Restore(r io.Reader, conf FileStorageConf) error {
+	if !filenameOk(conf.Name) || len(conf.Name) == 0 {
+		return fmt.Errorf("Invalid name %s", conf.Name)
+	}
+	if errMkdir := os.MkdirAll(conf.Path, os.ModePerm); errMkdir != nil {
+		return errMkdir
+	}
+	lock, _, errLock := acquireLock(conf.lockFileName())
+	if errLock != nil {
+		return errLock
+	}
+	defer lock.release()
+	if errConsumers := conf.checkNoConsumers(); errConsumers != nil {
+		return errConsumers
+	}
+
+	stagingConf := conf
+	stagingConf.Path = conf.stagingDir()
+	if errClean := os.RemoveAll(stagingConf.Path); errClean != nil { //Left from restore or migration that did not commit
+		return errClean
+	}
+	layout, errExtract := stagingConf.extractSnapshot(r)
+	if errExtract == nil {
+		errExtract = stagingConf.verifyStaged(layout)
+	}
+	if errExtract != nil {
+		os.RemoveAll(stagingConf.Path)
+		return errExtract
+	}
+
+	migration := Migration{Layout: layout}
+	var errList error
+	migration.Files, errList = stagingConf.stagedFiles()
+	if errList != nil {
+		os.RemoveAll(stagingConf.Path)
+		return errList
+	}
+	if errCommit := conf.writeManifest(Manifest{Layout: layout, Migration: &migration}); errCommit != nil {
+		return errCommit
+	}
+	return conf.finishMigration(migration)
+}
+
+//extractSnapshot writes files of archive to directory of conf, renamed for conf.Name. Returns layout from manifest
+func (p *FileStorageConf) extractSnapshot(r io.Reader) (Layout, error) {
+	if errMkdir := os.MkdirAll(p.Path, os.ModePerm); errMkdir != nil {
+		return Layout{}, errMkdir
+	}
+	tr := tar.NewReader(r)
+	var manifest *Manifest
+	archived := FileStorageConf{} //Name of storage on archive
+	for {
+		header, errNext := tr.Next()
+		if errNext == io.EOF {
+			break
+		}
+		if errNext != nil {
+			return Layout{}, fmt.Errorf("Invalid snapshot err=%v", errNext)
+		}
+		if manifest == nil {
+			if !strings.HasSuffix(header.Name, ".manifest") {
+				return Layout{}, fmt.Errorf("Invalid snapshot, starts with %v instead of manifest", header.Name)
+			}
+			archived.Name = strings.TrimSuffix(header.Name, ".manifest")
+			var errManifest error
+			manifest, errManifest = readSnapshotManifest(tr)
+			if errManifest != nil {
+				return Layout{}, errManifest
+			}
+			if errWrite := p.writeManifest(Manifest{Layout: manifest.Layout}); errWrite != nil {
+				return Layout{}, errWrite
+			}
+			continue
+		}
+		fileNumber, isTmp, isStorageFile := archived.parseStorageFileName(header.Name)
+		if !isStorageFile || isTmp || header.Typeflag != tar.TypeReg {
+			return Layout{}, fmt.Errorf("Invalid snapshot, unexpected file %v", header.Name)
+		}
+		filename := p.BaseFileName()
+		if 0 <= fileNumber {
+			filename = p.filename(fileNumber)
+		}
+		if errWrite := writeSyncedFile(filename, tr); errWrite != nil {
+			return Layout{}, errWrite
+		}
+		if errTime := os.Chtimes(filename, header.ModTime, header.ModTime); errTime != nil { //Retention by age uses modification time
+			return Layout{}, errTime
+		}
+	}
+	if manifest == nil {
+		return Layout{}, fmt.Errorf("Invalid snapshot, no manifest")
+	}
+	return manifest.Layout, syncDir(p.Path)
+}
+
+func readSnapshotManifest(r io.Reader) (*Manifest, error) {
+	content, errRead := io.ReadAll(r)
+	if errRead != nil {
+		return nil, errRead
+	}
+	var result Manifest
+	if errParse := json.Unmarshal(content, &result); errParse != nil {
+		return nil, fmt.Errorf("Invalid manifest on snapshot err=%v", errParse.Error())
+	}
+	if result.Version != MANIFESTVERSION {
+		return nil, fmt.Errorf("Unsupported manifest version %v on snapshot", result.Version)
+	}
+	return &result, nil
+}
+
+//writeSyncedFile writes new file from r and syncs it
+func writeSyncedFile(filename string, r io.Reader) error {
+	f, errOpen := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if errOpen != nil {
+		return errOpen
+	}
+	if _, errCopy := io.Copy(f, r); errCopy != nil {
+		f.Close()
+		return errCopy
+	}
+	if errSync := f.Sync(); errSync != nil {
+		f.Close()
+		return errSync
+	}
+	return f.Close()
+}
+
+//verifyStaged reads all records of extracted storage, so broken archive is not committed
+func (p *FileStorageConf) verifyStaged(layout Layout) error {
+	verifyConf := FileStorageConf{Name: p.Name, Path: p.Path, ReadOnly: true, CacheFiles: -1}
+	layout.Apply(&verifyConf)
+	if errConf := verifyConf.CheckErrors(); errConf != nil {
+		return fmt.Errorf("Invalid layout on snapshot err=%v", errConf)
+	}
+	sto, errInit := verifyConf.InitFileStorage()
+	if errInit != nil {
+		return errInit
+	}
+	defer sto.Close()
+	cursor, errCursor := sto.NewCursor()
+	if errCursor != nil {
+		return errCursor
+	}
+	buf := make([]byte, MIGRATEBATCHRECORDS*verifyConf.RecordSize)
+	for {
+		_, errRead := cursor.Read(buf)
+		if errRead == io.EOF {
+			return nil
+		}
+		if errRead != nil {
+			return fmt.Errorf("Snapshot has broken records err=%v", errRead)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package fixregsto
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTwelves(t *testing.T, fl *FileStorage, from int, n int) {
+	records := make([]byte, 12*n)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(records[i*12:], uint64(from+i))
+		binary.LittleEndian.PutUint32(records[i*12+8:], uint32(3*(from+i)))
+	}
+	_, errWrite := fl.Write(records)
+	assert.Equal(t, nil, errWrite)
+}
+
+func tarNames(t *testing.T, archive []byte) []string {
+	result := []string{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, errNext := tr.Next()
+		if errNext == io.EOF {
+			return result
+		}
+		assert.Equal(t, nil, errNext)
+		result = append(result, header.Name)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "device",
+		RecordSize:        12,
+		MaxFileCount:      10,
+		FileMaxSize:       12 * 8,
+		Path:              path.Join(TMPTESTDIR, "device"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		BitSlices:         []int{64, 32},
+		Framed:            true,
+		AppendWork:        true,
+		Indexed:           true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeTwelves(t, &fl, 0, 8*3+5)
+	expected, _ := fl.ReadAll()
+	var archive bytes.Buffer
+	assert.Equal(t, nil, fl.Snapshot(&archive))
+	assert.Equal(t, []string{"device.manifest", "device_0", "device_1", "device_2", "device"}, tarNames(t, archive.Bytes()))
+	writeTwelves(t, &fl, 8*3+5, 1) //Not on snapshot
+	assert.Equal(t, nil, fl.Close())
+
+	//Restore with other name, index is rebuilt on init
+	restoredCfg := cfg
+	restoredCfg.Name = "service"
+	restoredCfg.Path = path.Join(TMPTESTDIR, "service")
+	assert.Equal(t, nil, Restore(bytes.NewReader(archive.Bytes()), restoredCfg))
+	_, errStaging := os.Stat(restoredCfg.stagingDir())
+	assert.True(t, os.IsNotExist(errStaging))
+	restored, errRestored := restoredCfg.InitFileStorage()
+	assert.Equal(t, nil, errRestored)
+	assert.True(t, restored.RecoveryReport().String() == "clean")
+	all, _ := restored.ReadAll()
+	assert.Equal(t, expected, all)
+	assert.Equal(t, 3, len(restored.Index()))
+	writeTwelves(t, &restored, 8*3+5, 8)
+	assert.Equal(t, nil, restored.Close())
+
+	//Restore replaces existing storage, open storage is refused
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.NotEqual(t, nil, Restore(bytes.NewReader(archive.Bytes()), cfg))
+	assert.Equal(t, nil, fl.Close())
+	assert.Equal(t, nil, Restore(bytes.NewReader(archive.Bytes()), restoredCfg))
+	restored, errRestored = restoredCfg.InitFileStorage()
+	assert.Equal(t, nil, errRestored)
+	all, _ = restored.ReadAll()
+	assert.Equal(t, expected, all)
+	assert.Equal(t, nil, restored.Close())
+}
+
+//writeHook calls hook before first write to archive
+type writeHook struct {
+	w    io.Writer
+	hook func()
+}
+
+func (p *writeHook) Write(b []byte) (int, error) {
+	if p.hook != nil {
+		p.hook()
+		p.hook = nil
+	}
+	return p.w.Write(b)
+}
+
+func TestSnapshotRotatedWhileStreaming(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "device",
+		RecordSize:        12,
+		MaxFileCount:      10,
+		FileMaxSize:       12 * 8,
+		Path:              path.Join(TMPTESTDIR, "device"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		BitSlices:         []int{64, 32},
+		Framed:            true,
+		AppendWork:        true,
+		Indexed:           true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeTwelves(t, &fl, 0, 8*3+5)
+	expected, _ := fl.ReadAll()
+
+	//Files are not held in memory or under lock while archive is written. Writer rotates first file away meanwhile
+	var archive bytes.Buffer
+	hooked := writeHook{w: &archive, hook: func() { writeTwelves(t, &fl, 8*3+5, 8*8) }}
+	assert.Equal(t, nil, fl.Snapshot(&hooked))
+	assert.Equal(t, []string{"device.manifest", "device_1", "device_2", "device"}, tarNames(t, archive.Bytes()))
+	assert.Equal(t, nil, fl.Close())
+
+	restoredCfg := cfg
+	restoredCfg.Name = "service"
+	restoredCfg.Path = path.Join(TMPTESTDIR, "service")
+	assert.Equal(t, nil, Restore(bytes.NewReader(archive.Bytes()), restoredCfg))
+	restored, errRestored := restoredCfg.InitFileStorage()
+	assert.Equal(t, nil, errRestored)
+	all, _ := restored.ReadAll()
+	assert.Equal(t, expected[12*8:], all)
+	assert.Equal(t, nil, restored.Close())
+}
+
+func TestSnapshotReadOnly(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "device",
+		RecordSize:        12,
+		MaxFileCount:      10,
+		FileMaxSize:       12 * 8,
+		Path:              path.Join(TMPTESTDIR, "device"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		BitSlices:         []int{64, 32},
+		Indexed:           true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	writeTwelves(t, &fl, 0, 8*2)
+	expected, _ := fl.ReadAll()
+
+	roCfg := cfg
+	roCfg.ReadOnly = true
+	ro, roErr := roCfg.InitFileStorage()
+	assert.Equal(t, nil, roErr)
+	var archive bytes.Buffer
+	assert.Equal(t, nil, ro.Snapshot(&archive))
+	assert.Equal(t, []string{"device.manifest", "device_0", "device_1", "device"}, tarNames(t, archive.Bytes()))
+	assert.Equal(t, nil, ro.Close())
+	assert.Equal(t, ErrClosed, ro.Snapshot(&archive))
+
+	restoredCfg := cfg
+	restoredCfg.Path = path.Join(TMPTESTDIR, "service")
+	assert.Equal(t, nil, Restore(&archive, restoredCfg))
+	restored, errRestored := restoredCfg.InitFileStorage()
+	assert.Equal(t, nil, errRestored)
+	all, _ := restored.ReadAll()
+	assert.Equal(t, expected, all)
+	assert.Equal(t, nil, restored.Close())
+}
+
+func TestSnapshotStaleWork(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "device",
+		RecordSize:        12,
+		MaxFileCount:      10,
+		FileMaxSize:       12 * 8,
+		Path:              path.Join(TMPTESTDIR, "device"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		BitSlices:         []int{64, 32},
+		Framed:            true,
+		AppendWork:        true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	writeTwelves(t, &fl, 0, 8*2)
+	expected, _ := fl.ReadAll()
+
+	//Writer is between sealing file 1 and removing work file
+	assert.Equal(t, nil, cfg.markSeal(1))
+	assert.Equal(t, nil, cfg.writeWorkFile(expected[12*8:12*11], true))
+	roCfg := cfg
+	roCfg.ReadOnly = true
+	ro, roErr := roCfg.InitFileStorage()
+	assert.Equal(t, nil, roErr)
+	var archive bytes.Buffer
+	assert.Equal(t, nil, ro.Snapshot(&archive))
+	assert.Equal(t, []string{"device.manifest", "device_0", "device_1"}, tarNames(t, archive.Bytes()))
+	all, _ := ro.ReadAll()
+	assert.Equal(t, expected, all)
+	assert.Equal(t, nil, ro.Close())
+}
+
+func TestRestoreBroken(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "device",
+		RecordSize:        12,
+		MaxFileCount:      10,
+		FileMaxSize:       12 * 8,
+		Path:              path.Join(TMPTESTDIR, "device"),
+		CompressionMethod: COMPRESSIONMETHOD_GZ,
+		BitSlices:         []int{64, 32},
+		Framed:            true,
+		AppendWork:        true,
+		Indexed:           true,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeTwelves(t, &fl, 0, 8*2+1)
+	expected, _ := fl.ReadAll()
+	var archive bytes.Buffer
+	assert.Equal(t, nil, fl.Snapshot(&archive))
+	assert.Equal(t, nil, fl.Close())
+
+	info, _ := os.Stat(cfg.filename(1))
+	corrupted := append([]byte{}, archive.Bytes()...)
+	corrupted[int64(bytes.Index(corrupted, []byte("device_1"))+512)+info.Size()/2] ^= 0xFF //Middle of second file
+	var evil bytes.Buffer
+	tw := tar.NewWriter(&evil)
+	manifest, _ := cfg.ReadManifest()
+	manifestContent := []byte(`{"version":1,"layout":{"recordSize":12,"fileMaxSize":96,"maxFileCount":10}}`)
+	assert.Equal(t, nil, tw.WriteHeader(&tar.Header{Name: "x.manifest", Mode: 0644, Size: int64(len(manifestContent)), Typeflag: tar.TypeReg}))
+	tw.Write(manifestContent)
+	assert.Equal(t, nil, tw.WriteHeader(&tar.Header{Name: "../x_0", Mode: 0644, Size: 12, Typeflag: tar.TypeReg}))
+	tw.Write(make([]byte, 12))
+	tw.Close()
+
+	for _, broken := range [][]byte{corrupted, archive.Bytes()[:archive.Len()/2], evil.Bytes(), {}} {
+		assert.NotEqual(t, nil, Restore(bytes.NewReader(broken), cfg))
+		_, errStaging := os.Stat(cfg.stagingDir())
+		assert.True(t, os.IsNotExist(errStaging))
+		fl, flErr = cfg.InitFileStorage() //Old storage is kept
+		assert.Equal(t, nil, flErr)
+		all, _ := fl.ReadAll()
+		assert.Equal(t, expected, all)
+		assert.Equal(t, nil, fl.Close())
+		manifestAfter, _ := cfg.ReadManifest()
+		assert.Equal(t, manifest, manifestAfter)
+	}
+	assert.False(t, fileExists(path.Join(TMPTESTDIR, "x_0")))
+}
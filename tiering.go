@@ -0,0 +1,274 @@
+/*
+Tiered aging of sealed files. With RawFiles set, newly sealed files are written without compression so reads of
+recent history are cheap. When file is not anymore among RawFiles newest sealed files, background goroutine
+recompresses it with CompressionMethod, CompressionLevel, BitSlices and FieldTransforms of conf.
+
+Recompressed file is written to _TMP, synced and read back for verification before it is renamed in place
+under write lock, so readers see either raw or recompressed file. Power cut leaves raw file, _TMP is rolled
+back by recovery and file is recompressed again after init.
+
+RawFiles requires Framed. Raw files have header without compression and field coding, unframed raw records could
+start like compressed file by chance. Recompressed file keeps modification time of raw file for MaxAge retention
+and its index entry is updated under same lock as rename
+*/
+package fixregsto
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+//TieringStatus tells state of background recompression
+type TieringStatus struct {
+	RawFiles     int   //Sealed files without compression, newest ones included
+	Pending      int   //Raw files waiting for recompression
+	Recompressed int64 //Files recompressed after init
+	Err          error //Last failure. Recompression is tried again after next sealed file
+}
+
+//tieringState is shared between copies of FileStorage. Fields are protected by FileStorage mu, channels are not
+type tieringState struct {
+	raw          []int64 //Raw sealed file numbers, ascending
+	rawFiles     int64
+	recompressed int64
+	err          error
+
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+//checkTiering tells can sealed files be recompressed later with this conf
+func (p *FileStorageConf) checkTiering() error {
+	if p.RawFiles < 0 {
+		return fmt.Errorf("Invalid RawFiles %v", p.RawFiles)
+	}
+	if p.RawFiles == 0 {
+		return nil
+	}
+	if len(p.CompressionMethod) == 0 {
+		return fmt.Errorf("RawFiles requires CompressionMethod for older files")
+	}
+	if !p.Framed {
+		return fmt.Errorf("RawFiles requires Framed, raw files are recognized from header")
+	}
+	return nil
+}
+
+//sealingConf is conf for writing new sealed file. With RawFiles file is written without compression
+func (p *FileStorageConf) sealingConf() *FileStorageConf {
+	if p.RawFiles == 0 {
+		return p
+	}
+	result := *p //Header tells there is no compression and coding
+	result.CompressionMethod = ""
+	result.BitSlices = nil
+	result.FieldTransforms = nil
+	result.Schema = nil
+	return &result
+}
+
+//isRawFile tells is numbered file written without compression. Unframed files in framed storage are left as they are
+func (p *FileStorageConf) isRawFile(fileNumber int64) (bool, error) {
+	filename := p.filename(fileNumber)
+	f, errOpen := os.Open(filename)
+	if errOpen != nil {
+		return false, errOpen
+	}
+	head := make([]byte, 16) //Longer than magics
+	n, errRead := io.ReadFull(f, head)
+	f.Close()
+	if errRead != nil && errRead != io.ErrUnexpectedEOF {
+		return false, errRead
+	}
+	if !isFramed(head[:n]) {
+		return false, nil
+	}
+	header, errHeader := readFramedFileHeader(filename)
+	if errHeader != nil {
+		return false, errHeader
+	}
+	return len(header.CompressionMethod) == 0, nil
+}
+
+//newTieringState finds raw files left from earlier run
+func (p *FileStorageConf) newTieringState(numbers []int64) (*tieringState, error) {
+	result := tieringState{raw: []int64{}, rawFiles: p.RawFiles, wake: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	for _, fileNumber := range numbers {
+		raw, errRaw := p.isRawFile(fileNumber)
+		if os.IsNotExist(errRaw) {
+			continue
+		}
+		if errRaw != nil {
+			return nil, errRaw
+		}
+		if raw {
+			result.raw = append(result.raw, fileNumber)
+		}
+	}
+	sort.Slice(result.raw, func(i, j int) bool { return result.raw[i] < result.raw[j] })
+	return &result, nil
+}
+
+//sealed adds new raw file and wakes recompression. Caller holds write lock
+func (p *tieringState) sealed(fileNumber int64) {
+	if p == nil {
+		return
+	}
+	p.raw = append(p.raw, fileNumber)
+	select {
+	case p.wake <- struct{}{}:
+	default: //Already woken
+	}
+}
+
+//forget drops removed file. Caller holds write lock
+func (p *tieringState) forget(fileNumber int64) {
+	if p == nil {
+		return
+	}
+	for i, n := range p.raw {
+		if n == fileNumber {
+			p.raw = append(p.raw[:i], p.raw[i+1:]...)
+			return
+		}
+	}
+}
+
+//pending lists raw files that are not anymore among newest ones, oldest first
+func (p *tieringState) pending() []int64 {
+	if int64(len(p.raw)) <= p.rawFiles {
+		return nil
+	}
+	return p.raw[:int64(len(p.raw))-p.rawFiles]
+}
+
+//halt stops background recompression and waits it to finish. Returns last recompression error
+func (p *tieringState) halt() error {
+	if p == nil {
+		return nil
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+	return p.err
+}
+
+//startTiering starts background recompression. Goroutine has own copy of FileStorage and uses only shared fields
+func (p *FileStorage) startTiering() {
+	worker := *p
+	go worker.runTiering()
+	p.tiering.wake <- struct{}{} //Raw files from earlier run
+}
+
+func (p *FileStorage) runTiering() {
+	state := p.tiering
+	defer close(state.done)
+	for {
+		select {
+		case <-state.stop:
+			return
+		case <-state.wake:
+		}
+		for {
+			select {
+			case <-state.stop:
+				return
+			default:
+			}
+			more, errRecompress := p.recompressNext()
+			if errRecompress != nil {
+				p.mu.Lock()
+				state.err = errRecompress
+				p.mu.Unlock()
+				break
+			}
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+//recompressNext recompresses oldest pending raw file. Encoding and verification is done without lock,
+//only rename is done under write lock. Returns false when there is nothing to do
+func (p *FileStorage) recompressNext() (bool, error) {
+	p.mu.RLock()
+	pending := p.tiering.pending()
+	if p.closed.closed || len(pending) == 0 {
+		p.mu.RUnlock()
+		return false, nil
+	}
+	fileNumber := pending[0]
+	p.mu.RUnlock()
+
+	//Sealed file does not change, it can only be removed meanwhile
+	filename := p.conf.filename(fileNumber)
+	records, errRead := p.conf.ReadFileWithNumber(fileNumber)
+	if os.IsNotExist(errRead) {
+		p.mu.Lock()
+		p.tiering.forget(fileNumber)
+		p.mu.Unlock()
+		return true, nil
+	}
+	if errRead != nil { //Corrupted raw file is left as it is
+		p.mu.Lock()
+		p.tiering.forget(fileNumber)
+		p.mu.Unlock()
+		return false, fmt.Errorf("Error reading %v for recompression err=%v", filename, errRead)
+	}
+	content, errEncode := p.conf.encodeSealed(records)
+	if errEncode != nil {
+		return false, errEncode
+	}
+	if _, errTmp := writeTmpFile(filename, content, true); errTmp != nil {
+		os.Remove(filename + "_TMP")
+		return false, errTmp
+	}
+	if errVerify := p.conf.verifySealedFile(filename+"_TMP", records); errVerify != nil {
+		os.Remove(filename + "_TMP")
+		return false, errVerify
+	}
+	if errTime := keepModTime(filename+"_TMP", filename); errTime != nil { //Age of records does not change
+		os.Remove(filename + "_TMP")
+		return false, errTime
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stillRaw := false
+	for _, n := range p.tiering.raw {
+		stillRaw = stillRaw || n == fileNumber
+	}
+	if p.closed.closed || !stillRaw { //Removed while recompressing
+		os.Remove(filename + "_TMP")
+		return !p.closed.closed, nil
+	}
+	if errRename := renameTmpFile(filename, true); errRename != nil {
+		return false, errRename
+	}
+	p.tiering.forget(fileNumber)
+	p.tiering.recompressed++
+	if info, errStat := os.Stat(filename); errStat == nil { //Same records, no need to decompress again
+		p.cache.put(fileNumber, info, records)
+	}
+	return true, p.replaceIndexEntry(fileNumber, records)
+}
+
+//TieringStatus tells how many sealed files are raw and waiting for recompression
+func (p *FileStorage) TieringStatus() TieringStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.tiering == nil {
+		return TieringStatus{}
+	}
+	return TieringStatus{
+		RawFiles:     len(p.tiering.raw),
+		Pending:      len(p.tiering.pending()),
+		Recompressed: p.tiering.recompressed,
+		Err:          p.tiering.err,
+	}
+}
@@ -0,0 +1,143 @@
+package fixregsto
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitTiering(t *testing.T, fl *FileStorage) {
+	assert.Eventually(t, func() bool { return fl.TieringStatus().Pending == 0 }, 5*time.Second, time.Millisecond)
+}
+
+func TestTiering(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		os.RemoveAll(TMPTESTDIR)
+		cfg := FileStorageConf{
+			Name:              "tiered",
+			RecordSize:        8,
+			MaxFileCount:      100,
+			FileMaxSize:       64,
+			Path:              TMPTESTDIR,
+			CompressionMethod: COMPRESSIONMETHOD_ZSTD,
+			BitSlices:         []int{32, 32},
+			FieldTransforms:   []string{TRANSFORM_DELTA, ""},
+			Framed:            true,
+			RawFiles:          2,
+			Indexed:           indexed,
+		}
+		assert.Equal(t, nil, cfg.CheckErrors())
+		fl, flErr := cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		writeCounters(t, &fl, 0, 8)
+		sealedAt := time.Now().Add(-time.Hour)
+		assert.Equal(t, nil, os.Chtimes(cfg.filename(0), sealedAt, sealedAt))
+		writeCounters(t, &fl, 8, 8*4+3)
+		waitTiering(t, &fl)
+		status := fl.TieringStatus()
+		assert.Equal(t, TieringStatus{RawFiles: 2, Recompressed: 3}, status)
+		for fileNumber := int64(0); fileNumber < 5; fileNumber++ {
+			raw, errRaw := cfg.isRawFile(fileNumber)
+			assert.Equal(t, nil, errRaw)
+			assert.Equal(t, 3 <= fileNumber, raw, "file %v", fileNumber)
+		}
+		info, _ := os.Stat(cfg.filename(0))
+		assert.True(t, info.ModTime().Equal(sealedAt), "recompressed file keeps modification time")
+		if indexed {
+			assert.Equal(t, nil, fl.VerifyIndex())
+		}
+		all, errAll := fl.ReadAll()
+		assert.Equal(t, nil, errAll)
+		assert.Equal(t, 8*5+3, len(all)/8)
+		for i := 0; i < len(all)/8; i++ {
+			assert.Equal(t, counterRecord(i), all[i*8:i*8+8])
+		}
+		assert.Equal(t, nil, fl.Close())
+
+		//Fewer raw files, older ones are recompressed after init
+		cfg.RawFiles = 1
+		fl, flErr = cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		waitTiering(t, &fl)
+		assert.Equal(t, int64(1), fl.TieringStatus().Recompressed)
+		latest, _ := fl.GetLatest(8*2 + 3)
+		assert.Equal(t, all[8*3*8:], latest)
+		assert.Equal(t, nil, fl.Close())
+
+		//Reader without tiering decodes both kinds of files
+		cfg.RawFiles = 0
+		cfg.ReadOnly = true
+		fl, flErr = cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		allAgain, _ := fl.ReadAll()
+		assert.Equal(t, all, allAgain)
+		assert.Equal(t, TieringStatus{}, fl.TieringStatus())
+		assert.Equal(t, nil, fl.Close())
+	}
+}
+
+func TestTieringInterrupted(t *testing.T) {
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{
+		Name:              "tiered",
+		RecordSize:        8,
+		MaxFileCount:      3,
+		FileMaxSize:       64,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_ZSTD,
+		BitSlices:         []int{32, 32},
+		FieldTransforms:   []string{TRANSFORM_DELTA, ""},
+		Framed:            true,
+		RawFiles:          10,
+	}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	writeCounters(t, &fl, 0, 8*3)
+	expected, _ := fl.ReadAll()
+	assert.Equal(t, nil, fl.Close())
+
+	//Power cut in middle of writing recompressed file
+	assert.Equal(t, nil, os.WriteFile(cfg.filename(0)+"_TMP", []byte("FXRF"), 0666))
+	cfg.RawFiles = 1
+	fl, flErr = cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	assert.Equal(t, []string{cfg.filename(0) + "_TMP"}, fl.RecoveryReport().RolledBack)
+	waitTiering(t, &fl)
+	assert.Equal(t, int64(2), fl.TieringStatus().Recompressed)
+	all, _ := fl.ReadAll()
+	assert.Equal(t, expected, all)
+
+	//Removed raw files are not waited
+	writeCounters(t, &fl, 8*3, 8*3)
+	waitTiering(t, &fl)
+	assert.Equal(t, TieringStatus{RawFiles: 1, Recompressed: 4}, fl.TieringStatus())
+	all, _ = fl.ReadAll()
+	assert.Equal(t, 8*3, len(all)/8)
+	assert.Equal(t, nil, fl.Close())
+	assert.Equal(t, ErrClosed, fl.Close())
+}
+
+func TestTieringConf(t *testing.T) {
+	registerXorCodec(t)
+	cfg := FileStorageConf{
+		Name:              "tiered",
+		RecordSize:        8,
+		MaxFileCount:      100,
+		FileMaxSize:       64,
+		Path:              TMPTESTDIR,
+		CompressionMethod: COMPRESSIONMETHOD_ZSTD,
+		BitSlices:         []int{32, 32},
+		FieldTransforms:   []string{TRANSFORM_DELTA, ""},
+		RawFiles:          2,
+	}
+	assert.NotEqual(t, nil, cfg.CheckErrors()) //Raw files could not be told from compressed
+	cfg.Framed = true
+	cfg.CompressionMethod = "xortest"
+	assert.Equal(t, nil, cfg.CheckErrors())
+	cfg.CompressionMethod = ""
+	assert.NotEqual(t, nil, cfg.CheckErrors())
+	cfg.RawFiles = -1
+	assert.NotEqual(t, nil, cfg.CheckErrors())
+}
@@ -0,0 +1,205 @@
+/*
+Per field transforms before bit slicing and compression. Counters and timestamps change only little on every record,
+so difference to previous record compresses much better than value itself.
+
+Transforms are listed per bit slice and chained with "+", like "delta+zigzag". Chain is applied from left on write and
+reversed on read. Transforms start from zero on every file, so each file decodes alone.
+Arithmetic wraps on field width, so any value comes back exactly.
+*/
+package fixregsto
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	TRANSFORM_DELTA  = "delta"  //Difference to previous record
+	TRANSFORM_DELTA2 = "delta2" //Delta of delta. For timestamps with steady interval
+	TRANSFORM_ZIGZAG = "zigzag" //Signed to unsigned, small negative values are small. Use after delta on signed or decreasing fields
+	TRANSFORM_XOR    = "xor"    //XOR with previous record like on Gorilla. For floats, unchanged high bits become zero
+)
+
+//fieldCoding is how records are coded before compression. Fields are transformed and then bit sliced
+type fieldCoding struct {
+	bitSlices  []int
+	transforms []string //Per bit slice, empty is no transform
+	bigEndian  []bool   //Per bit slice, byte order of field value on transforms
+}
+
+//coding collects field coding from configuration. Byte order is from Schema, default is little endian
+func (p *FileStorageConf) coding() fieldCoding {
+	result := fieldCoding{bitSlices: p.bitSlices(), transforms: p.FieldTransforms}
+	if p.Schema != nil && len(p.Schema.Fields) == len(result.bitSlices) {
+		result.bigEndian = make([]bool, len(p.Schema.Fields))
+		for i, field := range p.Schema.Fields {
+			result.bigEndian[i] = field.BigEndian
+		}
+	}
+	return result
+}
+
+//hasTransforms tells is any field transformed
+func (p *fieldCoding) hasTransforms() bool {
+	for _, transform := range p.transforms {
+		if 0 < len(transform) {
+			return true
+		}
+	}
+	return false
+}
+
+//CheckErrors checks that transforms are known and match bit slices
+func (p *fieldCoding) CheckErrors() error {
+	if !p.hasTransforms() {
+		return nil
+	}
+	if len(p.transforms) != len(p.bitSlices) {
+		return fmt.Errorf("have %v transforms and %v bit slices, must be one per slice", len(p.transforms), len(p.bitSlices))
+	}
+	if 0 < len(p.bigEndian) && len(p.bigEndian) != len(p.bitSlices) {
+		return fmt.Errorf("have %v byte orders and %v bit slices", len(p.bigEndian), len(p.bitSlices))
+	}
+	for i, transform := range p.transforms {
+		if len(transform) == 0 {
+			continue
+		}
+		if 64 < p.bitSlices[i] || p.bitSlices[i] < 1 {
+			return fmt.Errorf("transform %v on %v bit field, must be 1-64 bits", transform, p.bitSlices[i])
+		}
+		if 255 < len(transform) {
+			return fmt.Errorf("transform %v too long", transform)
+		}
+		if _, errStages := parseTransform(transform, p.bitSlices[i]); errStages != nil {
+			return errStages
+		}
+	}
+	return nil
+}
+
+func (p *fieldCoding) isBigEndian(i int) bool {
+	return i < len(p.bigEndian) && p.bigEndian[i]
+}
+
+//encode transforms and slices records
+func (p *fieldCoding) encode(records []byte) ([]byte, error) {
+	transformed, errTransform := p.transform(records, true)
+	if errTransform != nil {
+		return nil, errTransform
+	}
+	return sliceBitArr(transformed, p.bitSlices)
+}
+
+//decode reverses encode
+func (p *fieldCoding) decode(sliced []byte) ([]byte, error) {
+	unsliced, errUnslice := unsliceBitArr(sliced, p.bitSlices)
+	if errUnslice != nil {
+		return nil, errUnslice
+	}
+	return p.transform(unsliced, false)
+}
+
+//transform runs transforms forward or backward on copy of records
+func (p *fieldCoding) transform(records []byte, forward bool) ([]byte, error) {
+	if !p.hasTransforms() {
+		return records, nil
+	}
+	if errCheck := p.CheckErrors(); errCheck != nil {
+		return nil, errCheck
+	}
+	structsize := sumIntArr(p.bitSlices)
+	totalBits := len(records) * 8
+	if totalBits%structsize != 0 {
+		return nil, fmt.Errorf("got %v bits, must be multiple of pattern size %v", totalBits, structsize)
+	}
+	result := append([]byte{}, records...)
+	offset := 0
+	for i, bits := range p.bitSlices {
+		if len(p.transforms[i]) == 0 {
+			offset += bits
+			continue
+		}
+		stages, _ := parseTransform(p.transforms[i], bits)
+		bigEndian := p.isBigEndian(i)
+		for pos := offset; pos < totalBits; pos += structsize {
+			value := readField(result, pos, bits, bigEndian)
+			if forward {
+				for j := range stages {
+					value = stages[j].encode(value)
+				}
+			} else {
+				for j := len(stages) - 1; 0 <= j; j-- {
+					value = stages[j].decode(value)
+				}
+			}
+			writeField(result, pos, bits, bigEndian, value)
+		}
+		offset += bits
+	}
+	return result, nil
+}
+
+//transformStage is one transform in chain, with state from previous record
+type transformStage struct {
+	kind      string
+	bits      uint
+	mask      uint64
+	prev      uint64
+	prevDelta uint64
+}
+
+func parseTransform(transform string, bits int) ([]transformStage, error) {
+	result := []transformStage{}
+	for _, kind := range strings.Split(transform, "+") {
+		switch kind {
+		case TRANSFORM_DELTA, TRANSFORM_DELTA2, TRANSFORM_ZIGZAG, TRANSFORM_XOR:
+			result = append(result, transformStage{kind: kind, bits: uint(bits), mask: math.MaxUint64 >> (64 - uint(bits))})
+		default:
+			return nil, fmt.Errorf("unknown transform %#v", kind)
+		}
+	}
+	return result, nil
+}
+
+func (p *transformStage) encode(value uint64) uint64 {
+	switch p.kind {
+	case TRANSFORM_DELTA:
+		result := (value - p.prev) & p.mask
+		p.prev = value
+		return result
+	case TRANSFORM_DELTA2:
+		delta := (value - p.prev) & p.mask
+		result := (delta - p.prevDelta) & p.mask
+		p.prev = value
+		p.prevDelta = delta
+		return result
+	case TRANSFORM_ZIGZAG:
+		shift := 64 - p.bits
+		signed := int64(value<<shift) >> shift
+		return uint64(signed<<1^signed>>63) & p.mask
+	case TRANSFORM_XOR:
+		result := value ^ p.prev
+		p.prev = value
+		return result
+	}
+	return value
+}
+
+func (p *transformStage) decode(value uint64) uint64 {
+	switch p.kind {
+	case TRANSFORM_DELTA:
+		p.prev = (p.prev + value) & p.mask
+		return p.prev
+	case TRANSFORM_DELTA2:
+		p.prevDelta = (p.prevDelta + value) & p.mask
+		p.prev = (p.prev + p.prevDelta) & p.mask
+		return p.prev
+	case TRANSFORM_ZIGZAG:
+		return (value>>1 ^ -(value & 1)) & p.mask
+	case TRANSFORM_XOR:
+		p.prev ^= value
+		return p.prev
+	}
+	return value
+}
@@ -0,0 +1,106 @@
+package fixregsto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransformStages(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for _, transform := range []string{TRANSFORM_DELTA, TRANSFORM_DELTA2, TRANSFORM_ZIGZAG, TRANSFORM_XOR, "delta+zigzag", "delta2+zigzag", "xor+delta"} {
+		for _, bits := range []int{1, 3, 8, 13, 32, 64} {
+			coding := fieldCoding{bitSlices: []int{bits, 7, 64}, transforms: []string{transform, "", transform}, bigEndian: []bool{false, false, true}}
+			assert.Equal(t, nil, coding.CheckErrors(), "%v %v", transform, bits)
+			records := make([]byte, (bits+7+64)*16/8)
+			rnd.Read(records)
+			encoded, errEncode := coding.encode(records)
+			assert.Equal(t, nil, errEncode)
+			decoded, errDecode := coding.decode(encoded)
+			assert.Equal(t, nil, errDecode)
+			assert.Equal(t, records, decoded, "%v %v", transform, bits)
+		}
+	}
+
+	zigzag, _ := parseTransform(TRANSFORM_ZIGZAG, 8)
+	assert.Equal(t, uint64(1), zigzag[0].encode(0xFF)) //-1
+	assert.Equal(t, uint64(2), zigzag[0].encode(1))
+	assert.Equal(t, uint64(0xFF), zigzag[0].encode(0x80)) //-128
+
+	assert.NotEqual(t, nil, (&fieldCoding{bitSlices: []int{8, 8}, transforms: []string{"delta"}}).CheckErrors())
+	assert.NotEqual(t, nil, (&fieldCoding{bitSlices: []int{8}, transforms: []string{"delta+lz"}}).CheckErrors())
+	assert.NotEqual(t, nil, (&fieldCoding{bitSlices: []int{128}, transforms: []string{"delta"}}).CheckErrors())
+}
+
+//counterRecords are timestamp with steady interval, slowly changing counter and float measurement
+func counterRecords(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		binary.Write(&buf, binary.LittleEndian, uint32(1600000000+10*i))
+		binary.Write(&buf, binary.LittleEndian, uint32(i*i/7))
+		binary.Write(&buf, binary.LittleEndian, math.Float64bits(20+math.Sin(float64(i)/100)))
+	}
+	return buf.Bytes()
+}
+
+func gzLen(content []byte) int {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(content)
+	zw.Close()
+	return buf.Len()
+}
+
+func TestTransformCompresses(t *testing.T) {
+	records := counterRecords(1000)
+	plain := fieldCoding{bitSlices: []int{32, 32, 64}}
+	transformed := fieldCoding{bitSlices: []int{32, 32, 64}, transforms: []string{TRANSFORM_DELTA2, TRANSFORM_DELTA, TRANSFORM_XOR}}
+	plainSliced, _ := plain.encode(records)
+	transformedSliced, _ := transformed.encode(records)
+	assert.True(t, gzLen(transformedSliced)*2 < gzLen(plainSliced), "transformed %v plain %v", gzLen(transformedSliced), gzLen(plainSliced))
+}
+
+func TestTransformStorage(t *testing.T) {
+	for _, framed := range []bool{false, true} {
+		os.RemoveAll(TMPTESTDIR)
+		cfg := FileStorageConf{
+			Name:              "transformed",
+			RecordSize:        16,
+			MaxFileCount:      8,
+			FileMaxSize:       16 * 64,
+			Path:              TMPTESTDIR,
+			CompressionMethod: COMPRESSIONMETHOD_GZ,
+			BitSlices:         []int{32, 32, 64},
+			FieldTransforms:   []string{TRANSFORM_DELTA2, "delta+zigzag", TRANSFORM_XOR},
+			Framed:            framed,
+		}
+		assert.Equal(t, nil, cfg.CheckErrors())
+		fl, flErr := cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		records := counterRecords(300)
+		_, errWrite := fl.Write(records)
+		assert.Equal(t, nil, errWrite)
+		assert.Equal(t, nil, fl.Close())
+
+		fl, flErr = cfg.InitFileStorage()
+		assert.Equal(t, nil, flErr)
+		all, errAll := fl.ReadAll()
+		assert.Equal(t, nil, errAll)
+		assert.Equal(t, records, all)
+		assert.Equal(t, nil, fl.Close())
+
+		if framed { //Header tells transforms
+			header, fromFile, errRead := ReadFramedFile(cfg.filename(0))
+			assert.Equal(t, nil, errRead)
+			assert.Equal(t, FRAMEDVERSION, header.Version)
+			assert.Equal(t, cfg.FieldTransforms, header.Transforms)
+			assert.Equal(t, records[:16*64], fromFile)
+		}
+	}
+}
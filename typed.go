@@ -0,0 +1,168 @@
+/*
+TypedStore wraps any FixRegSto and moves go values in and out with encoding/binary.
+T must be fixed size (see binary.Size), like struct of sized integers, floats, bools and arrays of those
+*/
+package fixregsto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//TYPEDBATCHRECORDS is how many records iterator reads at once
+const TYPEDBATCHRECORDS = 64
+
+//RecordSizer is storage that tells its record size. All storages in this package implement it
+type RecordSizer interface {
+	RecordSize() int64
+}
+
+//cursorOpener is storage that gives independent cursors
+type cursorOpener interface {
+	NewCursor() (*Cursor, error)
+}
+
+//TypedStore reads and writes records as T
+type TypedStore[T any] struct {
+	sto        FixRegSto
+	order      binary.ByteOrder
+	recordSize int64
+}
+
+//NewTypedStore checks that binary size of T is record size of storage. Storage must implement RecordSizer
+func NewTypedStore[T any](sto FixRegSto, order binary.ByteOrder) (TypedStore[T], error) {
+	var zero T
+	size := binary.Size(zero)
+	if size <= 0 {
+		return TypedStore[T]{}, fmt.Errorf("type %T is not fixed size", zero)
+	}
+	sizer, haz := sto.(RecordSizer)
+	if !haz {
+		return TypedStore[T]{}, fmt.Errorf("storage %T does not tell record size", sto)
+	}
+	if int64(size) != sizer.RecordSize() {
+		return TypedStore[T]{}, fmt.Errorf("type %T is %v bytes, record size is %v", zero, size, sizer.RecordSize())
+	}
+	return TypedStore[T]{sto: sto, order: order, recordSize: int64(size)}, nil
+}
+
+//Storage returns wrapped storage
+func (p *TypedStore[T]) Storage() FixRegSto {
+	return p.sto
+}
+
+//Append writes values with one Write
+func (p *TypedStore[T]) Append(values ...T) error {
+	if len(values) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if errEncode := binary.Write(&buf, p.order, values); errEncode != nil {
+		return errEncode
+	}
+	_, errWrite := p.sto.Write(buf.Bytes())
+	return errWrite
+}
+
+//Len is number of records
+func (p *TypedStore[T]) Len() (int64, error) {
+	return p.sto.Len()
+}
+
+//Latest returns up to n latest records, oldest first
+func (p *TypedStore[T]) Latest(n int64) ([]T, error) {
+	raw, errRead := p.sto.GetLatest(n)
+	if errRead != nil {
+		return nil, errRead
+	}
+	return p.decode(raw)
+}
+
+//First returns up to n first records
+func (p *TypedStore[T]) First(n int64) ([]T, error) {
+	raw, errRead := p.sto.GetFirst(n)
+	if errRead != nil {
+		return nil, errRead
+	}
+	return p.decode(raw)
+}
+
+func (p *TypedStore[T]) decode(raw []byte) ([]T, error) {
+	if int64(len(raw))%p.recordSize != 0 {
+		return nil, fmt.Errorf("got %v bytes, not multiple of record size %v", len(raw), p.recordSize)
+	}
+	result := make([]T, int64(len(raw))/p.recordSize)
+	if errDecode := binary.Read(bytes.NewReader(raw), p.order, result); errDecode != nil {
+		return nil, errDecode
+	}
+	return result, nil
+}
+
+//Iterator starts from offset counted in records, whence like on Seek.
+//Iterator has own cursor if storage supports NewCursor, otherwise it moves read position of storage
+func (p *TypedStore[T]) Iterator(offset int64, whence int) (*TypedIterator[T], error) {
+	var reader io.ReadSeeker = p.sto
+	if opener, haz := p.sto.(cursorOpener); haz {
+		cursor, errCursor := opener.NewCursor()
+		if errCursor != nil {
+			return nil, errCursor
+		}
+		reader = cursor
+	}
+	if _, errSeek := reader.Seek(offset*p.recordSize, whence); errSeek != nil {
+		return nil, errSeek
+	}
+	return &TypedIterator[T]{store: p, reader: reader, buf: make([]byte, TYPEDBATCHRECORDS*p.recordSize)}, nil
+}
+
+//TypedIterator goes through records like bufio.Scanner
+//	for it.Next() {
+//		v := it.Value()
+//	}
+//	if it.Err() != nil {
+type TypedIterator[T any] struct {
+	store   *TypedStore[T]
+	reader  io.ReadSeeker
+	buf     []byte
+	pending []T
+	value   T
+	err     error
+}
+
+//Next moves to next record. Returns false when records ran out or on error. Records read together with
+//error are returned first. Calling Next again after end continues from records written after that
+func (p *TypedIterator[T]) Next() bool {
+	if len(p.pending) == 0 {
+		if p.err != nil {
+			return false
+		}
+		n, errRead := p.reader.Read(p.buf)
+		if errRead != nil && errRead != io.EOF {
+			p.err = errRead //Stops after records read with it
+		}
+		if n == 0 {
+			return false
+		}
+		var errDecode error
+		p.pending, errDecode = p.store.decode(p.buf[:n])
+		if errDecode != nil {
+			p.err = errDecode
+			return false
+		}
+	}
+	p.value = p.pending[0]
+	p.pending = p.pending[1:]
+	return true
+}
+
+//Value is record from latest successful Next
+func (p *TypedIterator[T]) Value() T {
+	return p.value
+}
+
+//Err is first error that stopped iteration. End of records is not error
+func (p *TypedIterator[T]) Err() error {
+	return p.err
+}
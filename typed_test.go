@@ -0,0 +1,104 @@
+package fixregsto
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type typedTestRecord struct {
+	Timestamp uint32
+	Value     int16
+	Flags     [2]uint8
+}
+
+func typedTest(t *testing.T, sto FixRegSto) {
+	store, errStore := NewTypedStore[typedTestRecord](sto, binary.LittleEndian)
+	assert.Equal(t, nil, errStore)
+
+	it, errIt := store.Iterator(0, io.SeekStart)
+	assert.Equal(t, nil, errIt)
+	assert.False(t, it.Next())
+
+	for i := 0; i < 50; i++ {
+		assert.Equal(t, nil, store.Append(typedTestRecord{Timestamp: uint32(i), Value: int16(-i)}, typedTestRecord{Timestamp: uint32(i), Flags: [2]uint8{1, 2}}))
+	}
+	n, errLen := store.Len()
+	assert.Equal(t, nil, errLen)
+	assert.Equal(t, int64(100), n)
+
+	first, errFirst := store.First(2)
+	assert.Equal(t, nil, errFirst)
+	assert.Equal(t, []typedTestRecord{{Timestamp: 0}, {Timestamp: 0, Flags: [2]uint8{1, 2}}}, first)
+	latest, errLatest := store.Latest(1)
+	assert.Equal(t, nil, errLatest)
+	assert.Equal(t, []typedTestRecord{{Timestamp: 49, Flags: [2]uint8{1, 2}}}, latest)
+
+	count := 0
+	for it.Next() {
+		assert.Equal(t, uint32(count/2), it.Value().Timestamp)
+		count++
+	}
+	assert.Equal(t, nil, it.Err())
+	assert.Equal(t, 100, count)
+
+	assert.Equal(t, nil, store.Append(typedTestRecord{Timestamp: 50}))
+	assert.True(t, it.Next()) //Continues with new records
+	assert.Equal(t, uint32(50), it.Value().Timestamp)
+
+	fromEnd, _ := store.Iterator(-3, io.SeekEnd)
+	count = 0
+	for fromEnd.Next() {
+		count++
+	}
+	assert.Equal(t, 3, count)
+}
+
+//failingReader returns records together with error
+type failingReader struct {
+	io.ReadSeeker
+	records []byte
+}
+
+func (p *failingReader) Read(b []byte) (int, error) {
+	n := copy(b, p.records)
+	p.records = p.records[n:]
+	return n, io.ErrUnexpectedEOF
+}
+
+func TestTypedIteratorReadError(t *testing.T) {
+	memCfg := MemloopConf{RecordSize: 8, MaxRecords: 10}
+	mem, _ := memCfg.InitMemLoop()
+	store, errStore := NewTypedStore[typedTestRecord](&mem, binary.LittleEndian)
+	assert.Equal(t, nil, errStore)
+	records := make([]byte, 8*2)
+	records[8] = 1
+	it := TypedIterator[typedTestRecord]{store: &store, reader: &failingReader{records: records}, buf: make([]byte, 8*4)}
+	assert.True(t, it.Next())
+	assert.True(t, it.Next())
+	assert.Equal(t, uint32(1), it.Value().Timestamp)
+	assert.Equal(t, io.ErrUnexpectedEOF, it.Err())
+	assert.False(t, it.Next())
+	assert.Equal(t, io.ErrUnexpectedEOF, it.Err())
+}
+
+func TestTypedStore(t *testing.T) {
+	memCfg := MemloopConf{RecordSize: 8, MaxRecords: 1000}
+	mem, _ := memCfg.InitMemLoop()
+	typedTest(t, &mem)
+
+	os.RemoveAll(TMPTESTDIR)
+	cfg := FileStorageConf{Name: "typed", RecordSize: 8, MaxFileCount: 10, FileMaxSize: 8 * 16, Path: TMPTESTDIR}
+	fl, flErr := cfg.InitFileStorage()
+	assert.Equal(t, nil, flErr)
+	defer fl.Close()
+	typedTest(t, &fl)
+
+	_, errSize := NewTypedStore[uint32](&mem, binary.LittleEndian)
+	assert.NotEqual(t, nil, errSize)
+	_, errNotFixed := NewTypedStore[[]byte](&mem, binary.LittleEndian)
+	assert.NotEqual(t, nil, errNotFixed)
+}
@@ -5,15 +5,12 @@ package fixregsto
 
 import (
 	"bytes"
-	"compress/gzip"
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
-const COMPRESSIONMETHOD_GZ = "gz" //TODO other compression methods?
-
 //filenameOk tells is name acceptable for operational system
 func filenameOk(filename string) bool {
 	_, err := os.Stat(filename)
@@ -39,6 +36,9 @@ func listFileSizes(path string, prefix string) (map[string]int, error) {
 	for _, entry := range fEntries {
 		if strings.HasPrefix(entry.Name(), prefix) {
 			fInfo, errFinfo := entry.Info()
+			if os.IsNotExist(errFinfo) {
+				continue //Removed after listing
+			}
 			if errFinfo != nil {
 				return result, errFinfo
 			}
@@ -48,86 +48,95 @@ func listFileSizes(path string, prefix string) (map[string]int, error) {
 	return result, nil
 }
 
-func readCompressedFile(filename string, method string, bitslices []int) ([]byte, error) {
+//compressBytes compresses content with method. Empty method is no compression
+func compressBytes(content []byte, method string, level int) ([]byte, error) {
 	if len(method) == 0 {
-		content, readErr := os.ReadFile(filename)
-		if readErr != nil {
-			return nil, readErr
-		}
-		return unsliceBitArr(content, bitslices)
+		return content, nil
 	}
-	if method != COMPRESSIONMETHOD_GZ {
-		return nil, fmt.Errorf("only gz is supported not, %s", method)
+	codec, errCodec := GetCodec(method)
+	if errCodec != nil {
+		return nil, errCodec
 	}
+	return codec.Compress(content, level)
+}
 
-	f, fErr := os.Open(filename)
-	if fErr != nil {
-		return nil, fErr
+//decompressBytes reverses compressBytes
+func decompressBytes(content []byte, method string) ([]byte, error) {
+	if len(method) == 0 {
+		return content, nil
+	}
+	codec, errCodec := GetCodec(method)
+	if errCodec != nil {
+		return nil, errCodec
 	}
+	return codec.Decompress(content)
+}
 
-	zr, zrErr := gzip.NewReader(f)
-	if zrErr != nil {
-		return nil, zrErr
+//decompressDetect is decompressBytes for files without header. Codec is recognized from magic, file might be written
+//with other method than configured now. Content without any known magic is not compressed.
+//rawSize is length of uncompressed content if known, otherwise 0. Content of that length that fails to decompress
+//is file written before compression was enabled, starting with magic by chance
+func decompressDetect(content []byte, method string, rawSize int64) ([]byte, error) {
+	var errFirst error
+	for _, detected := range detectCodecs(content, method) {
+		result, errDecompress := decompressBytes(content, detected)
+		if errDecompress == nil {
+			return result, nil
+		}
+		if errFirst == nil {
+			errFirst = errDecompress
+		}
+	}
+	if len(method) == 0 || (0 < rawSize && int64(len(content)) == rawSize) { //Uncompressed, magic was there by chance
+		return content, nil
+	}
+	if errFirst != nil {
+		return nil, errFirst
+	}
+	codec, errCodec := GetCodec(method)
+	if errCodec != nil {
+		return nil, errCodec
+	}
+	if len(codec.Magic()) == 0 { //Can not be recognized, trust configuration
+		return codec.Decompress(content)
 	}
+	return content, nil //Written before compression was enabled
+}
 
-	result, readErr := io.ReadAll(zr)
+func readCompressedFile(filename string, method string, coding fieldCoding) ([]byte, error) {
+	content, readErr := os.ReadFile(filename)
 	if readErr != nil {
 		return nil, readErr
 	}
-
-	zcloseErr := zr.Close()
-	if zcloseErr != nil {
-		return nil, zcloseErr
+	result, decompressErr := decompressDetect(content, method, 0)
+	if decompressErr != nil {
+		return nil, decompressErr
 	}
-
-	return unsliceBitArr(result, bitslices)
+	return coding.decode(result)
 }
 
-//Paranoidic way to write file with compression. And slice and re-arrange bits for better compression
-func writeWithFsyncCowCompressed(filename string, contentOriginal []byte, method string, bitslices []int) (int, error) {
-	content, slicingError := sliceBitArr(contentOriginal, bitslices)
+//Paranoidic way to write file with compression. And transform fields, slice and re-arrange bits for better compression
+func writeWithFsyncCowCompressed(filename string, contentOriginal []byte, method string, level int, coding fieldCoding) (int, error) {
+	content, slicingError := coding.encode(contentOriginal)
 	if slicingError != nil {
 		return 0, slicingError
 	}
 
-	if len(method) == 0 {
-		return writeWithFsyncCow(filename, content)
-	}
-	if method != COMPRESSIONMETHOD_GZ {
-		return 0, fmt.Errorf("only gz is supported not, %s", method)
-	}
-
-	f, errOpen := os.OpenFile(filename+"_TMP", os.O_RDWR|os.O_CREATE, 0755)
-	if errOpen != nil {
-		return 0, errOpen
+	compressed, compressErr := compressBytes(content, method, level)
+	if compressErr != nil {
+		return 0, compressErr
 	}
-
-	zw := gzip.NewWriter(f)
-	n, wErr := zw.Write(content)
+	_, wErr := writeWithFsyncCow(filename, compressed)
 	if wErr != nil {
 		return 0, wErr
 	}
-	gzCloseErr := zw.Close()
-	if gzCloseErr != nil {
-		return 0, fmt.Errorf("gz compression err %v", gzCloseErr.Error())
-	}
-	syncErr := f.Sync()
-	if syncErr != nil {
-		return 0, syncErr
-	}
-
-	closeErr := f.Close()
-	if closeErr != nil {
-		return 0, closeErr
-	}
-	//rename tmp
-	renErr := os.Rename(filename+"_TMP", filename)
-	if renErr != nil {
-		return 0, renErr
+	n := len(content)
+	if len(method) == 0 {
+		return n, nil
 	}
 
 	//Internal runtime testing, remove later for better performance. Used early to detect issues IF system produces invalid files and important data is lost
-	refContent, refReadErr := readCompressedFile(filename, method, bitslices)
+	refContent, refReadErr := readCompressedFile(filename, method, coding)
 	if refReadErr != nil {
 		return n, fmt.Errorf("error reading back file %v, err=%v", filename, refReadErr)
 	}
@@ -137,28 +146,65 @@ func writeWithFsyncCowCompressed(filename string, contentOriginal []byte, method
 	return n, nil
 }
 
-//Really paranoidic way of writing file. TODO restore function if rename is failed?
+//Really paranoidic way of writing file. Directory is synced after rename so renamed file survives power cut. TODO restore function if rename is failed?
 func writeWithFsyncCow(filename string, content []byte) (int, error) {
-	f, errOpen := os.OpenFile(filename+"_TMP", os.O_RDWR|os.O_CREATE, 0755)
+	return writeCow(filename, content, true)
+}
+
+//writeCow writes temporary file and renames it over filename. Without syncFile operating system decides when content is on disk
+func writeCow(filename string, content []byte, syncFile bool) (int, error) {
+	n, errTmp := writeTmpFile(filename, content, syncFile)
+	if errTmp != nil {
+		return 0, errTmp
+	}
+	if errRename := renameTmpFile(filename, syncFile); errRename != nil {
+		return 0, errRename
+	}
+	return n, nil
+}
+
+//keepModTime sets modification time of filename same as on original. Retention by age uses modification time
+func keepModTime(filename string, original string) error {
+	info, errStat := os.Stat(original)
+	if errStat != nil {
+		return errStat
+	}
+	return os.Chtimes(filename, info.ModTime(), info.ModTime())
+}
+
+//writeTmpFile writes content to filename_TMP, recovery rolls it back if filename exists
+func writeTmpFile(filename string, content []byte, syncFile bool) (int, error) {
+	f, errOpen := os.OpenFile(filename+"_TMP", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if errOpen != nil {
 		return 0, errOpen
 	}
 	n, wErr := f.Write(content) //Write returns non-nil error when n!=len(content)
 	if wErr != nil {
+		f.Close()
 		return 0, wErr
 	}
-	syncErr := f.Sync()
-	if syncErr != nil {
-		return 0, syncErr
+	if syncFile {
+		syncErr := f.Sync()
+		if syncErr != nil {
+			f.Close()
+			return 0, syncErr
+		}
 	}
 	closeErr := f.Close()
 	if closeErr != nil {
 		return 0, closeErr
 	}
-	//rename tmp
+	return n, nil
+}
+
+//renameTmpFile renames filename_TMP over filename. Directory is synced after rename if syncFile is set
+func renameTmpFile(filename string, syncFile bool) error {
 	renErr := os.Rename(filename+"_TMP", filename)
 	if renErr != nil {
-		return 0, renErr
+		return renErr
 	}
-	return n, nil
+	if syncFile {
+		return syncDir(filepath.Dir(filename))
+	}
+	return nil
 }